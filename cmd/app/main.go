@@ -6,16 +6,24 @@ import (
 	"etl-pipeline/internal/app"
 	"etl-pipeline/pkg/database"
 	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"os"
 
 	"go.uber.org/fx"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
 	fx.New(
 		config.Module,
 		database.Module,
 		app.Module,
 		logger.Module,
 		kakfa.Module,
+		metrics.Module,
 	).Run()
 }
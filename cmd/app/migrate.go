@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"etl-pipeline/config"
+	"etl-pipeline/pkg/database"
+	"etl-pipeline/pkg/logger"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/fx"
+)
+
+const migrateUsage = "usage: app migrate up | down [steps] | status"
+
+// runMigrate runs the migrate subcommand and exits.
+func runMigrate(args []string) {
+	app := fx.New(
+		config.DBModule,
+		logger.Module,
+		database.Module,
+		fx.NopLogger,
+		fx.Invoke(func(pool *pgxpool.Pool, log logger.Logger) error {
+			defer pool.Close()
+
+			migrator, err := database.NewMigrator(pool, log)
+			if err != nil {
+				return err
+			}
+			return migrate(context.Background(), migrator, args)
+		}),
+	)
+	if err := app.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func migrate(ctx context.Context, migrator database.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		count, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migration(s)\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return errors.New(migrateUsage)
+			}
+			steps = n
+		}
+		count, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rolled back %d migration(s)\n", count)
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-24s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -14,6 +14,22 @@ type Config struct {
 	DB          DBConfig
 	Kafka       KafkaConfig
 	Environment EnvironmentConfig
+	Transform   TransformConfig
+	Schema      SchemaConfig
+	Quality     QualityConfig
+	Deadband    DeadbandConfig
+	Counter     CounterConfig
+	Window      WindowConfig
+	Enrich      EnrichConfig
+	Privacy     PrivacyConfig
+	Pipeline    PipelineConfig
+	Loader      LoaderConfig
+	Timescale   TimescaleConfig
+	Partition   PartitionConfig
+	Sink        SinkConfig
+	Routing     RoutingConfig
+	Spool       SpoolConfig
+	Metrics     MetricsConfig
 }
 
 type DBConfig struct {
@@ -23,6 +39,8 @@ type DBConfig struct {
 	Password string `envconfig:"DB_PASSWORD" default:"postgres"`
 	DBName   string `envconfig:"DB_NAME" default:"postgres"`
 	SSLMode  string `envconfig:"SSL_MODE" default:"disable"`
+
+	AutoMigrate bool `envconfig:"DB_AUTO_MIGRATE" default:"false"`
 }
 
 type KafkaConfig struct {
@@ -36,6 +54,9 @@ type KafkaConfig struct {
 	DLQBrokers      []string `envconfig:"KAFKA_DLQ_BROKERS" required:"true"`
 	CommitBatchSize int      `envconfig:"KAFKA_COMMIT_BATCH_SIZE" default:"100"`
 	CommitInterval  int      `envconfig:"KAFKA_COMMIT_INTERVAL" default:"5"`
+	// MaxPendingCommits pauses fetching while this many messages wait for
+	// their offsets to be committed.
+	MaxPendingCommits int `envconfig:"KAFKA_MAX_PENDING_COMMITS" default:"10000"`
 }
 
 type EnvironmentConfig struct {
@@ -44,6 +65,113 @@ type EnvironmentConfig struct {
 	TopicPrefix string `envconfig:"TOPIC_PREFIX" required:"true"`
 }
 
+type TransformConfig struct {
+	RulesPath       string `envconfig:"TRANSFORM_RULES_PATH"`
+	ExpressionsPath string `envconfig:"TRANSFORM_EXPRESSIONS_PATH"`
+	UnitsPath       string `envconfig:"TRANSFORM_UNITS_PATH"`
+
+	Flatten          bool   `envconfig:"TRANSFORM_FLATTEN" default:"false"`
+	FlattenSeparator string `envconfig:"TRANSFORM_FLATTEN_SEPARATOR" default:"_"`
+	FlattenMaxDepth  int    `envconfig:"TRANSFORM_FLATTEN_MAX_DEPTH" default:"0"`
+	FlattenArrays    string `envconfig:"TRANSFORM_FLATTEN_ARRAYS" default:"json"`
+	FlattenKeyCase   string `envconfig:"TRANSFORM_FLATTEN_KEY_CASE" default:"keep"`
+}
+
+type SchemaConfig struct {
+	DriftEnabled bool   `envconfig:"SCHEMA_DRIFT_ENABLED" default:"false"`
+	DriftTopic   string `envconfig:"SCHEMA_DRIFT_TOPIC"`
+	// RemovalAfter is how long a field must go unseen before it is reported
+	// as removed, e.g. 7d. Empty never reports removals.
+	RemovalAfter string `envconfig:"SCHEMA_REMOVAL_AFTER" default:"7d"`
+}
+
+type QualityConfig struct {
+	RulesPath string `envconfig:"QUALITY_RULES_PATH"`
+}
+
+type DeadbandConfig struct {
+	RulesPath     string `envconfig:"DEADBAND_RULES_PATH"`
+	FlushInterval int    `envconfig:"DEADBAND_FLUSH_INTERVAL" default:"30"`
+	StateTTL      string `envconfig:"DEADBAND_STATE_TTL" default:"30d"`
+}
+
+type CounterConfig struct {
+	RulesPath     string `envconfig:"COUNTER_RULES_PATH"`
+	FlushInterval int    `envconfig:"COUNTER_FLUSH_INTERVAL" default:"30"`
+	StateTTL      string `envconfig:"COUNTER_STATE_TTL" default:"30d"`
+}
+
+type WindowConfig struct {
+	Sizes           []string `envconfig:"WINDOW_SIZES"`
+	AllowedLateness int      `envconfig:"WINDOW_ALLOWED_LATENESS" default:"60"`
+	FlushInterval   int      `envconfig:"WINDOW_FLUSH_INTERVAL" default:"5"`
+}
+
+type EnrichConfig struct {
+	Enabled     bool     `envconfig:"ENRICH_ENABLED" default:"false"`
+	Attributes  []string `envconfig:"ENRICH_ATTRIBUTES" default:"site,asset_type,meter_serial,timezone"`
+	Prefix      string   `envconfig:"ENRICH_PREFIX"`
+	CacheSize   int      `envconfig:"ENRICH_CACHE_SIZE" default:"10000"`
+	CacheTTL    int      `envconfig:"ENRICH_CACHE_TTL" default:"300"`
+	NegativeTTL int      `envconfig:"ENRICH_NEGATIVE_TTL" default:"60"`
+	Preload     bool     `envconfig:"ENRICH_PRELOAD" default:"true"`
+	Listen      bool     `envconfig:"ENRICH_LISTEN" default:"true"`
+}
+
+type PrivacyConfig struct {
+	PolicyPath string `envconfig:"PRIVACY_POLICY_PATH"`
+	HMACKey    string `envconfig:"PRIVACY_HMAC_KEY"`
+}
+
+type PipelineConfig struct {
+	Stages []string `envconfig:"PIPELINE_STAGES" default:"extract,transform,privacy,rules,units,compute,flatten,enrich,counter,schema,quality,deadband,load,window"`
+	Hooks  []string `envconfig:"PIPELINE_HOOKS"`
+}
+
+type LoaderConfig struct {
+	WideTablesPath string `envconfig:"LOAD_WIDE_TABLES_PATH"`
+	Format         string `envconfig:"LOAD_FORMAT" default:"jsonb"`
+	NarrowTable    string `envconfig:"LOAD_NARROW_TABLE" default:"device_metrics"`
+	LatestState    bool   `envconfig:"LOAD_LATEST_STATE" default:"false"`
+}
+
+type TimescaleConfig struct {
+	ConfigPath string `envconfig:"TIMESCALE_CONFIG_PATH"`
+	DryRun     bool   `envconfig:"TIMESCALE_DRY_RUN" default:"false"`
+}
+
+type PartitionConfig struct {
+	ConfigPath    string `envconfig:"PARTITION_CONFIG_PATH"`
+	CheckInterval int    `envconfig:"PARTITION_CHECK_INTERVAL" default:"3600"`
+}
+
+type SinkConfig struct {
+	ConfigPath string `envconfig:"SINKS_CONFIG_PATH"`
+}
+
+type RoutingConfig struct {
+	ConfigPath string `envconfig:"DB_ROUTES_PATH"`
+	// MaxPools bounds the connection pools kept open for routed tenants.
+	MaxPools int `envconfig:"DB_ROUTE_MAX_POOLS" default:"16"`
+	// PoolIdle is how long, in seconds, an unused route pool stays open.
+	PoolIdle int `envconfig:"DB_ROUTE_POOL_IDLE" default:"1800"`
+}
+
+type SpoolConfig struct {
+	Dir          string `envconfig:"SPOOL_DIR"`
+	MaxBytes     int64  `envconfig:"SPOOL_MAX_BYTES" default:"1073741824"`
+	SegmentBytes int64  `envconfig:"SPOOL_SEGMENT_BYTES" default:"16777216"`
+}
+
+type MetricsConfig struct {
+	Addr string `envconfig:"METRICS_ADDR" default:":9090"`
+	// MaxTenants bounds the tenant label values; further tenants are
+	// reported as "other".
+	MaxTenants int `envconfig:"METRICS_MAX_TENANTS" default:"100"`
+	// MaxDeviceTypes bounds the device type label values the same way.
+	MaxDeviceTypes int `envconfig:"METRICS_MAX_DEVICE_TYPES" default:"100"`
+}
+
 func NewConfig() (*Config, error) {
 	LoadConfig()
 
@@ -58,6 +186,79 @@ func NewConfig() (*Config, error) {
 	if err := envconfig.Process("", &cfg.Environment); err != nil {
 		log.Fatalf("Failed to process Environment config: %v", err)
 	}
+	if err := envconfig.Process("", &cfg.Transform); err != nil {
+		log.Fatalf("Failed to process Transform config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Schema); err != nil {
+		log.Fatalf("Failed to process Schema config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Quality); err != nil {
+		log.Fatalf("Failed to process Quality config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Deadband); err != nil {
+		log.Fatalf("Failed to process Deadband config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Counter); err != nil {
+		log.Fatalf("Failed to process Counter config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Window); err != nil {
+		log.Fatalf("Failed to process Window config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Enrich); err != nil {
+		log.Fatalf("Failed to process Enrich config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Privacy); err != nil {
+		log.Fatalf("Failed to process Privacy config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Pipeline); err != nil {
+		log.Fatalf("Failed to process Pipeline config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Loader); err != nil {
+		log.Fatalf("Failed to process Loader config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Timescale); err != nil {
+		log.Fatalf("Failed to process Timescale config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Partition); err != nil {
+		log.Fatalf("Failed to process Partition config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Sink); err != nil {
+		log.Fatalf("Failed to process Sink config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Routing); err != nil {
+		log.Fatalf("Failed to process Routing config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Spool); err != nil {
+		log.Fatalf("Failed to process Spool config: %v", err)
+	}
+	if err := envconfig.Process("", &cfg.Metrics); err != nil {
+		log.Fatalf("Failed to process Metrics config: %v", err)
+	}
+
+	return &cfg, nil
+}
+
+// NewDBConfig reads only the database settings and the environment name,
+// so commands such as migrate run without the Kafka settings. Auto-migration
+// is left off, as such commands decide what to apply.
+func NewDBConfig() (*Config, error) {
+	LoadConfig()
+
+	var cfg Config
+
+	if err := envconfig.Process("", &cfg.DB); err != nil {
+		log.Fatalf("Failed to process DB config: %v", err)
+	}
+	cfg.DB.AutoMigrate = false
+
+	// EnvironmentConfig also requires settings only the pipeline uses.
+	var env struct {
+		Env string `envconfig:"ENVIRONMENT" default:"development"`
+	}
+	if err := envconfig.Process("", &env); err != nil {
+		log.Fatalf("Failed to process Environment config: %v", err)
+	}
+	cfg.Environment.Env = env.Env
 
 	return &cfg, nil
 }
@@ -80,3 +281,8 @@ func LoadConfig() {
 var Module = fx.Options(
 	fx.Provide(NewConfig),
 )
+
+// DBModule provides a Config holding only what NewDBConfig reads.
+var DBModule = fx.Options(
+	fx.Provide(NewDBConfig),
+)
@@ -8,6 +8,9 @@ var Module = fx.Options(
 	fx.Provide(NewPool),
 	fx.Provide(NewKafkaReader),
 	fx.Provide(NewKafkaWriter),
+	fx.Provide(NewEventPublisher),
+	fx.Provide(NewProducer),
+	fx.Provide(NewDeadLetter),
 	fx.Invoke(RunReader),
 	fx.Invoke(RunWriter),
 )
@@ -3,20 +3,29 @@ package kafka
 import (
 	"context"
 	"etl-pipeline/config"
+	"etl-pipeline/pkg/metrics"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 )
 
+const queueSize = 1000
+
 type Task func(ctx context.Context)
 
 type Pool interface {
 	Start()
-	Submit(task Task)
+	// Submit queues task on the worker owning key, so tasks with the same
+	// key run one at a time and in order. Tasks without a key are spread
+	// over the workers.
+	Submit(key []byte, task Task)
 	Stop()
 }
 
 type pool struct {
 	numberWorker int
-	tasks        chan Task
+	queues       []chan Task
+	next         atomic.Uint64
 	wg           sync.WaitGroup
 	ctx          context.Context
 	cancel       context.CancelFunc
@@ -24,9 +33,14 @@ type pool struct {
 
 func NewPool(config *config.Config) Pool {
 	ctx, cancel := context.WithCancel(context.Background())
+	numberWorker := max(config.Environment.NumWorkers, 1)
+	queues := make([]chan Task, numberWorker)
+	for i := range queues {
+		queues[i] = make(chan Task, max(queueSize/numberWorker, 1))
+	}
 	return &pool{
-		numberWorker: config.Environment.NumWorkers,
-		tasks:        make(chan Task, 1000),
+		numberWorker: numberWorker,
+		queues:       queues,
 		ctx:          ctx,
 		cancel:       cancel,
 	}
@@ -41,16 +55,28 @@ func (p *pool) Start() {
 				select {
 				case <-p.ctx.Done():
 					return
-				case task := <-p.tasks:
+				case task := <-p.queues[id]:
+					metrics.PoolQueueDepth.Dec()
+					metrics.PoolBusyWorkers.Inc()
 					task(p.ctx)
+					metrics.PoolBusyWorkers.Dec()
 				}
 			}
 		}(i)
 	}
 }
 
-func (p *pool) Submit(task Task) {
-	p.tasks <- task
+func (p *pool) Submit(key []byte, task Task) {
+	var index uint64
+	if len(key) > 0 {
+		h := fnv.New64a()
+		h.Write(key)
+		index = h.Sum64()
+	} else {
+		index = p.next.Add(1)
+	}
+	metrics.PoolQueueDepth.Inc()
+	p.queues[index%uint64(p.numberWorker)] <- task
 }
 
 func (p *pool) Stop() {
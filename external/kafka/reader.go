@@ -2,9 +2,15 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"etl-pipeline/config"
 	"etl-pipeline/internal/processor"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/internal/service/sink"
+	"etl-pipeline/internal/service/window"
 	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,20 +28,27 @@ type Reader interface {
 type kafkaReader struct {
 	reader          *kafka.Reader
 	processor       processor.Processor
+	sinks           sink.Dispatcher
+	windows         window.Aggregator
 	logger          logger.Logger
 	pool            Pool
 	writer          Writer
 	commitBatchSize int
 	commitInterval  time.Duration
+	maxPending      int
 	commitMutex     sync.Mutex
 	pendingMessages []kafka.Message
 	commitTicker    *time.Ticker
+	// paused is only touched by the read loop.
+	paused bool
 }
 
 type ReaderParams struct {
 	fx.In
 	Config    *config.Config
 	Processor processor.Processor
+	Sinks     sink.Dispatcher
+	Windows   window.Aggregator
 	Logger    logger.Logger
 	Pool      Pool
 	Writer    Writer
@@ -73,11 +86,14 @@ func NewKafkaReader(p ReaderParams) Reader {
 	return &kafkaReader{
 		reader:          reader,
 		processor:       p.Processor,
+		sinks:           p.Sinks,
+		windows:         p.Windows,
 		logger:          p.Logger,
 		pool:            p.Pool,
 		writer:          p.Writer,
 		commitBatchSize: p.Config.Kafka.CommitBatchSize,
 		commitInterval:  time.Duration(p.Config.Kafka.CommitInterval) * time.Second,
+		maxPending:      p.Config.Kafka.MaxPendingCommits,
 		pendingMessages: make([]kafka.Message, 0, p.Config.Kafka.CommitBatchSize),
 	}
 }
@@ -108,6 +124,7 @@ func (r *kafkaReader) startCommitTicker(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case <-r.commitTicker.C:
+				r.recordStats()
 				r.commitPendingMessages(ctx)
 			}
 		}
@@ -129,6 +146,14 @@ func (r *kafkaReader) readLoop(ctx context.Context) {
 
 // readAndHandleMessage reads and handles a message from the Kafka reader
 func (r *kafkaReader) readAndHandleMessage(ctx context.Context) {
+	if r.backlogged() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		return
+	}
+
 	readCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
@@ -142,7 +167,14 @@ func (r *kafkaReader) readAndHandleMessage(ctx context.Context) {
 		return
 	}
 
-	r.pool.Submit(func(taskCtx context.Context) {
+	metrics.MessagesConsumedTotal.WithLabelValues(msg.Topic).Inc()
+	if msg.HighWaterMark > 0 {
+		metrics.ConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).Set(float64(msg.HighWaterMark - msg.Offset - 1))
+	}
+
+	// Hono keys records by device, so a device's messages are handled in
+	// order by one worker.
+	r.pool.Submit(msg.Key, func(taskCtx context.Context) {
 		r.handleMessage(taskCtx, msg)
 	})
 }
@@ -163,9 +195,11 @@ func (r *kafkaReader) handleMessage(ctx context.Context, msg kafka.Message) {
 
 	err := r.retryProcess(msg, r.reader.Config().MaxAttempts)
 	if err != nil {
+		metrics.MessagesFailedTotal.WithLabelValues(msg.Topic).Inc()
+		processor.CountFailure(err)
 		r.logger.Error("Error processing message",
 			zap.String("topic", msg.Topic),
-			zap.Error(err),
+			zap.String("error", privacy.RedactError(err)),
 		)
 
 		if dlqErr := r.writer.WriteToDLQ(ctx, msg, err); dlqErr != nil {
@@ -174,6 +208,8 @@ func (r *kafkaReader) handleMessage(ctx context.Context, msg kafka.Message) {
 				zap.Error(dlqErr),
 			)
 		}
+	} else if !msg.Time.IsZero() {
+		metrics.EndToEndDuration.Observe(time.Since(msg.Time).Seconds())
 	}
 
 	r.queueMessageForCommit(ctx, msg)
@@ -183,11 +219,13 @@ func (r *kafkaReader) handleMessage(ctx context.Context, msg kafka.Message) {
 func (r *kafkaReader) queueMessageForCommit(ctx context.Context, msg kafka.Message) {
 	r.commitMutex.Lock()
 	r.pendingMessages = append(r.pendingMessages, msg)
+	metrics.PendingCommits.Set(float64(len(r.pendingMessages)))
 
 	if len(r.pendingMessages) >= r.commitBatchSize {
 		batch := make([]kafka.Message, len(r.pendingMessages))
 		copy(batch, r.pendingMessages)
 		r.pendingMessages = r.pendingMessages[:0]
+		metrics.PendingCommits.Set(0)
 		r.commitMutex.Unlock()
 
 		r.commitMessages(ctx, batch)
@@ -196,6 +234,25 @@ func (r *kafkaReader) queueMessageForCommit(ctx context.Context, msg kafka.Messa
 	}
 }
 
+// backlogged reports whether so many messages wait for a commit that
+// fetching should pause. That happens while flushing keeps failing; the
+// commit ticker retries until it succeeds.
+func (r *kafkaReader) backlogged() bool {
+	r.commitMutex.Lock()
+	pending := len(r.pendingMessages)
+	r.commitMutex.Unlock()
+
+	full := r.maxPending > 0 && pending >= r.maxPending
+	if full && !r.paused {
+		r.logger.Warn("Too many messages waiting for commit, pausing consumption",
+			zap.Int("pending", pending))
+	} else if !full && r.paused {
+		r.logger.Info("Resuming consumption")
+	}
+	r.paused = full
+	return full
+}
+
 // commitPendingMessages commits pending messages
 func (r *kafkaReader) commitPendingMessages(ctx context.Context) {
 	r.commitMutex.Lock()
@@ -208,13 +265,30 @@ func (r *kafkaReader) commitPendingMessages(ctx context.Context) {
 	batch := make([]kafka.Message, len(r.pendingMessages))
 	copy(batch, r.pendingMessages)
 	r.pendingMessages = r.pendingMessages[:0]
+	metrics.PendingCommits.Set(0)
 
 	go r.commitMessages(ctx, batch)
 }
 
-// commitMessages commits a batch of messages
+// commitMessages commits a batch of messages once the sinks and window
+// rollups have written what they buffered for it. When flushing fails the
+// batch is queued again.
 func (r *kafkaReader) commitMessages(ctx context.Context, msgs []kafka.Message) {
+	if err := errors.Join(r.sinks.Flush(ctx), r.windows.Flush(ctx)); err != nil {
+		r.logger.Error("Error flushing sinks or windows, postponing commit",
+			zap.Int("batch_size", len(msgs)),
+			zap.Error(err),
+		)
+		metrics.CommitsTotal.WithLabelValues("error").Inc()
+		r.commitMutex.Lock()
+		r.pendingMessages = append(msgs, r.pendingMessages...)
+		metrics.PendingCommits.Set(float64(len(r.pendingMessages)))
+		r.commitMutex.Unlock()
+		return
+	}
+
 	if err := r.reader.CommitMessages(ctx, msgs...); err != nil {
+		metrics.CommitsTotal.WithLabelValues("error").Inc()
 		r.logger.Error("Error committing messages batch",
 			zap.Int("batch_size", len(msgs)),
 			zap.Error(err),
@@ -222,10 +296,19 @@ func (r *kafkaReader) commitMessages(ctx context.Context, msgs []kafka.Message)
 		return
 	}
 
+	metrics.CommitsTotal.WithLabelValues("ok").Inc()
+	metrics.CommittedMessagesTotal.Add(float64(len(msgs)))
 	r.logger.Info("Committed message batch",
 		zap.Int("batch_size", len(msgs)))
 }
 
+// recordStats publishes the reader's own view of lag and buffered messages.
+func (r *kafkaReader) recordStats() {
+	stats := r.reader.Stats()
+	metrics.ReaderLag.Set(float64(stats.Lag))
+	metrics.ReaderQueueLength.Set(float64(stats.QueueLength))
+}
+
 // retryProcess retries processing a message
 func (r *kafkaReader) retryProcess(msg kafka.Message, maxAttempts int) error {
 	var err error
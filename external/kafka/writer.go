@@ -3,10 +3,17 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"etl-pipeline/config"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/internal/service/sink"
 	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -15,19 +22,24 @@ import (
 type Writer interface {
 	WriteMessages(ctx context.Context, topic string, messages ...kafka.Message) error
 	WriteToDLQ(ctx context.Context, msg kafka.Message, err error) error
+	WriteSinkFailure(ctx context.Context, sink string, key, value []byte, err error) error
+	Produce(ctx context.Context, topic string, messages ...kafka.Message) error
 	Close() error
 }
 
 type writer struct {
-	writer *kafka.Writer
-	dlq    *kafka.Writer
-	logger logger.Logger
+	writer  *kafka.Writer
+	durable *kafka.Writer
+	dlq     *kafka.Writer
+	privacy privacy.Policy
+	logger  logger.Logger
 }
 
 type WriterParams struct {
 	fx.In
-	Config *config.Config
-	Logger logger.Logger
+	Config  *config.Config
+	Privacy privacy.Policy
+	Logger  logger.Logger
 }
 
 func NewKafkaWriter(p WriterParams) Writer {
@@ -36,28 +48,42 @@ func NewKafkaWriter(p WriterParams) Writer {
 		p.Logger.Fatal("failed to create secure dialer", zap.Error(err))
 	}
 
+	// The topic is set per message in WriteMessages, so the writer itself
+	// must not be bound to one.
 	w := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:      p.Config.Kafka.Brokers,
-		Topic:        p.Config.Kafka.Topics[0],
 		BatchSize:    100,
 		BatchTimeout: 100 * time.Millisecond,
 		Dialer:       dialer,
 		Async:        true,
 	})
 
+	// Sink records and DLQ messages stand in for the offsets committed after
+	// them, so they are written synchronously and acknowledged by every
+	// in-sync replica. Writes from concurrent workers still share batches.
+	durable := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      p.Config.Kafka.Brokers,
+		BatchSize:    100,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: int(kafka.RequireAll),
+		Dialer:       dialer,
+	})
+
 	dlq := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:      p.Config.Kafka.DLQBrokers,
 		Topic:        p.Config.Kafka.DLQTopic,
 		BatchSize:    100,
-		BatchTimeout: 100 * time.Millisecond,
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: int(kafka.RequireAll),
 		Dialer:       dialer,
-		Async:        true,
 	})
 
 	return &writer{
-		writer: w,
-		dlq:    dlq,
-		logger: p.Logger,
+		writer:  w,
+		durable: durable,
+		dlq:     dlq,
+		privacy: p.Privacy,
+		logger:  p.Logger,
 	}
 }
 
@@ -69,23 +95,42 @@ func (w *writer) WriteMessages(ctx context.Context, topic string, messages ...ka
 	return w.writer.WriteMessages(ctx, messages...)
 }
 
-// WriteToDLQ writes a message to the DLQ
+// Produce writes messages synchronously and returns the delivery error
+func (w *writer) Produce(ctx context.Context, topic string, messages ...kafka.Message) error {
+	for i := range messages {
+		messages[i].Topic = topic
+	}
+	return w.durable.WriteMessages(ctx, messages...)
+}
+
+// WriteToDLQ writes a message to the DLQ with the privacy policy applied.
+// Values quoted in the error are redacted as well.
 func (w *writer) WriteToDLQ(ctx context.Context, msg kafka.Message, err error) error {
+	value, ok := w.privacy.ApplyMessage(msg.Value)
+	reason := privacy.RedactError(err)
+
 	// Create error details
 	errorDetails := map[string]interface{}{
-		"error":     err.Error(),
+		"error":     reason,
 		"timestamp": time.Now().UTC(),
 		"topic":     msg.Topic,
 		"partition": msg.Partition,
 		"offset":    msg.Offset,
 		"key":       string(msg.Key),
 	}
+	if !ok {
+		errorDetails["payload_withheld"] = true
+	}
+	failed := sink.FailedSinks(err)
+	if len(failed) > 0 {
+		errorDetails["sinks"] = failed
+	}
 
 	// Convert error details to JSON
-	errorJSON, err := json.Marshal(errorDetails)
-	if err != nil {
-		w.logger.Error("Failed to marshal error details", zap.Error(err))
-		errorJSON = []byte(err.Error())
+	errorJSON, marshalErr := json.Marshal(errorDetails)
+	if marshalErr != nil {
+		w.logger.Error("Failed to marshal error details", zap.Error(marshalErr))
+		errorJSON = []byte(reason)
 	}
 
 	// Add error information to message headers
@@ -93,11 +138,14 @@ func (w *writer) WriteToDLQ(ctx context.Context, msg kafka.Message, err error) e
 		Key:   "error_details",
 		Value: errorJSON,
 	})
+	if len(failed) > 0 {
+		headers = append(headers, kafka.Header{Key: "sink", Value: []byte(strings.Join(failed, ","))})
+	}
 
 	dlqMsg := kafka.Message{
 		Topic:   w.dlq.Topic,
 		Key:     msg.Key,
-		Value:   msg.Value,
+		Value:   value,
 		Headers: headers,
 		Time:    time.Now(),
 	}
@@ -105,17 +153,92 @@ func (w *writer) WriteToDLQ(ctx context.Context, msg kafka.Message, err error) e
 	w.logger.Info("Writing message to DLQ",
 		zap.String("topic", msg.Topic),
 		zap.String("dlq_topic", w.dlq.Topic),
-		zap.Error(err))
+		zap.String("error", reason))
 
-	return w.dlq.WriteMessages(ctx, dlqMsg)
+	return recordDLQWrite("pipeline", w.dlq.WriteMessages(ctx, dlqMsg))
+}
+
+// WriteSinkFailure writes a record one sink failed to deliver to the DLQ.
+// The record comes out of the pipeline, after the privacy stage, so the
+// message policy is not applied again. Values quoted in the error are
+// redacted, and Postgres errors are reported by code, table, column and
+// constraint rather than by their detail, which echoes values.
+func (w *writer) WriteSinkFailure(ctx context.Context, sink string, key, value []byte, err error) error {
+	reason := privacy.RedactError(err)
+	errorDetails := map[string]interface{}{
+		"error":     reason,
+		"timestamp": time.Now().UTC(),
+		"sink":      sink,
+		"key":       string(key),
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		errorDetails["pg_code"] = pgErr.Code
+		for name, field := range map[string]string{
+			"pg_table":      pgErr.TableName,
+			"pg_column":     pgErr.ColumnName,
+			"pg_constraint": pgErr.ConstraintName,
+		} {
+			if field != "" {
+				errorDetails[name] = field
+			}
+		}
+	}
+
+	errorJSON, marshalErr := json.Marshal(errorDetails)
+	if marshalErr != nil {
+		w.logger.Error("Failed to marshal error details", zap.Error(marshalErr))
+		errorJSON = []byte(reason)
+	}
+
+	dlqMsg := kafka.Message{
+		Topic: w.dlq.Topic,
+		Key:   key,
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "sink", Value: []byte(sink)},
+			{Key: "error_details", Value: errorJSON},
+		},
+		Time: time.Now(),
+	}
+
+	w.logger.Info("Writing sink failure to DLQ",
+		zap.String("sink", sink),
+		zap.String("dlq_topic", w.dlq.Topic),
+		zap.String("error", reason))
+
+	return recordDLQWrite(sink, w.dlq.WriteMessages(ctx, dlqMsg))
+}
+
+// recordDLQWrite counts a DLQ write for the sink that failed; whole
+// messages the pipeline gave up on count as "pipeline".
+func recordDLQWrite(sink string, err error) error {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.DLQWritesTotal.WithLabelValues(sink, result).Inc()
+	return err
+}
+
+// NewEventPublisher exposes the writer to services that publish events
+func NewEventPublisher(w Writer) event.Publisher {
+	return w
+}
+
+// NewProducer exposes the synchronous writer to the Kafka sinks
+func NewProducer(w Writer) event.Producer {
+	return w
+}
+
+// NewDeadLetter exposes the DLQ to the sinks
+func NewDeadLetter(w Writer) event.DeadLetter {
+	return w
 }
 
 // Close closes the Kafka writer
 func (w *writer) Close() error {
-	if err := w.writer.Close(); err != nil {
-		return err
-	}
-	return w.dlq.Close()
+	return errors.Join(w.writer.Close(), w.durable.Close(), w.dlq.Close())
 }
 
 // RunWriter runs the Kafka writer
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// Aggregate is a partial or complete rollup of one field over one window.
+// Partial aggregates of the same window merge by upsert.
+type Aggregate struct {
+	TenantID string    `json:"tenant_id"`
+	DeviceID string    `json:"device_id"`
+	Field    string    `json:"field"`
+	Bucket   time.Time `json:"bucket"`
+	Min      float64   `json:"min"`
+	Max      float64   `json:"max"`
+	Sum      float64   `json:"sum"`
+	Count    int64     `json:"count"`
+	Last     float64   `json:"last"`
+	LastTime time.Time `json:"last_ts"`
+}
+
+func (a *Aggregate) Add(value float64, timestamp time.Time) {
+	if a.Count == 0 || value < a.Min {
+		a.Min = value
+	}
+	if a.Count == 0 || value > a.Max {
+		a.Max = value
+	}
+	if a.Count == 0 || !timestamp.Before(a.LastTime) {
+		a.Last = value
+		a.LastTime = timestamp
+	}
+	a.Sum += value
+	a.Count++
+}
+
+func (a *Aggregate) Avg() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+	return a.Sum / float64(a.Count)
+}
@@ -0,0 +1,9 @@
+package model
+
+// Device is a registry entry used to enrich telemetry with metadata the
+// device itself does not send.
+type Device struct {
+	TenantID   string                 `json:"tenant_id"`
+	DeviceID   string                 `json:"device_id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
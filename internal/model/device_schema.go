@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+type FieldSchema struct {
+	Types     []string  `json:"types"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type DeviceSchema struct {
+	TenantID   string                 `json:"tenant_id"`
+	DeviceType string                 `json:"device_type"`
+	Fields     map[string]FieldSchema `json:"fields"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+const (
+	DriftFieldAdded       = "field_added"
+	DriftFieldRemoved     = "field_removed"
+	DriftFieldTypeChanged = "field_type_changed"
+)
+
+type SchemaDriftEvent struct {
+	Kind       string    `json:"kind"`
+	TenantID   string    `json:"tenant_id"`
+	DeviceType string    `json:"device_type"`
+	DeviceID   string    `json:"device_id"`
+	Field      string    `json:"field"`
+	OldTypes   []string  `json:"old_types,omitempty"`
+	NewType    string    `json:"new_type,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
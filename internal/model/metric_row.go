@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// MetricRow is one field of a record in the narrow metric table. Exactly one
+// of the value columns is set.
+type MetricRow struct {
+	TenantID    string    `json:"tenant_id"`
+	DeviceID    string    `json:"device_id"`
+	Timestamp   time.Time `json:"ts"`
+	Metric      string    `json:"metric"`
+	ValueDouble *float64  `json:"value_double,omitempty"`
+	ValueText   *string   `json:"value_text,omitempty"`
+	ValueBool   *bool     `json:"value_bool,omitempty"`
+	// QualityCode and QualityViolations repeat the record's quality result.
+	QualityCode       int      `json:"quality_code"`
+	QualityViolations []string `json:"quality_violations"`
+}
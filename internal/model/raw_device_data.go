@@ -2,9 +2,18 @@ package model
 
 import "time"
 
+const (
+	QualityGood      = 0
+	QualityUncertain = 1
+	QualityBad       = 2
+)
+
 type RawDeviceData struct {
-	TenantID  string                 `json:"tenant_id"`
-	DeviceID  string                 `json:"device_id"`
-	Timestamp time.Time              `json:"timestamp"`
-	Data      map[string]interface{} `json:"data"`
+	TenantID          string                 `json:"tenant_id"`
+	DeviceID          string                 `json:"device_id"`
+	DeviceType        string                 `json:"device_type,omitempty"`
+	Timestamp         time.Time              `json:"timestamp"`
+	Data              map[string]interface{} `json:"data"`
+	QualityCode       int                    `json:"quality_code"`
+	QualityViolations []string               `json:"quality_violations"`
 }
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+const (
+	StateKindDeadband = "deadband"
+	StateKindCounter  = "counter"
+)
+
+// StateEntry is the persisted per device and field state of a stateful stage,
+// so the stage can resume where it left off after a restart.
+type StateEntry struct {
+	Kind      string      `json:"kind"`
+	TenantID  string      `json:"tenant_id"`
+	DeviceID  string      `json:"device_id"`
+	Field     string      `json:"field"`
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Hypertable is the live TimescaleDB configuration of a hypertable.
+type Hypertable struct {
+	Table              string
+	TimeColumn         string
+	ChunkInterval      time.Duration
+	CompressionEnabled bool
+	SegmentBy          []string
+	OrderBy            string
+}
+
+// RefreshPolicy is the refresh schedule of a continuous aggregate. Nil
+// offsets are unbounded.
+type RefreshPolicy struct {
+	StartOffset      *time.Duration
+	EndOffset        *time.Duration
+	ScheduleInterval time.Duration
+}
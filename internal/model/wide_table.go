@@ -0,0 +1,18 @@
+package model
+
+// Column types of wide tables, spelled as information_schema reports them.
+const (
+	ColumnBoolean = "boolean"
+	ColumnBigint  = "bigint"
+	ColumnDouble  = "double precision"
+	ColumnText    = "text"
+	ColumnJSONB   = "jsonb"
+)
+
+// ColumnChange is a schema change to a wide table. An empty From adds the
+// column; otherwise the column is widened from From to Type.
+type ColumnChange struct {
+	Column string
+	Type   string
+	From   string
+}
@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"etl-pipeline/pkg/logger"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// HookTiming is the name of the built-in hook that logs stage latencies.
+const HookTiming = "timing"
+
+type BuiltinHooksResult struct {
+	fx.Out
+	Hooks []Hook `group:"hooks,flatten"`
+}
+
+func NewBuiltinHooks(log logger.Logger) BuiltinHooksResult {
+	return BuiltinHooksResult{Hooks: []Hook{&timingHook{logger: log}}}
+}
+
+type timingHook struct {
+	logger logger.Logger
+}
+
+func (h *timingHook) Name() string {
+	return HookTiming
+}
+
+func (h *timingHook) Before(string, *Message) {}
+
+func (h *timingHook) After(stage string, msg *Message, elapsed time.Duration, err error) {
+	h.logger.Debug("Stage finished",
+		zap.String("stage", stage),
+		zap.Duration("elapsed", elapsed),
+		zap.Bool("failed", err != nil),
+		zap.String("tenantID", msg.Identity.TenantId),
+		zap.String("deviceID", msg.Identity.DeviceId))
+}
@@ -0,0 +1,41 @@
+package processor
+
+import "sync"
+
+// deviceLocks serializes the messages of one device between reading and
+// committing stage state. Entries are dropped once no message holds them.
+type deviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*deviceLock
+}
+
+type deviceLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newDeviceLocks() *deviceLocks {
+	return &deviceLocks{locks: make(map[string]*deviceLock)}
+}
+
+// lock blocks until key is free and returns the function releasing it.
+func (l *deviceLocks) lock(key string) func() {
+	l.mu.Lock()
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &deviceLock{}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		l.mu.Lock()
+		if entry.refs--; entry.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
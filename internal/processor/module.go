@@ -3,5 +3,7 @@ package processor
 import "go.uber.org/fx"
 
 var Module = fx.Options(
+	fx.Provide(NewBuiltinStages),
+	fx.Provide(NewBuiltinHooks),
 	fx.Provide(NewProcessor),
 )
@@ -1,11 +1,18 @@
 package processor
 
 import (
-	"etl-pipeline/internal/service/extract"
-	"etl-pipeline/internal/service/load"
-	"etl-pipeline/internal/service/transform"
+	"context"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/privacy"
 	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"net"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 )
@@ -15,60 +22,125 @@ type Processor interface {
 }
 
 type processor struct {
-	Logger    logger.Logger
-	Extract   extract.HonoExtractor
-	Transform transform.HonoTransformer
-	Load      load.Loader
+	Logger logger.Logger
+	Stages []Stage
+	Hooks  []Hook
+	locks  *deviceLocks
 }
 
 type ProcessorParams struct {
 	fx.In
-	Logger    logger.Logger
-	Extract   extract.HonoExtractor
-	Transform transform.HonoTransformer
-	Load      load.Loader
+	Config *config.Config
+	Logger logger.Logger
+	Stages []Stage `group:"stages"`
+	Hooks  []Hook  `group:"hooks"`
 }
 
-func NewProcessor(params ProcessorParams) Processor {
-	return &processor{
-		Logger:    params.Logger,
-		Extract:   params.Extract,
-		Transform: params.Transform,
-		Load:      params.Load,
+func NewProcessor(params ProcessorParams) (Processor, error) {
+	stages, err := buildChain(params.Config.Pipeline.Stages, params.Stages, params.Config.Privacy.PolicyPath != "")
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := selectHooks(params.Config.Pipeline.Hooks, params.Hooks)
+	if err != nil {
+		return nil, err
 	}
+
+	return &processor{
+		Logger: params.Logger,
+		Stages: stages,
+		Hooks:  hooks,
+		locks:  newDeviceLocks(),
+	}, nil
 }
 
+// Process runs the message through every stage in order. Side effects
+// registered with OnCommit run only when all stages succeeded. Once a stage
+// has identified the device, messages of the same device wait for each
+// other, so stateful stages never read state another message is about to
+// commit.
 func (p *processor) Process(data []byte) error {
-	identity, value, timestamp, err := p.Extract.Extracter(data)
-	if err != nil {
-		p.Logger.Error("Failed to extract", zap.Error(err))
-		return err
-	}
+	msg := newMessage(data)
+	var unlock func()
+	defer func() {
+		if unlock != nil {
+			unlock()
+		}
+	}()
 
-	transformedData, err := p.Transform.HonoTransform(value)
-	if err != nil {
-		p.Logger.Error("Failed to transform data",
-			zap.Error(err),
-			zap.String("tenantID", identity.TenantId),
-			zap.String("deviceID", identity.DeviceId))
-		return err
-	}
+	for _, stage := range p.Stages {
+		if unlock == nil && msg.Identity.DeviceId != "" {
+			unlock = p.locks.lock(msg.Identity.TenantId + "/" + msg.Identity.DeviceId)
+		}
 
-	p.Logger.Info("Processing message",
-		zap.Any("transformedData", transformedData),
-		zap.String("tenantID", identity.TenantId),
-		zap.String("deviceID", identity.DeviceId))
+		name := stage.Name()
+		for _, hook := range p.Hooks {
+			hook.Before(name, msg)
+		}
 
-	err = p.Load.Load(identity.TenantId, identity.DeviceId, timestamp, transformedData)
-	if err != nil {
-		p.Logger.Error("Error load data",
-			zap.Any("error", err))
-		return err
-	}
+		reported := len(msg.Errors)
+		start := time.Now()
+		err := stage.Run(msg)
+		elapsed := time.Since(start)
+		metrics.StageDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+
+		for _, hook := range p.Hooks {
+			hook.After(name, msg, elapsed, err)
+		}
 
-	p.Logger.Info("Message inserted",
-		zap.String("tenantID", identity.TenantId),
-		zap.String("deviceID", identity.DeviceId))
+		for _, stageErr := range msg.Errors[reported:] {
+			p.Logger.Warn("Stage reported an error",
+				zap.String("stage", stageErr.Stage),
+				zap.String("error", privacy.RedactError(stageErr.Err)),
+				zap.String("tenantID", msg.Identity.TenantId),
+				zap.String("deviceID", msg.Identity.DeviceId))
+		}
 
+		if err != nil {
+			p.Logger.Error("Stage failed",
+				zap.String("stage", name),
+				zap.String("error", privacy.RedactError(err)),
+				zap.String("tenantID", msg.Identity.TenantId),
+				zap.String("deviceID", msg.Identity.DeviceId))
+			return &Failure{Stage: name, TenantID: msg.Identity.TenantId, Err: err}
+		}
+	}
+
+	msg.commit()
+	metrics.MessagesProcessedTotal.WithLabelValues(metrics.Tenant(msg.Identity.TenantId)).Inc()
 	return nil
 }
+
+// CountFailure counts a message that failed for good. Process leaves it to
+// the caller, which may still retry the message.
+func CountFailure(err error) {
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		return
+	}
+	metrics.StageFailuresTotal.WithLabelValues(metrics.Tenant(failure.TenantID), failure.Stage, errorClass(failure.Err)).Inc()
+}
+
+// errorClass groups stage errors for the failure metric.
+func errorClass(err error) string {
+	var (
+		pgErr     *pgconn.PgError
+		netErr    net.Error
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case repository.IsDataError(err):
+		return "data"
+	case errors.As(err, &pgErr):
+		return "database"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "decode"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
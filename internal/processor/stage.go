@@ -0,0 +1,143 @@
+package processor
+
+import (
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/internal/service/quality"
+	"fmt"
+	"time"
+)
+
+// Message is the per-message context passed along the stage chain.
+type Message struct {
+	Raw       []byte
+	Identity  extract.Identity
+	Timestamp time.Time
+	// Value is the payload as extracted, before it is decoded into Data.
+	Value interface{}
+	Data  map[string]interface{}
+	// Unfiltered holds the record before deadband filtering, so rollups see
+	// every reading.
+	Unfiltered map[string]interface{}
+	// Suppressed is set when every field was filtered out and nothing is
+	// due to be written.
+	Suppressed bool
+	Quality    quality.Result
+	// Metadata lets stages and hooks hand values to later ones.
+	Metadata map[string]interface{}
+	// Errors collects problems that did not stop the message.
+	Errors []StageError
+
+	commits []func()
+}
+
+// StageError is a non-fatal error reported by a stage.
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+// Failure is returned by Process when a stage fails the message. It reads
+// as the stage's own error.
+type Failure struct {
+	Stage    string
+	TenantID string
+	Err      error
+}
+
+func (e *Failure) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Failure) Unwrap() error {
+	return e.Err
+}
+
+func newMessage(raw []byte) *Message {
+	return &Message{Raw: raw, Metadata: make(map[string]interface{})}
+}
+
+// OnCommit registers a side effect that runs only after every stage has
+// succeeded. Stateful stages use it so a retried message is not counted
+// twice.
+func (m *Message) OnCommit(fn func()) {
+	m.commits = append(m.commits, fn)
+}
+
+func (m *Message) commit() {
+	for _, fn := range m.commits {
+		fn()
+	}
+}
+
+// Stage is one step of the processing chain. Returning an error stops the
+// chain and fails the message.
+type Stage interface {
+	Name() string
+	Run(msg *Message) error
+}
+
+// Hook observes every stage run, for cross-cutting concerns such as
+// timing, tracing or auditing.
+type Hook interface {
+	Name() string
+	Before(stage string, msg *Message)
+	After(stage string, msg *Message, elapsed time.Duration, err error)
+}
+
+// buildChain orders the registered stages as configured. Extract and
+// transform must come first because every other stage works on their output.
+// With a privacy policy, privacy must follow them, so no later stage logs
+// or loads a field the policy removes.
+func buildChain(order []string, stages []Stage, privacy bool) ([]Stage, error) {
+	byName := make(map[string]Stage, len(stages))
+	for _, stage := range stages {
+		if _, ok := byName[stage.Name()]; ok {
+			return nil, fmt.Errorf("stage %q registered twice", stage.Name())
+		}
+		byName[stage.Name()] = stage
+	}
+
+	if len(order) < 2 || order[0] != StageExtract || order[1] != StageTransform {
+		return nil, fmt.Errorf("pipeline must start with %s,%s", StageExtract, StageTransform)
+	}
+	if privacy && (len(order) < 3 || order[2] != StagePrivacy) {
+		return nil, fmt.Errorf("pipeline must start with %s,%s,%s when a privacy policy is set", StageExtract, StageTransform, StagePrivacy)
+	}
+
+	chain := make([]Stage, 0, len(order))
+	seen := make(map[string]bool, len(order))
+	for _, name := range order {
+		stage, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("pipeline stage %q listed twice", name)
+		}
+		seen[name] = true
+		chain = append(chain, stage)
+	}
+	return chain, nil
+}
+
+// selectHooks returns the registered hooks enabled in config, in that order.
+func selectHooks(enabled []string, hooks []Hook) ([]Hook, error) {
+	byName := make(map[string]Hook, len(hooks))
+	for _, hook := range hooks {
+		byName[hook.Name()] = hook
+	}
+
+	selected := make([]Hook, 0, len(enabled))
+	for _, name := range enabled {
+		hook, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline hook %q", name)
+		}
+		selected = append(selected, hook)
+	}
+	return selected, nil
+}
@@ -0,0 +1,215 @@
+package processor
+
+import (
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/counter"
+	"etl-pipeline/internal/service/deadband"
+	"etl-pipeline/internal/service/enrich"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/internal/service/quality"
+	"etl-pipeline/internal/service/schema"
+	"etl-pipeline/internal/service/sink"
+	"etl-pipeline/internal/service/transform"
+	"etl-pipeline/internal/service/window"
+	"etl-pipeline/pkg/logger"
+	"fmt"
+	"strings"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Names of the built-in stages, as used in PIPELINE_STAGES.
+const (
+	StageExtract   = "extract"
+	StageTransform = "transform"
+	StagePrivacy   = "privacy"
+	StageRules     = "rules"
+	StageUnits     = "units"
+	StageCompute   = "compute"
+	StageFlatten   = "flatten"
+	StageEnrich    = "enrich"
+	StageCounter   = "counter"
+	StageSchema    = "schema"
+	StageQuality   = "quality"
+	StageDeadband  = "deadband"
+	StageLoad      = "load"
+	StageWindow    = "window"
+)
+
+type BuiltinStagesParams struct {
+	fx.In
+	Logger    logger.Logger
+	Extract   extract.HonoExtractor
+	Transform transform.HonoTransformer
+	Privacy   privacy.Policy
+	Rules     transform.RuleEngine
+	Units     transform.UnitNormalizer
+	Compute   transform.Computer
+	Flatten   transform.Flattener
+	Enrich    enrich.Enricher
+	Counter   counter.Converter
+	Schema    schema.Tracker
+	Quality   quality.Checker
+	Deadband  deadband.Filter
+	Sinks     sink.Dispatcher
+	Window    window.Aggregator
+}
+
+// BuiltinStagesResult adds the built-in stages to the "stages" group. Other
+// modules can register more stages in the same group.
+type BuiltinStagesResult struct {
+	fx.Out
+	Stages []Stage `group:"stages,flatten"`
+}
+
+func NewBuiltinStages(p BuiltinStagesParams) BuiltinStagesResult {
+	return BuiltinStagesResult{Stages: []Stage{
+		stageFunc(StageExtract, func(msg *Message) error {
+			identity, value, timestamp, err := p.Extract.Extracter(msg.Raw)
+			if err != nil {
+				return err
+			}
+			msg.Identity, msg.Value, msg.Timestamp = identity, value, timestamp
+			return nil
+		}),
+		stageFunc(StageTransform, func(msg *Message) (err error) {
+			msg.Data, err = p.Transform.HonoTransform(msg.Value)
+			return err
+		}),
+		// Sensitive fields are handled before any later stage can log or
+		// store them.
+		stageFunc(StagePrivacy, func(msg *Message) error {
+			msg.Data = p.Privacy.Apply(msg.Identity, msg.Data)
+			return nil
+		}),
+		stageFunc(StageRules, func(msg *Message) (err error) {
+			msg.Data, err = p.Rules.Apply(msg.Identity, msg.Data)
+			return err
+		}),
+		stageFunc(StageUnits, func(msg *Message) (err error) {
+			msg.Data, err = p.Units.Normalize(msg.Identity, msg.Data)
+			return err
+		}),
+		stageFunc(StageCompute, func(msg *Message) error {
+			var fieldErrs []*transform.FieldError
+			msg.Data, fieldErrs = p.Compute.Compute(msg.Identity, msg.Data)
+			for _, fieldErr := range fieldErrs {
+				msg.Errors = append(msg.Errors, StageError{Stage: StageCompute, Err: fieldErr})
+			}
+			return nil
+		}),
+		stageFunc(StageFlatten, func(msg *Message) (err error) {
+			msg.Data, err = p.Flatten.Flatten(msg.Data)
+			return err
+		}),
+		// Enrichment is best effort: a registry outage must not block
+		// ingestion.
+		stageFunc(StageEnrich, func(msg *Message) error {
+			var err error
+			msg.Data, err = p.Enrich.Enrich(msg.Identity, msg.Data)
+			if err != nil {
+				msg.Errors = append(msg.Errors, StageError{Stage: StageEnrich, Err: err})
+			}
+			return nil
+		}),
+		stageFunc(StageCounter, func(msg *Message) error {
+			var commit func()
+			msg.Data, commit = p.Counter.Convert(msg.Identity, msg.Timestamp, msg.Data)
+			msg.OnCommit(commit)
+			return nil
+		}),
+		stageFunc(StageSchema, func(msg *Message) error {
+			if _, err := p.Schema.Observe(msg.Identity, msg.Data); err != nil {
+				msg.Errors = append(msg.Errors, StageError{Stage: StageSchema, Err: err})
+			}
+			return nil
+		}),
+		stageFunc(StageQuality, func(msg *Message) error {
+			var commit func()
+			msg.Quality, commit = p.Quality.Check(msg.Identity, msg.Timestamp, msg.Data)
+			msg.OnCommit(commit)
+			if len(msg.Quality.Violations) > 0 {
+				msg.Errors = append(msg.Errors, StageError{
+					Stage: StageQuality,
+					Err: fmt.Errorf("rules violated: %s (quality code %d)",
+						strings.Join(msg.Quality.Violations, ", "), msg.Quality.Code),
+				})
+			}
+			return nil
+		}),
+		stageFunc(StageDeadband, func(msg *Message) error {
+			msg.Unfiltered = msg.Data
+			filtered, commit := p.Deadband.Filter(msg.Identity, msg.Timestamp, msg.Data)
+			msg.OnCommit(commit)
+			if filtered == nil {
+				p.Logger.Debug("All fields suppressed by deadband",
+					zap.String("tenantID", msg.Identity.TenantId),
+					zap.String("deviceID", msg.Identity.DeviceId))
+				msg.Data = make(map[string]interface{})
+				msg.Suppressed = true
+				return nil
+			}
+			msg.Data = filtered
+			return nil
+		}),
+		stageFunc(StageLoad, func(msg *Message) error {
+			if msg.Suppressed {
+				return nil
+			}
+
+			p.Logger.Debug("Processing message",
+				zap.String("tenantID", msg.Identity.TenantId),
+				zap.String("deviceID", msg.Identity.DeviceId),
+				zap.Int("fields", len(msg.Data)))
+
+			err := p.Sinks.Deliver(&model.RawDeviceData{
+				TenantID:          msg.Identity.TenantId,
+				DeviceID:          msg.Identity.DeviceId,
+				DeviceType:        msg.Identity.DeviceType,
+				Timestamp:         msg.Timestamp,
+				Data:              msg.Data,
+				QualityCode:       msg.Quality.Code,
+				QualityViolations: msg.Quality.Violations,
+			})
+			if err != nil {
+				return err
+			}
+
+			p.Logger.Info("Message inserted",
+				zap.String("tenantID", msg.Identity.TenantId),
+				zap.String("deviceID", msg.Identity.DeviceId))
+			return nil
+		}),
+		// Rollups see every reading, including the ones deadband suppresses,
+		// and are only fed once the message has gone through.
+		stageFunc(StageWindow, func(msg *Message) error {
+			data := msg.Data
+			if msg.Unfiltered != nil {
+				data = msg.Unfiltered
+			}
+			msg.OnCommit(func() {
+				p.Window.Add(msg.Identity, msg.Timestamp, data)
+			})
+			return nil
+		}),
+	}}
+}
+
+type funcStage struct {
+	name string
+	run  func(msg *Message) error
+}
+
+func stageFunc(name string, run func(msg *Message) error) Stage {
+	return &funcStage{name: name, run: run}
+}
+
+func (s *funcStage) Name() string {
+	return s.name
+}
+
+func (s *funcStage) Run(msg *Message) error {
+	return s.run(msg)
+}
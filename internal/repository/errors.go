@@ -0,0 +1,19 @@
+package repository
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// IsDataError reports whether err is Postgres rejecting the values written,
+// a data exception or an integrity constraint violation, rather than a
+// failure of the database itself.
+func IsDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
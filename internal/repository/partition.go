@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Partitions manages native range partitions. Table and partition names
+// must come from configuration validated by the caller.
+type Partitions interface {
+	// RangeKey returns the range partition key column of table and whether
+	// it has a default partition. The column is empty when table does not
+	// exist or is not partitioned by range on a column.
+	RangeKey(ctx context.Context, table string) (column string, hasDefault bool, err error)
+	// ConvertToPartitioned turns a plain table into one partitioned by range
+	// on column. The existing table, rows and all, becomes its default
+	// partition under defaultName.
+	ConvertToPartitioned(ctx context.Context, table, column, defaultName string) error
+	// CreateDefaultPartition creates the default partition unless it exists.
+	CreateDefaultPartition(ctx context.Context, table, name string) error
+	ListPartitions(ctx context.Context, table string) ([]string, error)
+	// CreateRangePartition creates the partition for [from, to) and moves
+	// the rows of that range out of the default partition into it. With
+	// tenants, it is list partitioned by tenant_id into one partition per
+	// tenant plus a default one.
+	CreateRangePartition(ctx context.Context, table, name, column string, from, to time.Time, tenants []string) error
+	// DropPartition detaches and drops a partition.
+	DropPartition(ctx context.Context, table, name string) error
+	// TryLocked runs fn if the named advisory lock is free and reports
+	// whether it ran.
+	TryLocked(ctx context.Context, name string, fn func() error) (bool, error)
+}
+
+type partitions struct {
+	db *pgxpool.Pool
+}
+
+func NewPartitions(db *pgxpool.Pool) Partitions {
+	return &partitions{db: db}
+}
+
+func (p *partitions) RangeKey(ctx context.Context, table string) (string, bool, error) {
+	var column string
+	var hasDefault bool
+	err := p.db.QueryRow(ctx, RangePartitionKey, table).Scan(&column, &hasDefault)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, nil
+	}
+	return column, hasDefault, err
+}
+
+func (p *partitions) ConvertToPartitioned(ctx context.Context, table, column, defaultName string) error {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	quoted := pgx.Identifier{table}.Sanitize()
+	quotedDefault := pgx.Identifier{defaultName}.Sanitize()
+	statements := []string{
+		fmt.Sprintf(LockExclusive, quoted),
+		fmt.Sprintf(RenameTable, quoted, quotedDefault),
+		fmt.Sprintf(CreateRangePartitioned, quoted, quotedDefault, pgx.Identifier{column}.Sanitize()),
+		fmt.Sprintf(AttachDefaultPartition, quoted, quotedDefault),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *partitions) CreateDefaultPartition(ctx context.Context, table, name string) error {
+	_, err := p.db.Exec(ctx, fmt.Sprintf(CreateDefaultPartition, pgx.Identifier{name}.Sanitize(), pgx.Identifier{table}.Sanitize()))
+	return err
+}
+
+func (p *partitions) ListPartitions(ctx context.Context, table string) ([]string, error) {
+	rows, err := p.db.Query(ctx, ListPartitions, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (p *partitions) CreateRangePartition(ctx context.Context, table, name, column string, from, to time.Time, tenants []string) error {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// The partition is filled while still detached: attaching it next to a
+	// default partition that holds rows of its range would fail.
+	subpartition := ""
+	if len(tenants) > 0 {
+		subpartition = "PARTITION BY LIST (tenant_id)"
+	}
+	quoted := pgx.Identifier{name}.Sanitize()
+	parent := pgx.Identifier{table}.Sanitize()
+	if _, err := tx.Exec(ctx, fmt.Sprintf(CreatePartitionTable, quoted, parent, subpartition)); err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		child := pgx.Identifier{name + "_" + tenant}.Sanitize()
+		if _, err := tx.Exec(ctx, fmt.Sprintf(CreateListPartition, child, quoted, quoteLiteral(tenant))); err != nil {
+			return err
+		}
+	}
+	if len(tenants) > 0 {
+		child := pgx.Identifier{name + "_default"}.Sanitize()
+		if _, err := tx.Exec(ctx, fmt.Sprintf(CreateDefaultPartition, child, quoted)); err != nil {
+			return err
+		}
+	}
+
+	lower := quoteLiteral(from.UTC().Format(time.RFC3339))
+	upper := quoteLiteral(to.UTC().Format(time.RFC3339))
+	move := fmt.Sprintf(MovePartitionRows, parent, pgx.Identifier{column}.Sanitize(), lower, upper, quoted)
+	if _, err := tx.Exec(ctx, move); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(AttachRangePartition, parent, quoted, lower, upper)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *partitions) DropPartition(ctx context.Context, table, name string) error {
+	tx, err := p.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	quoted := pgx.Identifier{name}.Sanitize()
+	if _, err := tx.Exec(ctx, fmt.Sprintf(DetachPartition, pgx.Identifier{table}.Sanitize(), quoted)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf(DropTable, quoted)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *partitions) TryLocked(ctx context.Context, name string, fn func() error) (bool, error) {
+	return tryLocked(ctx, p.db, name, fn)
+}
+
+// tryLocked holds a session advisory lock on one connection while fn runs.
+func tryLocked(ctx context.Context, db *pgxpool.Pool, name string, fn func() error) (bool, error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, TryAdvisoryLock, name).Scan(&locked); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.Exec(context.Background(), AdvisoryUnlock, name)
+
+	return true, fn()
+}
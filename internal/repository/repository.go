@@ -2,24 +2,484 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/fx"
 )
 
 type Repository interface {
-	InsertRawDeviceData(ctx context.Context, tenantID, deviceID string, timestamp time.Time, data map[string]interface{}) error
+	InsertRawDeviceData(ctx context.Context, record *model.RawDeviceData) error
+	GetDeviceSchema(ctx context.Context, tenantID, deviceType string) (*model.DeviceSchema, error)
+	UpsertDeviceSchema(ctx context.Context, schema *model.DeviceSchema) error
+	ListPipelineState(ctx context.Context, kind string, since time.Time) ([]model.StateEntry, error)
+	SavePipelineState(ctx context.Context, entries []model.StateEntry) error
+	UpsertAggregates(ctx context.Context, table string, aggregates []model.Aggregate) error
+	CreateAggregateTable(ctx context.Context, table string) error
+	GetDevice(ctx context.Context, tenantID, deviceID string) (*model.Device, error)
+	ListDevices(ctx context.Context) ([]model.Device, error)
+	Listen(ctx context.Context, channel string, handle func(payload string)) error
+	GetTableColumns(ctx context.Context, tenantID, table string) (map[string]string, error)
+	EvolveWideTable(ctx context.Context, tenantID, table string, changes []model.ColumnChange) (map[string]string, error)
+	InsertWideRow(ctx context.Context, tenantID, table string, columns []string, values []interface{}) error
+	InsertMetricRows(ctx context.Context, table string, rows []model.MetricRow, reject func([]util.Rejected[model.MetricRow]) error) error
+	UpsertLatestState(ctx context.Context, record *model.RawDeviceData) error
 }
 
+// Databases runs maintenance on every database device records are written
+// to. Names identify a route in logs without exposing its DSN.
+type Databases interface {
+	Each(ctx context.Context, fn func(name string, db *pgxpool.Pool) error) error
+}
+
+// repository writes device records and rollups to the database their
+// tenant is routed to; everything else lives in the main database.
 type repository struct {
-	db *pgxpool.Pool
+	db     *pgxpool.Pool
+	router *router
+}
+
+func (r *repository) InsertRawDeviceData(ctx context.Context, record *model.RawDeviceData) error {
+	db, release, err := r.router.pool(ctx, record.TenantID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	violations := record.QualityViolations
+	if violations == nil {
+		violations = []string{}
+	}
+	_, err = db.Exec(ctx, InsertRawDeviceData,
+		record.TenantID, record.DeviceID, record.Timestamp, record.Data, record.QualityCode, violations)
+	return err
+}
+
+// GetDeviceSchema returns nil without error when no schema has been stored yet.
+func (r *repository) GetDeviceSchema(ctx context.Context, tenantID, deviceType string) (*model.DeviceSchema, error) {
+	var schema model.DeviceSchema
+	var fields []byte
+
+	err := r.db.QueryRow(ctx, GetDeviceSchema, tenantID, deviceType).
+		Scan(&schema.TenantID, &schema.DeviceType, &fields, &schema.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(fields, &schema.Fields); err != nil {
+		return nil, err
+	}
+	return &schema, nil
 }
 
-func (r *repository) InsertRawDeviceData(ctx context.Context, tenantID string, deviceID string, timestamp time.Time, data map[string]interface{}) error {
-	_, err := r.db.Exec(ctx, InsertRawDeviceData, tenantID, deviceID, timestamp, data)
+func (r *repository) UpsertDeviceSchema(ctx context.Context, schema *model.DeviceSchema) error {
+	_, err := r.db.Exec(ctx, UpsertDeviceSchema, schema.TenantID, schema.DeviceType, schema.Fields, schema.UpdatedAt)
 	return err
 }
 
-func NewRepository(db *pgxpool.Pool) Repository {
-	return &repository{db: db}
+func (r *repository) ListPipelineState(ctx context.Context, kind string, since time.Time) ([]model.StateEntry, error) {
+	rows, err := r.db.Query(ctx, ListPipelineState, kind, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []model.StateEntry
+	for rows.Next() {
+		var entry model.StateEntry
+		var value []byte
+		if err := rows.Scan(&entry.Kind, &entry.TenantID, &entry.DeviceID, &entry.Field, &value, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+		if err := util.UnmarshalJSON(value, &entry.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// SavePipelineState upserts all entries in a single batch round trip.
+func (r *repository) SavePipelineState(ctx context.Context, entries []model.StateEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, entry := range entries {
+		value, err := json.Marshal(entry.Value)
+		if err != nil {
+			return err
+		}
+		batch.Queue(UpsertPipelineState, entry.Kind, entry.TenantID, entry.DeviceID, entry.Field, value, entry.Timestamp)
+	}
+
+	results := r.db.SendBatch(ctx, batch)
+	defer results.Close()
+
+	for range entries {
+		if _, err := results.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAggregateTable creates a rollup table in every route unless it
+// exists. Tables are per window size, so they are created at startup rather
+// than by a migration.
+func (r *repository) CreateAggregateTable(ctx context.Context, table string) error {
+	query := fmt.Sprintf(CreateAggregateTable, pgx.Identifier{table}.Sanitize())
+	return r.router.each(ctx, func(_ string, db *pgxpool.Pool) error {
+		_, err := db.Exec(ctx, query)
+		return err
+	})
+}
+
+// UpsertAggregates merges aggregates into table in their tenant's route.
+// All aggregates must belong to one tenant. The table name must come from
+// configuration validated by the caller, never from payload data.
+func (r *repository) UpsertAggregates(ctx context.Context, table string, aggregates []model.Aggregate) error {
+	if len(aggregates) == 0 {
+		return nil
+	}
+
+	db, release, err := r.router.pool(ctx, aggregates[0].TenantID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	query := fmt.Sprintf(UpsertAggregate, pgx.Identifier{table}.Sanitize())
+	batch := &pgx.Batch{}
+	for _, a := range aggregates {
+		batch.Queue(query, a.TenantID, a.DeviceID, a.Field, a.Bucket, a.Min, a.Max, a.Sum, a.Count, a.Last, a.LastTime)
+	}
+
+	results := db.SendBatch(ctx, batch)
+	defer results.Close()
+
+	for range aggregates {
+		if _, err := results.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDevice returns nil without error when the device is not registered.
+func (r *repository) GetDevice(ctx context.Context, tenantID, deviceID string) (*model.Device, error) {
+	device, err := scanDevice(r.db.QueryRow(ctx, GetDevice, tenantID, deviceID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return device, err
+}
+
+func (r *repository) ListDevices(ctx context.Context) ([]model.Device, error) {
+	rows, err := r.db.Query(ctx, ListDevices)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []model.Device
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *device)
+	}
+	return devices, rows.Err()
+}
+
+// scanDevice merges the well-known columns over the free-form attributes.
+func scanDevice(row pgx.Row) (*model.Device, error) {
+	var device model.Device
+	var site, assetType, meterSerial, timezone *string
+	var attributes []byte
+
+	if err := row.Scan(&device.TenantID, &device.DeviceID, &site, &assetType, &meterSerial, &timezone, &attributes); err != nil {
+		return nil, err
+	}
+
+	device.Attributes = make(map[string]interface{})
+	if len(attributes) > 0 {
+		if err := util.UnmarshalJSON(attributes, &device.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range map[string]*string{
+		"site":         site,
+		"asset_type":   assetType,
+		"meter_serial": meterSerial,
+		"timezone":     timezone,
+	} {
+		if value != nil {
+			device.Attributes[name] = *value
+		}
+	}
+	return &device, nil
+}
+
+// Listen blocks on a dedicated connection and calls handle for every
+// notification on channel until ctx is done or the connection fails.
+func (r *repository) Listen(ctx context.Context, channel string, handle func(payload string)) error {
+	conn, err := r.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handle(notification.Payload)
+	}
+}
+
+// GetTableColumns returns the column types of table in tenantID's route,
+// or an empty map when the table does not exist.
+func (r *repository) GetTableColumns(ctx context.Context, tenantID, table string) (map[string]string, error) {
+	db, release, err := r.router.pool(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return getTableColumns(ctx, db, table)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func getTableColumns(ctx context.Context, q querier, table string) (map[string]string, error) {
+	rows, err := q.Query(ctx, GetTableColumns, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		columns[name] = dataType
+	}
+	return columns, rows.Err()
+}
+
+// EvolveWideTable creates table in tenantID's route if needed and applies
+// changes under an advisory lock, so concurrent loaders never race on the
+// same DDL. Changes another loader already made are skipped. It returns the
+// resulting column types. Table, column and type names must be validated by
+// the caller.
+func (r *repository) EvolveWideTable(ctx context.Context, tenantID, table string, changes []model.ColumnChange) (map[string]string, error) {
+	db, release, err := r.router.pool(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, LockTable, table); err != nil {
+		return nil, err
+	}
+
+	quoted := pgx.Identifier{table}.Sanitize()
+	if _, err := tx.Exec(ctx, fmt.Sprintf(CreateWideTable, quoted)); err != nil {
+		return nil, err
+	}
+
+	columns, err := getTableColumns(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		current, exists := columns[change.Column]
+		column := pgx.Identifier{change.Column}.Sanitize()
+		switch {
+		case change.From == "" && !exists:
+			_, err = tx.Exec(ctx, fmt.Sprintf(AddColumn, quoted, column, change.Type))
+		case change.From != "" && current == change.From:
+			_, err = tx.Exec(ctx, fmt.Sprintf(WidenColumn, quoted, column, change.Type))
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		columns[change.Column] = change.Type
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+func (r *repository) InsertWideRow(ctx context.Context, tenantID, table string, columns []string, values []interface{}) error {
+	db, release, err := r.router.pool(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	names := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = pgx.Identifier{column}.Sanitize()
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf(InsertWideRow, pgx.Identifier{table}.Sanitize(),
+		strings.Join(names, ", "), strings.Join(placeholders, ", "))
+	_, err = db.Exec(ctx, query, values...)
+	return err
+}
+
+// metricColumns is the column order of the narrow metric table.
+var metricColumns = []string{"tenant_id", "device_id", "ts", "metric", "value_double", "value_text", "value_bool",
+	"quality_code", "quality_violations"}
+
+// InsertMetricRows bulk inserts rows with COPY in one transaction. All rows
+// must belong to one tenant. When Postgres rejects rows for their values,
+// the copy is bisected under savepoints and the offending rows are handed
+// to reject before the rest commit. Any other error, or an error from
+// reject, rolls back every row, so a retry cannot insert any of them twice.
+// The table name must come from configuration validated by the caller.
+func (r *repository) InsertMetricRows(ctx context.Context, table string, rows []model.MetricRow, reject func([]util.Rejected[model.MetricRow]) error) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	db, release, err := r.router.pool(ctx, rows[0].TenantID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	rejected, _, err := util.Bisect(rows, func(part []model.MetricRow) error {
+		savepoint, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer savepoint.Rollback(ctx)
+
+		_, err = savepoint.CopyFrom(ctx, pgx.Identifier{table}, metricColumns,
+			pgx.CopyFromSlice(len(part), func(i int) ([]interface{}, error) {
+				row := part[i]
+				return []interface{}{row.TenantID, row.DeviceID, row.Timestamp, row.Metric,
+					row.ValueDouble, row.ValueText, row.ValueBool, row.QualityCode, row.QualityViolations}, nil
+			}))
+		if err != nil {
+			return err
+		}
+		return savepoint.Commit(ctx)
+	}, IsDataError)
+	if err != nil {
+		return err
+	}
+	if len(rejected) > 0 {
+		if err := reject(rejected); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// UpsertLatestState merges the record's fields into device_latest_state in
+// the tenant's route.
+func (r *repository) UpsertLatestState(ctx context.Context, record *model.RawDeviceData) error {
+	if len(record.Data) == 0 {
+		return nil
+	}
+
+	db, release, err := r.router.pool(ctx, record.TenantID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	fieldTimes := make(map[string]time.Time, len(record.Data))
+	for field := range record.Data {
+		fieldTimes[field] = record.Timestamp
+	}
+	_, err = db.Exec(ctx, UpsertLatestState,
+		record.TenantID, record.DeviceID, record.Data, fieldTimes, record.Timestamp)
+	return err
+}
+
+// Each runs fn on the main database and on every configured route, so
+// maintenance covers tenant schemas and databases too.
+func (r *repository) Each(ctx context.Context, fn func(name string, db *pgxpool.Pool) error) error {
+	return r.router.each(ctx, fn)
+}
+
+type RepositoryParams struct {
+	fx.In
+	DB        *pgxpool.Pool
+	Config    *config.Config
+	Logger    logger.Logger
+	Lifecycle fx.Lifecycle
+}
+
+type RepositoryResult struct {
+	fx.Out
+	Repository Repository
+	Databases  Databases
+}
+
+// NewRepository routes device records by tenant as configured in
+// DB_ROUTES_PATH.
+func NewRepository(params RepositoryParams) (RepositoryResult, error) {
+	router, err := newRouter(params.DB, params.Config, params.Logger)
+	if err != nil {
+		return RepositoryResult{}, err
+	}
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			router.start()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			router.close()
+			return nil
+		},
+	})
+	repo := &repository{db: params.DB, router: router}
+	return RepositoryResult{Repository: repo, Databases: repo}, nil
 }
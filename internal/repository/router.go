@@ -0,0 +1,369 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/pkg/cache"
+	"etl-pipeline/pkg/database"
+	"etl-pipeline/pkg/logger"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+var schemaPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// RouteFile is the YAML document loaded from DB_ROUTES_PATH. Tenants
+// without a route of their own use Default; an empty Default is the main
+// database.
+type RouteFile struct {
+	Default Route   `yaml:"default"`
+	Routes  []Route `yaml:"routes"`
+}
+
+// Route sends a tenant's records to Schema in the main database, or to the
+// separate database at DSN, optionally in Schema. The DSN is expanded from
+// the environment so credentials can stay out of the file.
+type Route struct {
+	Tenant string `yaml:"tenant"`
+	Schema string `yaml:"schema"`
+	DSN    string `yaml:"dsn"`
+}
+
+// route identifies one pool. The zero value is the main pool.
+type route struct {
+	dsn    string
+	schema string
+}
+
+// routedPool is a route pool with the number of callers holding it. An
+// evicted pool is closed once the last of them releases it.
+type routedPool struct {
+	pool    *pgxpool.Pool
+	refs    int
+	evicted bool
+}
+
+// dial is an open of a route pool in progress. Callers needing the same
+// route wait for it instead of connecting again.
+type dial struct {
+	done chan struct{}
+	err  error
+}
+
+// router resolves the pool a tenant's records are written to. Pools other
+// than the main one are opened on first use, outside the lock so a slow
+// route only delays its own tenants, and kept in an LRU. Evicted or idle
+// pools are closed once no caller holds them.
+type router struct {
+	main        *pgxpool.Pool
+	mainDSN     string
+	routes      map[string]route
+	fallback    route
+	idle        time.Duration
+	autoMigrate bool
+	logger      logger.Logger
+
+	// mu guards pools, dials and the reference counts. Every use of pools
+	// happens under it, so the eviction callback runs under it too.
+	mu    sync.Mutex
+	pools *cache.LRU[route, *routedPool]
+	dials map[route]*dial
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newRouter(main *pgxpool.Pool, cfg *config.Config, log logger.Logger) (*router, error) {
+	r := &router{
+		main:        main,
+		mainDSN:     database.DSN(cfg),
+		routes:      make(map[string]route),
+		idle:        time.Duration(cfg.Routing.PoolIdle) * time.Second,
+		autoMigrate: cfg.DB.AutoMigrate,
+		logger:      log,
+		pools:       cache.NewLRU[route, *routedPool](cfg.Routing.MaxPools),
+		dials:       make(map[route]*dial),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	r.pools.OnEvict(func(_ route, p *routedPool) {
+		p.evicted = true
+		if p.refs == 0 {
+			// Close waits for acquired connections, so it must not block
+			// the cache.
+			go p.pool.Close()
+		}
+	})
+
+	if cfg.Routing.ConfigPath == "" {
+		return r, nil
+	}
+	if cfg.Routing.MaxPools <= 0 {
+		return nil, errors.New("DB_ROUTE_MAX_POOLS must be positive")
+	}
+	if cfg.Routing.PoolIdle <= 0 {
+		return nil, errors.New("DB_ROUTE_POOL_IDLE must be positive")
+	}
+
+	content, err := os.ReadFile(cfg.Routing.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route config: %w", err)
+	}
+
+	var file RouteFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse route config: %w", err)
+	}
+
+	if file.Default.Tenant != "" {
+		return nil, errors.New("default: route must not name a tenant")
+	}
+	if r.fallback, err = compileRoute(file.Default); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+
+	for i, rt := range file.Routes {
+		if rt.Tenant == "" {
+			return nil, fmt.Errorf("routes[%d]: tenant is required", i)
+		}
+		if _, ok := r.routes[rt.Tenant]; ok {
+			return nil, fmt.Errorf("routes[%d]: duplicate tenant %q", i, rt.Tenant)
+		}
+		if rt.Schema == "" && rt.DSN == "" {
+			return nil, fmt.Errorf("routes[%d]: schema or dsn is required", i)
+		}
+		compiled, err := compileRoute(rt)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		r.routes[rt.Tenant] = compiled
+	}
+	return r, nil
+}
+
+func compileRoute(rt Route) (route, error) {
+	if rt.Schema != "" && !schemaPattern.MatchString(rt.Schema) {
+		return route{}, fmt.Errorf("invalid schema name %q", rt.Schema)
+	}
+	compiled := route{dsn: os.ExpandEnv(rt.DSN), schema: rt.Schema}
+	if compiled.dsn != "" {
+		if _, err := pgxpool.ParseConfig(compiled.dsn); err != nil {
+			return route{}, fmt.Errorf("invalid dsn: %w", err)
+		}
+	}
+	return compiled, nil
+}
+
+// pool returns the pool for tenantID's records. The caller must call
+// release once it no longer uses the pool.
+func (r *router) pool(ctx context.Context, tenantID string) (*pgxpool.Pool, func(), error) {
+	rt, ok := r.routes[tenantID]
+	if !ok {
+		rt = r.fallback
+	}
+	pool, release, err := r.acquire(ctx, rt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open route for tenant %q: %w", tenantID, err)
+	}
+	return pool, release, nil
+}
+
+func (r *router) acquire(ctx context.Context, rt route) (*pgxpool.Pool, func(), error) {
+	if rt == (route{}) {
+		return r.main, func() {}, nil
+	}
+
+	for {
+		r.mu.Lock()
+		if p, ok := r.pools.Get(rt); ok {
+			p.refs++
+			// Setting it again keeps a pool in use from idling out.
+			r.pools.Set(rt, p, r.idle)
+			r.mu.Unlock()
+			return p.pool, func() { r.release(p) }, nil
+		}
+
+		if d, ok := r.dials[rt]; ok {
+			r.mu.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if d.err != nil {
+				return nil, nil, d.err
+			}
+			continue
+		}
+
+		d := &dial{done: make(chan struct{})}
+		r.dials[rt] = d
+		r.mu.Unlock()
+
+		pool, err := r.connect(ctx, rt)
+
+		r.mu.Lock()
+		delete(r.dials, rt)
+		if err == nil {
+			r.pools.Set(rt, &routedPool{pool: pool}, r.idle)
+		}
+		r.mu.Unlock()
+
+		d.err = err
+		close(d.done)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (r *router) release(p *routedPool) {
+	r.mu.Lock()
+	p.refs--
+	closing := p.evicted && p.refs == 0
+	r.mu.Unlock()
+
+	if closing {
+		p.pool.Close()
+	}
+}
+
+// each calls fn with the main pool and the pool of every configured route,
+// naming each by its schema, or by tenant for routes to another database.
+func (r *router) each(ctx context.Context, fn func(name string, db *pgxpool.Pool) error) error {
+	seen := make(map[route]bool)
+	var errs []error
+	visit := func(name string, rt route) {
+		if seen[rt] {
+			return
+		}
+		seen[rt] = true
+
+		pool, release, err := r.acquire(ctx, rt)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		defer release()
+		if err := fn(name, pool); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	visit("main", route{})
+	visit(routeName("default", r.fallback), r.fallback)
+	tenants := make([]string, 0, len(r.routes))
+	for tenant := range r.routes {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		visit(routeName("tenant "+tenant, r.routes[tenant]), r.routes[tenant])
+	}
+	return errors.Join(errs...)
+}
+
+// routeName names rt in logs and errors without exposing its DSN.
+func routeName(fallback string, rt route) string {
+	if rt.dsn == "" && rt.schema != "" {
+		return "schema " + rt.schema
+	}
+	return fallback
+}
+
+// connect opens a pool for rt. Schema routes pin search_path to the schema
+// only, so unqualified table names can never fall back to another schema.
+func (r *router) connect(ctx context.Context, rt route) (*pgxpool.Pool, error) {
+	dsn := rt.dsn
+	if dsn == "" {
+		dsn = r.mainDSN
+	}
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if rt.schema != "" {
+		cfg.ConnConfig.RuntimeParams["search_path"] = pgx.Identifier{rt.schema}.Sanitize()
+	}
+
+	pool, err := pgxpool.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.autoMigrate {
+		if err := r.migrate(ctx, pool, rt.schema); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+
+	r.logger.Info("Opened tenant route",
+		zap.String("schema", rt.schema),
+		zap.Bool("separateDatabase", rt.dsn != ""))
+	return pool, nil
+}
+
+func (r *router) migrate(ctx context.Context, pool *pgxpool.Pool, schema string) error {
+	if schema != "" {
+		if _, err := pool.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+pgx.Identifier{schema}.Sanitize()); err != nil {
+			return err
+		}
+	}
+	migrator, err := database.NewTenantMigrator(pool, r.logger)
+	if err != nil {
+		return err
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	return nil
+}
+
+// start closes idle pools in the background. The LRU only expires entries
+// it looks up, so a tenant that goes quiet would keep its pool otherwise.
+func (r *router) start() {
+	if len(r.routes) == 0 && r.fallback == (route{}) {
+		close(r.done)
+		return
+	}
+	go r.sweep()
+}
+
+func (r *router) sweep() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(max(r.idle/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.pools.Expire()
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *router) close() {
+	close(r.stop)
+	<-r.done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pools.Purge()
+}
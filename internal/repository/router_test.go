@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"context"
+	"etl-pipeline/config"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func lazyPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	cfg, err := pgxpool.ParseConfig("postgres://localhost:1/none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestRouterSweepClosesIdlePoolsOnceReleased(t *testing.T) {
+	r, err := newRouter(nil, &config.Config{Routing: config.RoutingConfig{MaxPools: 4}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.idle = time.Millisecond
+	quiet, busy := route{schema: "quiet"}, route{schema: "busy"}
+	r.pools.Set(quiet, &routedPool{pool: lazyPool(t)}, r.idle)
+	r.pools.Set(busy, &routedPool{pool: lazyPool(t)}, r.idle)
+
+	_, release, err := r.acquire(context.Background(), busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, _ := r.pools.Get(busy)
+
+	// Nothing looks the pools up again, so only the sweep expires them.
+	time.Sleep(5 * time.Millisecond)
+	r.mu.Lock()
+	r.pools.Expire()
+	r.mu.Unlock()
+
+	if r.pools.Len() != 0 {
+		t.Fatalf("%d pools left after the sweep", r.pools.Len())
+	}
+	if !held.evicted || held.refs != 1 {
+		t.Fatalf("held pool: evicted=%t refs=%d, want evicted and still held", held.evicted, held.refs)
+	}
+	release()
+	if held.refs != 0 {
+		t.Fatalf("refs = %d after release", held.refs)
+	}
+}
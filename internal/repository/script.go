@@ -2,7 +2,230 @@ package repository
 
 const (
 	InsertRawDeviceData = `
-	INSERT INTO raw_device_data (tenant_id, device_id, timestamp, data)
+	INSERT INTO raw_device_data (tenant_id, device_id, timestamp, data, quality_code, quality_violations)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	// UpsertLatestState merges a reading into the latest state of a device.
+	// A field is only replaced by a reading at least as new as the one it
+	// holds, so out-of-order data never moves a field back in time.
+	UpsertLatestState = `
+	INSERT INTO device_latest_state AS s (tenant_id, device_id, data, field_times, updated_at)
+	VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (tenant_id, device_id) DO UPDATE SET
+		data = s.data || (
+			SELECT COALESCE(jsonb_object_agg(n.key, n.value), '{}')
+			FROM jsonb_each(EXCLUDED.data) n
+			WHERE s.field_times ->> n.key IS NULL
+				OR (s.field_times ->> n.key)::timestamptz <= EXCLUDED.updated_at
+		),
+		field_times = s.field_times || (
+			SELECT COALESCE(jsonb_object_agg(n.key, EXCLUDED.field_times -> n.key), '{}')
+			FROM jsonb_each(EXCLUDED.data) n
+			WHERE s.field_times ->> n.key IS NULL
+				OR (s.field_times ->> n.key)::timestamptz <= EXCLUDED.updated_at
+		),
+		updated_at = GREATEST(s.updated_at, EXCLUDED.updated_at)
+	`
+
+	GetDeviceSchema = `
+	SELECT tenant_id, device_type, fields, updated_at
+	FROM device_schema
+	WHERE tenant_id = $1 AND device_type = $2
+	`
+
+	UpsertDeviceSchema = `
+	INSERT INTO device_schema (tenant_id, device_type, fields, updated_at)
 	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (tenant_id, device_type)
+	DO UPDATE SET fields = EXCLUDED.fields, updated_at = EXCLUDED.updated_at
+	`
+
+	ListPipelineState = `
+	SELECT kind, tenant_id, device_id, field, value, timestamp
+	FROM pipeline_state
+	WHERE kind = $1 AND timestamp >= $2
+	`
+
+	UpsertPipelineState = `
+	INSERT INTO pipeline_state (kind, tenant_id, device_id, field, value, timestamp)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (kind, tenant_id, device_id, field)
+	DO UPDATE SET value = EXCLUDED.value, timestamp = EXCLUDED.timestamp
+	`
+
+	// UpsertAggregate is formatted with the aggregate table name. A row that
+	// already exists is merged, so late data corrects a closed window.
+	UpsertAggregate = `
+	INSERT INTO %[1]s AS agg (tenant_id, device_id, field, bucket, min, max, sum, count, last, last_ts)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (tenant_id, device_id, field, bucket)
+	DO UPDATE SET
+		min = LEAST(agg.min, EXCLUDED.min),
+		max = GREATEST(agg.max, EXCLUDED.max),
+		sum = agg.sum + EXCLUDED.sum,
+		count = agg.count + EXCLUDED.count,
+		last = CASE WHEN EXCLUDED.last_ts >= agg.last_ts THEN EXCLUDED.last ELSE agg.last END,
+		last_ts = GREATEST(agg.last_ts, EXCLUDED.last_ts)
+	`
+
+	GetDevice = `
+	SELECT tenant_id, device_id, site, asset_type, meter_serial, timezone, attributes
+	FROM devices
+	WHERE tenant_id = $1 AND device_id = $2
+	`
+
+	ListDevices = `
+	SELECT tenant_id, device_id, site, asset_type, meter_serial, timezone, attributes
+	FROM devices
+	`
+
+	GetTableColumns = `
+	SELECT column_name, data_type
+	FROM information_schema.columns
+	WHERE table_schema = current_schema() AND table_name = $1
+	`
+
+	LockTable = `SELECT pg_advisory_xact_lock(hashtext($1))`
+
+	CreateWideTable = `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		tenant_id          TEXT        NOT NULL,
+		device_id          TEXT        NOT NULL,
+		timestamp          TIMESTAMPTZ NOT NULL,
+		quality_code       SMALLINT    NOT NULL DEFAULT 0,
+		quality_violations TEXT[]      NOT NULL DEFAULT '{}',
+		extra              JSONB
+	)
+	`
+
+	AddColumn = `ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS %[2]s %[3]s`
+
+	WidenColumn = `ALTER TABLE %[1]s ALTER COLUMN %[2]s TYPE %[3]s USING %[2]s::%[3]s`
+
+	InsertWideRow = `INSERT INTO %[1]s (%[2]s) VALUES (%[3]s)`
+
+	CreateAggregateTable = `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		tenant_id TEXT             NOT NULL,
+		device_id TEXT             NOT NULL,
+		field     TEXT             NOT NULL,
+		bucket    TIMESTAMPTZ      NOT NULL,
+		min       DOUBLE PRECISION NOT NULL,
+		max       DOUBLE PRECISION NOT NULL,
+		sum       DOUBLE PRECISION NOT NULL,
+		count     BIGINT           NOT NULL,
+		avg       DOUBLE PRECISION GENERATED ALWAYS AS (sum / NULLIF(count, 0)) STORED,
+		last      DOUBLE PRECISION NOT NULL,
+		last_ts   TIMESTAMPTZ      NOT NULL,
+		PRIMARY KEY (tenant_id, device_id, field, bucket)
+	)
 	`
+
+	GetTimescaleVersion = `SELECT extversion FROM pg_extension WHERE extname = 'timescaledb'`
+
+	GetHypertable = `
+	SELECT d.column_name, extract(epoch FROM d.time_interval), h.compression_enabled
+	FROM timescaledb_information.hypertables h
+	JOIN timescaledb_information.dimensions d
+		ON d.hypertable_schema = h.hypertable_schema
+		AND d.hypertable_name = h.hypertable_name
+		AND d.dimension_number = 1
+	WHERE h.hypertable_schema = current_schema() AND h.hypertable_name = $1
+	`
+
+	GetCompressionSettings = `
+	SELECT attname, segmentby_column_index, orderby_column_index, orderby_asc
+	FROM timescaledb_information.compression_settings
+	WHERE hypertable_schema = current_schema() AND hypertable_name = $1
+	ORDER BY segmentby_column_index NULLS LAST, orderby_column_index NULLS LAST
+	`
+
+	CreateHypertable = `
+	SELECT create_hypertable($1::regclass, $2::name, chunk_time_interval => $3::interval,
+		if_not_exists => true, migrate_data => $4::boolean)
+	`
+
+	HasRows = `SELECT EXISTS (SELECT 1 FROM %[1]s)`
+
+	SetChunkInterval = `SELECT set_chunk_time_interval($1::regclass, $2::interval)`
+
+	SetCompression = `ALTER TABLE %[1]s SET (timescaledb.compress, timescaledb.compress_segmentby = %[2]s, timescaledb.compress_orderby = %[3]s)`
+
+	// GetPolicyInterval reads an interval from the config of a policy job on
+	// a hypertable or on the materialization of a continuous aggregate.
+	GetPolicyInterval = `
+	SELECT extract(epoch FROM (j.config ->> $3)::interval)
+	FROM timescaledb_information.jobs j
+	WHERE j.proc_name = $2
+		AND (j.hypertable_schema, j.hypertable_name) IN (
+			SELECT current_schema()::name, $1::name
+			UNION ALL
+			SELECT materialization_hypertable_schema, materialization_hypertable_name
+			FROM timescaledb_information.continuous_aggregates
+			WHERE view_schema = current_schema() AND view_name = $1
+		)
+	`
+
+	RemoveCompressionPolicy = `SELECT remove_compression_policy($1::regclass, if_exists => true)`
+	AddCompressionPolicy    = `SELECT add_compression_policy($1::regclass, $2::interval)`
+	RemoveRetentionPolicy   = `SELECT remove_retention_policy($1::regclass, if_exists => true)`
+	AddRetentionPolicy      = `SELECT add_retention_policy($1::regclass, $2::interval)`
+
+	ContinuousAggregateExists = `
+	SELECT EXISTS (
+		SELECT 1 FROM timescaledb_information.continuous_aggregates
+		WHERE view_schema = current_schema() AND view_name = $1
+	)
+	`
+
+	CreateContinuousAggregate = `CREATE MATERIALIZED VIEW %[1]s WITH (timescaledb.continuous) AS %[2]s WITH NO DATA`
+
+	GetRefreshPolicy = `
+	SELECT extract(epoch FROM (j.config ->> 'start_offset')::interval),
+		extract(epoch FROM (j.config ->> 'end_offset')::interval),
+		extract(epoch FROM j.schedule_interval)
+	FROM timescaledb_information.continuous_aggregates c
+	JOIN timescaledb_information.jobs j
+		ON j.hypertable_schema = c.materialization_hypertable_schema
+		AND j.hypertable_name = c.materialization_hypertable_name
+		AND j.proc_name = 'policy_refresh_continuous_aggregate'
+	WHERE c.view_schema = current_schema() AND c.view_name = $1
+	`
+
+	RemoveRefreshPolicy = `SELECT remove_continuous_aggregate_policy($1::regclass, if_not_exists => true)`
+	AddRefreshPolicy    = `
+	SELECT add_continuous_aggregate_policy($1::regclass,
+		start_offset => $2::interval, end_offset => $3::interval, schedule_interval => $4::interval)
+	`
+
+	RangePartitionKey = `
+	SELECT a.attname, p.partdefid <> 0
+	FROM pg_partitioned_table p
+	JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+	WHERE p.partrelid = to_regclass($1) AND p.partstrat = 'r'
+	`
+
+	ListPartitions = `
+	SELECT c.relname
+	FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	WHERE i.inhparent = to_regclass($1)
+	ORDER BY c.relname
+	`
+
+	LockExclusive          = `LOCK TABLE %[1]s IN ACCESS EXCLUSIVE MODE`
+	RenameTable            = `ALTER TABLE %[1]s RENAME TO %[2]s`
+	CreateRangePartitioned = `CREATE TABLE %[1]s (LIKE %[2]s INCLUDING ALL) PARTITION BY RANGE (%[3]s)`
+	CreatePartitionTable   = `CREATE TABLE %[1]s (LIKE %[2]s INCLUDING DEFAULTS INCLUDING CONSTRAINTS) %[3]s`
+	MovePartitionRows      = `WITH moved AS (DELETE FROM %[1]s WHERE %[2]s >= %[3]s AND %[2]s < %[4]s RETURNING *) INSERT INTO %[5]s SELECT * FROM moved`
+	AttachRangePartition   = `ALTER TABLE %[1]s ATTACH PARTITION %[2]s FOR VALUES FROM (%[3]s) TO (%[4]s)`
+	AttachDefaultPartition = `ALTER TABLE %[1]s ATTACH PARTITION %[2]s DEFAULT`
+	CreateListPartition    = `CREATE TABLE IF NOT EXISTS %[1]s PARTITION OF %[2]s FOR VALUES IN (%[3]s)`
+	CreateDefaultPartition = `CREATE TABLE IF NOT EXISTS %[1]s PARTITION OF %[2]s DEFAULT`
+	DetachPartition        = `ALTER TABLE %[1]s DETACH PARTITION %[2]s`
+	DropTable              = `DROP TABLE IF EXISTS %[1]s`
+
+	TryAdvisoryLock = `SELECT pg_try_advisory_lock(hashtext($1))`
+	AdvisoryUnlock  = `SELECT pg_advisory_unlock(hashtext($1))`
 )
@@ -0,0 +1,249 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/internal/model"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Timescale reads and changes TimescaleDB settings. Relation and column
+// names must come from configuration validated by the caller.
+type Timescale interface {
+	// Version returns "" when the extension is not installed.
+	Version(ctx context.Context) (string, error)
+	// GetHypertable returns nil without error when table is not a hypertable.
+	GetHypertable(ctx context.Context, table string) (*model.Hypertable, error)
+	// CreateHypertable converts table into a hypertable. With migrateData
+	// its rows are moved into chunks while the table is locked, which takes
+	// as long as copying them.
+	CreateHypertable(ctx context.Context, table, timeColumn string, chunkInterval time.Duration, migrateData bool) error
+	HasRows(ctx context.Context, table string) (bool, error)
+	SetChunkInterval(ctx context.Context, table string, chunkInterval time.Duration) error
+	SetCompression(ctx context.Context, table string, segmentBy []string, orderBy string) error
+	// GetPolicy returns the interval of a compression or retention policy,
+	// or nil when there is none.
+	GetPolicy(ctx context.Context, relation, policy string) (*time.Duration, error)
+	// SetPolicy replaces a compression or retention policy; zero removes it.
+	SetPolicy(ctx context.Context, relation, policy string, after time.Duration) error
+	ContinuousAggregateExists(ctx context.Context, view string) (bool, error)
+	CreateContinuousAggregate(ctx context.Context, view, query string) error
+	// GetRefreshPolicy returns nil without error when there is no policy.
+	GetRefreshPolicy(ctx context.Context, view string) (*model.RefreshPolicy, error)
+	SetRefreshPolicy(ctx context.Context, view string, policy model.RefreshPolicy) error
+	// TryLocked runs fn if the named advisory lock is free and reports
+	// whether it ran.
+	TryLocked(ctx context.Context, name string, fn func() error) (bool, error)
+}
+
+// Policy kinds accepted by GetPolicy and SetPolicy.
+const (
+	PolicyCompression = "compression"
+	PolicyRetention   = "retention"
+)
+
+type timescale struct {
+	db *pgxpool.Pool
+}
+
+func NewTimescale(db *pgxpool.Pool) Timescale {
+	return &timescale{db: db}
+}
+
+func (t *timescale) Version(ctx context.Context) (string, error) {
+	var version string
+	err := t.db.QueryRow(ctx, GetTimescaleVersion).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return version, err
+}
+
+func (t *timescale) GetHypertable(ctx context.Context, table string) (*model.Hypertable, error) {
+	h := model.Hypertable{Table: table}
+	var chunkSeconds float64
+	err := t.db.QueryRow(ctx, GetHypertable, table).Scan(&h.TimeColumn, &chunkSeconds, &h.CompressionEnabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.ChunkInterval = seconds(chunkSeconds)
+
+	if !h.CompressionEnabled {
+		return &h, nil
+	}
+
+	rows, err := t.db.Query(ctx, GetCompressionSettings, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orderBy []string
+	for rows.Next() {
+		var column string
+		var segmentIndex, orderIndex *int
+		var asc *bool
+		if err := rows.Scan(&column, &segmentIndex, &orderIndex, &asc); err != nil {
+			return nil, err
+		}
+		if segmentIndex != nil {
+			h.SegmentBy = append(h.SegmentBy, column)
+		}
+		if orderIndex != nil {
+			if asc != nil && !*asc {
+				column += " DESC"
+			}
+			orderBy = append(orderBy, column)
+		}
+	}
+	h.OrderBy = strings.Join(orderBy, ", ")
+	return &h, rows.Err()
+}
+
+func (t *timescale) CreateHypertable(ctx context.Context, table, timeColumn string, chunkInterval time.Duration, migrateData bool) error {
+	_, err := t.db.Exec(ctx, CreateHypertable, table, timeColumn, chunkInterval, migrateData)
+	return err
+}
+
+func (t *timescale) HasRows(ctx context.Context, table string) (bool, error) {
+	var hasRows bool
+	err := t.db.QueryRow(ctx, fmt.Sprintf(HasRows, pgx.Identifier{table}.Sanitize())).Scan(&hasRows)
+	return hasRows, err
+}
+
+func (t *timescale) SetChunkInterval(ctx context.Context, table string, chunkInterval time.Duration) error {
+	_, err := t.db.Exec(ctx, SetChunkInterval, table, chunkInterval)
+	return err
+}
+
+func (t *timescale) SetCompression(ctx context.Context, table string, segmentBy []string, orderBy string) error {
+	query := fmt.Sprintf(SetCompression, pgx.Identifier{table}.Sanitize(),
+		quoteLiteral(strings.Join(segmentBy, ", ")), quoteLiteral(orderBy))
+	_, err := t.db.Exec(ctx, query)
+	return err
+}
+
+func policyQueries(policy string) (proc, key, remove, add string, err error) {
+	switch policy {
+	case PolicyCompression:
+		return "policy_compression", "compress_after", RemoveCompressionPolicy, AddCompressionPolicy, nil
+	case PolicyRetention:
+		return "policy_retention", "drop_after", RemoveRetentionPolicy, AddRetentionPolicy, nil
+	}
+	return "", "", "", "", fmt.Errorf("unknown policy %q", policy)
+}
+
+func (t *timescale) GetPolicy(ctx context.Context, relation, policy string) (*time.Duration, error) {
+	proc, key, _, _, err := policyQueries(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var after *float64
+	err = t.db.QueryRow(ctx, GetPolicyInterval, relation, proc, key).Scan(&after)
+	if errors.Is(err, pgx.ErrNoRows) || after == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := seconds(*after)
+	return &d, nil
+}
+
+func (t *timescale) SetPolicy(ctx context.Context, relation, policy string, after time.Duration) error {
+	_, _, remove, add, err := policyQueries(policy)
+	if err != nil {
+		return err
+	}
+
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, remove, relation); err != nil {
+		return err
+	}
+	if after > 0 {
+		if _, err := tx.Exec(ctx, add, relation, after); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (t *timescale) ContinuousAggregateExists(ctx context.Context, view string) (bool, error) {
+	var exists bool
+	err := t.db.QueryRow(ctx, ContinuousAggregateExists, view).Scan(&exists)
+	return exists, err
+}
+
+// CreateContinuousAggregate runs outside a transaction, as TimescaleDB
+// requires for continuous aggregates.
+func (t *timescale) CreateContinuousAggregate(ctx context.Context, view, query string) error {
+	_, err := t.db.Exec(ctx, fmt.Sprintf(CreateContinuousAggregate, pgx.Identifier{view}.Sanitize(), query))
+	return err
+}
+
+func (t *timescale) GetRefreshPolicy(ctx context.Context, view string) (*model.RefreshPolicy, error) {
+	var start, end *float64
+	var schedule float64
+	err := t.db.QueryRow(ctx, GetRefreshPolicy, view).Scan(&start, &end, &schedule)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &model.RefreshPolicy{ScheduleInterval: seconds(schedule)}
+	if start != nil {
+		d := seconds(*start)
+		policy.StartOffset = &d
+	}
+	if end != nil {
+		d := seconds(*end)
+		policy.EndOffset = &d
+	}
+	return policy, nil
+}
+
+func (t *timescale) SetRefreshPolicy(ctx context.Context, view string, policy model.RefreshPolicy) error {
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, RemoveRefreshPolicy, view); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, AddRefreshPolicy, view, policy.StartOffset, policy.EndOffset, policy.ScheduleInterval); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// quoteLiteral quotes s as an SQL string literal. Storage parameters cannot
+// be bound as query arguments.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func (t *timescale) TryLocked(ctx context.Context, name string, fn func() error) (bool, error) {
+	return tryLocked(ctx, t.db, name, fn)
+}
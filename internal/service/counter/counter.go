@@ -0,0 +1,287 @@
+package counter
+
+import (
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/internal/service/state"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"go.uber.org/fx"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DeltaSuffix = "_delta"
+	FlagSuffix  = "_delta_flag"
+
+	// FlagReset marks a register that went backwards without a rollover.
+	FlagReset = "reset"
+	// FlagRollover marks a delta computed across the register's wrap point.
+	FlagRollover = "rollover"
+	// FlagSwap marks the first reading after the meter was replaced.
+	FlagSwap = "meter_swap"
+	// FlagJump marks an increase larger than max_delta.
+	FlagJump = "jump"
+	// FlagOutOfOrder marks a reading not newer than the last one seen.
+	FlagOutOfOrder = "out_of_order"
+)
+
+// RuleFile is the YAML document loaded from COUNTER_RULES_PATH.
+type RuleFile struct {
+	Counters []RuleSet `yaml:"counters"`
+}
+
+type RuleSet struct {
+	Tenant     string  `yaml:"tenant"`
+	DeviceType string  `yaml:"device_type"`
+	Fields     []Field `yaml:"fields"`
+}
+
+// Field configures delta conversion of one cumulative register. Rollover is
+// the value at which the register wraps back to zero, MaxDelta bounds a
+// plausible increase between two readings, and SwapField names a field (for
+// example the meter serial) whose change means the meter was replaced.
+type Field struct {
+	Field     string      `yaml:"field"`
+	Rollover  interface{} `yaml:"rollover"`
+	MaxDelta  interface{} `yaml:"max_delta"`
+	SwapField string      `yaml:"swap_field"`
+}
+
+type Converter interface {
+	// Convert adds <field>_delta for every configured register, or
+	// <field>_delta_flag when no trustworthy delta exists. The returned
+	// commit function records the readings and must only be called once the
+	// record has been loaded.
+	Convert(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (map[string]interface{}, func())
+}
+
+type compiledField struct {
+	field     string
+	rollover  *big.Rat
+	maxDelta  *big.Rat
+	swapField string
+}
+
+type compiledRuleSet struct {
+	extract.Selector
+	fields []compiledField
+}
+
+// reading is the persisted state value of one register.
+type reading struct {
+	Value interface{} `json:"value"`
+	Swap  interface{} `json:"swap,omitempty"`
+}
+
+type converter struct {
+	sets  []compiledRuleSet
+	store state.Store
+}
+
+type ConverterParams struct {
+	fx.In
+	Lifecycle fx.Lifecycle
+	Config    *config.Config
+	Repo      repository.Repository
+	Logger    logger.Logger
+}
+
+func NewConverter(params ConverterParams) (Converter, error) {
+	cfg := params.Config.Counter
+	if cfg.RulesPath == "" {
+		return &converter{}, nil
+	}
+
+	content, err := os.ReadFile(cfg.RulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read counter rules: %w", err)
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse counter rules: %w", err)
+	}
+
+	sets, err := compile(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if cfg.StateTTL != "" {
+		if ttl, err = util.ParseDuration(cfg.StateTTL); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid COUNTER_STATE_TTL %q", cfg.StateTTL)
+		}
+	}
+
+	store := state.NewStore(params.Lifecycle, model.StateKindCounter, params.Repo, params.Logger,
+		time.Duration(cfg.FlushInterval)*time.Second, ttl)
+	return &converter{sets: sets, store: store}, nil
+}
+
+func compile(file *RuleFile) ([]compiledRuleSet, error) {
+	var sets []compiledRuleSet
+	seen := make(extract.Selectors)
+
+	for i, set := range file.Counters {
+		compiled := compiledRuleSet{Selector: extract.NewSelector(set.Tenant, set.DeviceType)}
+		if err := seen.Add(compiled.Selector); err != nil {
+			return nil, fmt.Errorf("counters[%d]: %w", i, err)
+		}
+
+		for j, field := range set.Fields {
+			c, err := compileField(field)
+			if err != nil {
+				return nil, fmt.Errorf("counters[%d].fields[%d]: %w", i, j, err)
+			}
+			compiled.fields = append(compiled.fields, c)
+		}
+		sets = append(sets, compiled)
+	}
+	return sets, nil
+}
+
+func compileField(field Field) (compiledField, error) {
+	c := compiledField{field: field.Field, swapField: field.SwapField}
+	if field.Field == "" {
+		return c, errors.New("missing field")
+	}
+
+	if field.Rollover != nil {
+		r, err := util.ToRat(field.Rollover)
+		if err != nil || r.Sign() <= 0 {
+			return c, fmt.Errorf("invalid rollover %v", field.Rollover)
+		}
+		c.rollover = r
+	}
+	if field.MaxDelta != nil {
+		r, err := util.ToRat(field.MaxDelta)
+		if err != nil || r.Sign() <= 0 {
+			return c, fmt.Errorf("invalid max_delta %v", field.MaxDelta)
+		}
+		c.maxDelta = r
+	}
+	return c, nil
+}
+
+// Convert derives interval deltas from the previous reading of the same
+// device and register. A reading that goes backwards counts as a rollover
+// only when a rollover is configured and the wrapped delta is plausible;
+// otherwise it is flagged as a reset and the new value becomes the baseline.
+func (c *converter) Convert(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (map[string]interface{}, func()) {
+	set := c.match(identity)
+	if set == nil {
+		return data, func() {}
+	}
+
+	var readings []model.StateEntry
+	for _, field := range set.fields {
+		value, ok := util.GetPath(data, field.field)
+		if !ok || value == nil {
+			continue
+		}
+		current, err := util.ToRat(value)
+		if err != nil {
+			continue
+		}
+
+		var swap interface{}
+		if field.swapField != "" {
+			swap, _ = util.GetPath(data, field.swapField)
+		}
+
+		entry := model.StateEntry{
+			TenantID:  identity.TenantId,
+			DeviceID:  identity.DeviceId,
+			Field:     field.field,
+			Value:     reading{Value: util.RatToNumber(current), Swap: swap},
+			Timestamp: timestamp,
+		}
+
+		last, seen := c.store.Get(identity.TenantId, identity.DeviceId, field.field)
+		if !seen {
+			readings = append(readings, entry)
+			continue
+		}
+		if !timestamp.After(last.Timestamp) {
+			util.SetPath(data, field.field+FlagSuffix, FlagOutOfOrder)
+			continue
+		}
+		readings = append(readings, entry)
+
+		prevValue, prevSwap := decodeReading(last.Value)
+		previous, err := util.ToRat(prevValue)
+		if err != nil {
+			continue
+		}
+
+		if field.swapField != "" && prevSwap != nil && swap != nil && fmt.Sprint(prevSwap) != fmt.Sprint(swap) {
+			util.SetPath(data, field.field+FlagSuffix, FlagSwap)
+			continue
+		}
+
+		delta, flag := field.delta(previous, current)
+		if flag != "" {
+			util.SetPath(data, field.field+FlagSuffix, flag)
+		}
+		if delta != nil {
+			util.SetPath(data, field.field+DeltaSuffix, util.RatToNumber(delta))
+		}
+	}
+
+	return data, func() {
+		for _, entry := range readings {
+			c.store.Put(entry)
+		}
+	}
+}
+
+// delta returns the consumption between two readings, or nil with a flag when
+// the readings cannot be trusted to produce one.
+func (f compiledField) delta(previous, current *big.Rat) (*big.Rat, string) {
+	delta := new(big.Rat).Sub(current, previous)
+	flag := ""
+
+	if delta.Sign() < 0 {
+		if f.rollover == nil {
+			return nil, FlagReset
+		}
+		// The register wrapped: consumption is what was left to the
+		// rollover point plus the new reading.
+		delta.Add(delta, f.rollover)
+		if delta.Sign() < 0 || (f.maxDelta != nil && delta.Cmp(f.maxDelta) > 0) {
+			return nil, FlagReset
+		}
+		flag = FlagRollover
+	}
+
+	if f.maxDelta != nil && delta.Cmp(f.maxDelta) > 0 {
+		return nil, FlagJump
+	}
+	return delta, flag
+}
+
+func (c *converter) match(identity extract.Identity) *compiledRuleSet {
+	return extract.BestMatch(identity, c.sets)
+}
+
+// decodeReading accepts both the in-memory reading and the map it becomes
+// after a round trip through Postgres.
+func decodeReading(v interface{}) (interface{}, interface{}) {
+	switch r := v.(type) {
+	case reading:
+		return r.Value, r.Swap
+	case map[string]interface{}:
+		return r["value"], r["swap"]
+	}
+	return v, nil
+}
@@ -0,0 +1,55 @@
+package counter
+
+import (
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/extract"
+	"testing"
+	"time"
+)
+
+// memoryStore is a state.Store without persistence.
+type memoryStore map[string]model.StateEntry
+
+func (m memoryStore) Get(tenantID, deviceID, field string) (model.StateEntry, bool) {
+	entry, ok := m[tenantID+"/"+deviceID+"/"+field]
+	return entry, ok
+}
+
+func (m memoryStore) Put(entry model.StateEntry) bool {
+	m[entry.TenantID+"/"+entry.DeviceID+"/"+entry.Field] = entry
+	return true
+}
+
+func TestConvertNestedRegister(t *testing.T) {
+	sets, err := compile(&RuleFile{Counters: []RuleSet{{Fields: []Field{{Field: "meter.energy", Rollover: 1000}}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &converter{sets: sets, store: memoryStore{}}
+	device := extract.Identity{TenantId: "t", DeviceId: "d"}
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	readings := []struct {
+		value string
+		delta interface{}
+		flag  interface{}
+	}{
+		{"10.25", nil, nil},
+		{"10.4", json.Number("0.15"), nil},
+		{"0.4", json.Number("990"), FlagRollover},
+	}
+	for i, r := range readings {
+		data := map[string]interface{}{"meter": map[string]interface{}{"energy": json.Number(r.value)}}
+		data, commit := c.Convert(device, start.Add(time.Duration(i)*time.Minute), data)
+		commit()
+
+		meter := data["meter"].(map[string]interface{})
+		if meter["energy"+DeltaSuffix] != r.delta || meter["energy"+FlagSuffix] != r.flag {
+			t.Fatalf("reading %d: got %v", i, meter)
+		}
+		if len(data) != 1 {
+			t.Fatalf("reading %d: suffixed fields added at the top level: %v", i, data)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package deadband
+
+import (
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/internal/service/state"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"time"
+
+	"go.uber.org/fx"
+	"gopkg.in/yaml.v3"
+)
+
+// RuleFile is the YAML document loaded from DEADBAND_RULES_PATH.
+type RuleFile struct {
+	Deadband []RuleSet `yaml:"deadband"`
+}
+
+// RuleSet configures change-only compression for one tenant and device type.
+// Fields without an entry use Default when it is set and pass through
+// otherwise.
+type RuleSet struct {
+	Tenant     string          `yaml:"tenant"`
+	DeviceType string          `yaml:"device_type"`
+	Heartbeat  string          `yaml:"heartbeat"`
+	Default    *Band           `yaml:"default"`
+	Fields     map[string]Band `yaml:"fields"`
+}
+
+// Band suppresses a numeric value while it stays within Absolute units or
+// Percent percent of the last written value. Non-numeric values are
+// suppressed while they are unchanged.
+type Band struct {
+	Absolute float64 `yaml:"absolute"`
+	Percent  float64 `yaml:"percent"`
+}
+
+type Filter interface {
+	// Filter removes suppressed fields from data. The returned commit
+	// function records the written values and must only be called once the
+	// record has been loaded, so a failed load is retried unfiltered.
+	// A nil map means every field was suppressed and nothing is due.
+	Filter(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (map[string]interface{}, func())
+}
+
+type compiledRuleSet struct {
+	extract.Selector
+	heartbeat time.Duration
+	fallback  *Band
+	fields    map[string]Band
+}
+
+type filter struct {
+	sets  []compiledRuleSet
+	store state.Store
+}
+
+type FilterParams struct {
+	fx.In
+	Lifecycle fx.Lifecycle
+	Config    *config.Config
+	Repo      repository.Repository
+	Logger    logger.Logger
+}
+
+func NewFilter(params FilterParams) (Filter, error) {
+	cfg := params.Config.Deadband
+	if cfg.RulesPath == "" {
+		return &filter{}, nil
+	}
+
+	content, err := os.ReadFile(cfg.RulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deadband rules: %w", err)
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse deadband rules: %w", err)
+	}
+
+	sets, err := compile(&file)
+	if err != nil {
+		return nil, err
+	}
+
+	var ttl time.Duration
+	if cfg.StateTTL != "" {
+		if ttl, err = util.ParseDuration(cfg.StateTTL); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid DEADBAND_STATE_TTL %q", cfg.StateTTL)
+		}
+	}
+
+	store := state.NewStore(params.Lifecycle, model.StateKindDeadband, params.Repo, params.Logger,
+		time.Duration(cfg.FlushInterval)*time.Second, ttl)
+	return &filter{sets: sets, store: store}, nil
+}
+
+func compile(file *RuleFile) ([]compiledRuleSet, error) {
+	var sets []compiledRuleSet
+	seen := make(extract.Selectors)
+
+	for i, set := range file.Deadband {
+		compiled := compiledRuleSet{
+			Selector: extract.NewSelector(set.Tenant, set.DeviceType),
+			fallback: set.Default,
+			fields:   set.Fields,
+		}
+		if err := seen.Add(compiled.Selector); err != nil {
+			return nil, fmt.Errorf("deadband[%d]: %w", i, err)
+		}
+
+		if set.Heartbeat == "" {
+			return nil, fmt.Errorf("deadband[%d]: missing heartbeat", i)
+		}
+		heartbeat, err := util.ParseDuration(set.Heartbeat)
+		if err != nil || heartbeat <= 0 {
+			return nil, fmt.Errorf("deadband[%d]: invalid heartbeat %q", i, set.Heartbeat)
+		}
+		compiled.heartbeat = heartbeat
+
+		if set.Default != nil {
+			if err := validateBand(*set.Default); err != nil {
+				return nil, fmt.Errorf("deadband[%d].default: %w", i, err)
+			}
+		}
+		for field, band := range set.Fields {
+			if err := validateBand(band); err != nil {
+				return nil, fmt.Errorf("deadband[%d].fields.%s: %w", i, field, err)
+			}
+		}
+		sets = append(sets, compiled)
+	}
+	return sets, nil
+}
+
+func validateBand(band Band) error {
+	if band.Absolute < 0 || band.Percent < 0 {
+		return errors.New("deadband must not be negative")
+	}
+	if band.Absolute > 0 && band.Percent > 0 {
+		return errors.New("set either absolute or percent, not both")
+	}
+	return nil
+}
+
+// Filter drops each configured field whose value stays within its deadband
+// of the last written value, unless the heartbeat interval has elapsed since
+// that write. Readings older than the last written one pass through
+// unfiltered and do not move the state back in time.
+func (f *filter) Filter(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (map[string]interface{}, func()) {
+	set := f.match(identity)
+	if set == nil {
+		return data, func() {}
+	}
+
+	result := make(map[string]interface{}, len(data))
+	var written []model.StateEntry
+
+	for field, value := range data {
+		band, ok := set.fields[field]
+		if !ok {
+			if set.fallback == nil {
+				result[field] = value
+				continue
+			}
+			band = *set.fallback
+		}
+
+		last, seen := f.store.Get(identity.TenantId, identity.DeviceId, field)
+		if seen && timestamp.Before(last.Timestamp) {
+			result[field] = value
+			continue
+		}
+		if seen && timestamp.Sub(last.Timestamp) < set.heartbeat && withinBand(band, last.Value, value) {
+			continue
+		}
+
+		result[field] = value
+		written = append(written, model.StateEntry{
+			TenantID:  identity.TenantId,
+			DeviceID:  identity.DeviceId,
+			Field:     field,
+			Value:     value,
+			Timestamp: timestamp,
+		})
+	}
+
+	commit := func() {
+		for _, entry := range written {
+			f.store.Put(entry)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, commit
+	}
+	return result, commit
+}
+
+func (f *filter) match(identity extract.Identity) *compiledRuleSet {
+	return extract.BestMatch(identity, f.sets)
+}
+
+func withinBand(band Band, last, current interface{}) bool {
+	if !util.IsNumber(last) || !util.IsNumber(current) {
+		return reflect.DeepEqual(last, current)
+	}
+
+	prev, err := util.ToFloat64(last)
+	if err != nil {
+		return false
+	}
+	next, err := util.ToFloat64(current)
+	if err != nil {
+		return false
+	}
+
+	diff := math.Abs(next - prev)
+	switch {
+	case band.Percent > 0:
+		if prev == 0 {
+			return next == 0
+		}
+		return diff/math.Abs(prev)*100 <= band.Percent
+	case band.Absolute > 0:
+		return diff <= band.Absolute
+	}
+	return diff == 0
+}
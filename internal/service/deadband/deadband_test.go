@@ -0,0 +1,54 @@
+package deadband
+
+import (
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/extract"
+	"testing"
+	"time"
+)
+
+// memoryStore is a state.Store without persistence.
+type memoryStore map[string]model.StateEntry
+
+func (m memoryStore) Get(tenantID, deviceID, field string) (model.StateEntry, bool) {
+	entry, ok := m[tenantID+"/"+deviceID+"/"+field]
+	return entry, ok
+}
+
+func (m memoryStore) Put(entry model.StateEntry) bool {
+	m[entry.TenantID+"/"+entry.DeviceID+"/"+entry.Field] = entry
+	return true
+}
+
+func TestFilterSuppressesUntilHeartbeat(t *testing.T) {
+	sets, err := compile(&RuleFile{Deadband: []RuleSet{{
+		Heartbeat: "1d12h",
+		Fields:    map[string]Band{"temp": {Absolute: 0.5}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &filter{sets: sets, store: memoryStore{}}
+	device := extract.Identity{TenantId: "t", DeviceId: "d"}
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	readings := []struct {
+		after   time.Duration
+		value   string
+		written bool
+	}{
+		{0, "20", true},
+		{time.Hour, "20.4", false},
+		{2 * time.Hour, "21", true},
+		{37 * time.Hour, "21", false},
+		{38 * time.Hour, "21", true},
+	}
+	for i, r := range readings {
+		data, commit := f.Filter(device, start.Add(r.after), map[string]interface{}{"temp": json.Number(r.value)})
+		commit()
+		if written := data != nil; written != r.written {
+			t.Fatalf("reading %d: written = %v, want %v", i, written, r.written)
+		}
+	}
+}
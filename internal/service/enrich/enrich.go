@@ -0,0 +1,229 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/cache"
+	"etl-pipeline/pkg/logger"
+	"strings"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// NotifyChannel is the channel the devices trigger of migration 0005
+// notifies on every change.
+const NotifyChannel = "device_changed"
+
+// Source looks up device metadata. The Postgres devices table is the default
+// implementation; other registries can be plugged in by providing a Source.
+type Source interface {
+	// Lookup returns nil without error for an unknown device.
+	Lookup(ctx context.Context, tenantID, deviceID string) (*model.Device, error)
+	List(ctx context.Context) ([]model.Device, error)
+}
+
+type repositorySource struct {
+	repo repository.Repository
+}
+
+func NewRepositorySource(repo repository.Repository) Source {
+	return &repositorySource{repo: repo}
+}
+
+func (s *repositorySource) Lookup(ctx context.Context, tenantID, deviceID string) (*model.Device, error) {
+	return s.repo.GetDevice(ctx, tenantID, deviceID)
+}
+
+func (s *repositorySource) List(ctx context.Context) ([]model.Device, error) {
+	return s.repo.ListDevices(ctx)
+}
+
+type Enricher interface {
+	// Enrich merges the configured registry attributes into data. Fields
+	// the device sent itself are never overwritten.
+	Enrich(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error)
+}
+
+type enricher struct {
+	enabled     bool
+	attributes  []string
+	prefix      string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	source      Source
+	repo        repository.Repository
+	logger      logger.Logger
+	// cache holds nil for devices known to be missing from the registry.
+	cache  *cache.LRU[string, *model.Device]
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type EnricherParams struct {
+	fx.In
+	Lifecycle fx.Lifecycle
+	Config    *config.Config
+	Source    Source
+	Repo      repository.Repository
+	Logger    logger.Logger
+}
+
+func NewEnricher(params EnricherParams) (Enricher, error) {
+	cfg := params.Config.Enrich
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &enricher{
+		enabled:     cfg.Enabled,
+		attributes:  cfg.Attributes,
+		prefix:      cfg.Prefix,
+		ttl:         time.Duration(cfg.CacheTTL) * time.Second,
+		negativeTTL: time.Duration(cfg.NegativeTTL) * time.Second,
+		source:      params.Source,
+		repo:        params.Repo,
+		logger:      params.Logger,
+		cache:       cache.NewLRU[string, *model.Device](cfg.CacheSize),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	if !e.enabled {
+		return e, nil
+	}
+	if len(cfg.Attributes) == 0 {
+		return nil, errors.New("enrichment is enabled but ENRICH_ATTRIBUTES is empty")
+	}
+	if cfg.CacheTTL <= 0 || cfg.NegativeTTL <= 0 {
+		return nil, errors.New("enrichment cache TTLs must be positive")
+	}
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(startCtx context.Context) error {
+			if cfg.Preload {
+				if err := e.preload(startCtx); err != nil {
+					return err
+				}
+			}
+			if cfg.Listen {
+				go e.listen(NotifyChannel)
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+
+	return e, nil
+}
+
+func key(tenantID, deviceID string) string {
+	return tenantID + "/" + deviceID
+}
+
+func (e *enricher) Enrich(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error) {
+	if !e.enabled {
+		return data, nil
+	}
+
+	device, err := e.lookup(identity)
+	if err != nil || device == nil {
+		return data, err
+	}
+
+	for _, name := range e.attributes {
+		value, ok := device.Attributes[name]
+		if !ok || value == nil {
+			continue
+		}
+		field := e.prefix + name
+		if _, exists := data[field]; exists {
+			continue
+		}
+		data[field] = value
+	}
+	return data, nil
+}
+
+func (e *enricher) lookup(identity extract.Identity) (*model.Device, error) {
+	k := key(identity.TenantId, identity.DeviceId)
+	if device, ok := e.cache.Get(k); ok {
+		return device, nil
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, 5*time.Second)
+	defer cancel()
+
+	device, err := e.source.Lookup(ctx, identity.TenantId, identity.DeviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if device == nil {
+		e.cache.Set(k, nil, e.negativeTTL)
+		return nil, nil
+	}
+	e.cache.Set(k, device, e.ttl)
+	return device, nil
+}
+
+// preload fills the cache with the whole registry, up to the cache size.
+func (e *enricher) preload(ctx context.Context) error {
+	devices, err := e.source.List(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range devices {
+		device := devices[i]
+		e.cache.Set(key(device.TenantID, device.DeviceID), &device, e.ttl)
+	}
+	e.logger.Info("Preloaded device registry",
+		zap.Int("devices", len(devices)),
+		zap.Int("cached", e.cache.Len()))
+	return nil
+}
+
+// listen invalidates cache entries on NOTIFY. The payload is
+// "<tenant_id>/<device_id>"; an empty payload purges the whole cache.
+// The listener reconnects with backoff until the enricher stops.
+func (e *enricher) listen(channel string) {
+	backoff := time.Second
+	for {
+		err := e.repo.Listen(e.ctx, channel, func(payload string) {
+			backoff = time.Second
+			e.invalidate(payload)
+		})
+		if e.ctx.Err() != nil {
+			return
+		}
+
+		// Notifications may have been missed while disconnected.
+		e.cache.Purge()
+		e.logger.Warn("Device registry listener disconnected",
+			zap.String("channel", channel),
+			zap.Duration("retryIn", backoff),
+			zap.Error(err))
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (e *enricher) invalidate(payload string) {
+	payload = strings.TrimSpace(payload)
+	if payload == "" {
+		e.cache.Purge()
+		return
+	}
+	e.cache.Delete(payload)
+}
@@ -0,0 +1,90 @@
+package enrich
+
+import (
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/cache"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mapSource is a registry held in memory that counts its lookups.
+type mapSource struct {
+	devices map[string]*model.Device
+	lookups int
+}
+
+func (s *mapSource) Lookup(_ context.Context, tenantID, deviceID string) (*model.Device, error) {
+	s.lookups++
+	return s.devices[key(tenantID, deviceID)], nil
+}
+
+func (s *mapSource) List(context.Context) ([]model.Device, error) {
+	var devices []model.Device
+	for _, device := range s.devices {
+		devices = append(devices, *device)
+	}
+	return devices, nil
+}
+
+func newTestEnricher(source Source) *enricher {
+	return &enricher{
+		enabled:     true,
+		attributes:  []string{"site", "timezone"},
+		prefix:      "meta_",
+		ttl:         time.Minute,
+		negativeTTL: time.Minute,
+		source:      source,
+		cache:       cache.NewLRU[string, *model.Device](10),
+		ctx:         context.Background(),
+	}
+}
+
+func TestEnrichKeepsDeviceFields(t *testing.T) {
+	source := &mapSource{devices: map[string]*model.Device{
+		"t/d": {TenantID: "t", DeviceID: "d", Attributes: map[string]interface{}{"site": "north", "timezone": "UTC", "owner": "x"}},
+	}}
+	e := newTestEnricher(source)
+
+	data, err := e.Enrich(extract.Identity{TenantId: "t", DeviceId: "d"}, map[string]interface{}{"meta_timezone": "CET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"meta_site": "north", "meta_timezone": "CET"}
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("got %v, want %v", data, want)
+	}
+}
+
+func TestLookupCachesAndInvalidates(t *testing.T) {
+	source := &mapSource{devices: map[string]*model.Device{}}
+	e := newTestEnricher(source)
+	device := extract.Identity{TenantId: "t", DeviceId: "d"}
+
+	// Unknown devices are remembered too.
+	for i := 0; i < 2; i++ {
+		if _, err := e.Enrich(device, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.lookups != 1 {
+		t.Fatalf("looked up %d times, want 1", source.lookups)
+	}
+
+	source.devices["t/d"] = &model.Device{TenantID: "t", DeviceID: "d", Attributes: map[string]interface{}{"site": "north"}}
+	e.invalidate("t/d")
+	data, err := e.Enrich(device, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["meta_site"] != "north" || source.lookups != 2 {
+		t.Fatalf("got %v after %d lookups, want the registered site after 2", data, source.lookups)
+	}
+
+	e.invalidate("")
+	if e.cache.Len() != 0 {
+		t.Fatalf("cache holds %d entries after a purge", e.cache.Len())
+	}
+}
@@ -0,0 +1,10 @@
+package event
+
+import "context"
+
+// DeadLetter receives records a sink could not deliver. The record has
+// already been through the pipeline, so it is forwarded as is. It is
+// satisfied by the Kafka writer in external/kafka.
+type DeadLetter interface {
+	WriteSinkFailure(ctx context.Context, sink string, key, value []byte, err error) error
+}
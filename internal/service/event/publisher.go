@@ -0,0 +1,20 @@
+package event
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher writes pipeline events (schema drift, quality, ...) to Kafka
+// topics. It is satisfied by the Kafka writer in external/kafka.
+type Publisher interface {
+	WriteMessages(ctx context.Context, topic string, messages ...kafka.Message) error
+}
+
+// Producer writes records to Kafka topics and only returns once the brokers
+// have acknowledged them, so callers can retry or dead-letter on failure.
+// It is satisfied by the Kafka writer in external/kafka.
+type Producer interface {
+	Produce(ctx context.Context, topic string, messages ...kafka.Message) error
+}
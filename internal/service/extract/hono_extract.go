@@ -1,15 +1,41 @@
 package extract
 
 import (
-	"encoding/json"
 	"errors"
 	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/util"
 	"time"
 )
 
 type Identity struct {
-	TenantId string
-	DeviceId string
+	TenantId   string
+	DeviceId   string
+	DeviceType string
+}
+
+// Wildcard matches any tenant or device type in a per-tenant selector.
+const Wildcard = "*"
+
+// MatchScore ranks how specifically a tenant/device type selector matches the
+// identity: exact tenant beats exact device type, which beats wildcards. It
+// returns -1 when the selector does not match at all.
+func (i Identity) MatchScore(tenant, deviceType string) int {
+	score := 0
+	switch tenant {
+	case i.TenantId:
+		score += 2
+	case Wildcard:
+	default:
+		return -1
+	}
+	switch deviceType {
+	case i.DeviceType:
+		score++
+	case Wildcard:
+	default:
+		return -1
+	}
+	return score
 }
 
 type HonoExtractor interface {
@@ -20,7 +46,7 @@ func (e *extract) Extracter(data []byte) (Identity, interface{}, time.Time, erro
 	identity := Identity{}
 
 	var value model.KafkaMessageValue
-	if err := json.Unmarshal(data, &value); err != nil {
+	if err := util.UnmarshalJSON(data, &value); err != nil {
 		return identity, nil, time.Time{}, errors.New("failed to unmarshal KafkaMessageValue: " + err.Error())
 	}
 
@@ -29,6 +55,9 @@ func (e *extract) Extracter(data []byte) (Identity, interface{}, time.Time, erro
 
 	identity.TenantId = tenantId.(string)
 	identity.DeviceId = deviceId.(string)
+	if deviceType, ok := value.Headers["device_type"].(string); ok {
+		identity.DeviceType = deviceType
+	}
 	return identity, value.Value, value.Timestamp, nil
 }
 
@@ -0,0 +1,58 @@
+package extract
+
+import "fmt"
+
+// Selector picks the records a per-tenant rule set applies to. Rule sets
+// embed it and are matched with BestMatch.
+type Selector struct {
+	Tenant     string
+	DeviceType string
+}
+
+// NewSelector builds a selector from config values, where an empty tenant or
+// device type matches any.
+func NewSelector(tenant, deviceType string) Selector {
+	if tenant == "" {
+		tenant = Wildcard
+	}
+	if deviceType == "" {
+		deviceType = Wildcard
+	}
+	return Selector{Tenant: tenant, DeviceType: deviceType}
+}
+
+// Selection returns the selector, so types embedding it satisfy the
+// constraint of BestMatch.
+func (s Selector) Selection() Selector {
+	return s
+}
+
+func (s Selector) String() string {
+	return fmt.Sprintf("tenant=%q device_type=%q", s.Tenant, s.DeviceType)
+}
+
+// BestMatch returns the item whose selector matches identity most
+// specifically, as ranked by MatchScore, or nil when none matches.
+func BestMatch[T interface{ Selection() Selector }](identity Identity, items []T) *T {
+	var best *T
+	bestScore := -1
+	for i := range items {
+		s := items[i].Selection()
+		if score := identity.MatchScore(s.Tenant, s.DeviceType); score > bestScore {
+			best, bestScore = &items[i], score
+		}
+	}
+	return best
+}
+
+// Selectors collects the selectors of one config file to reject duplicates.
+type Selectors map[Selector]bool
+
+// Add records s and fails when it was added before.
+func (seen Selectors) Add(s Selector) error {
+	if seen[s] {
+		return fmt.Errorf("duplicate selector %s", s)
+	}
+	seen[s] = true
+	return nil
+}
@@ -2,32 +2,72 @@ package load
 
 import (
 	"context"
+	"encoding/json"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
 	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/privacy"
 	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
 	"time"
 
 	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Storage formats for records without a wide table.
+const (
+	FormatJSONB  = "jsonb"
+	FormatNarrow = "narrow"
 )
 
 type load struct {
 	repo   repository.Repository
-	logger logger.Logger
-	ctx    context.Context
-	cancel context.CancelFunc
+	wide   *wideLoader
+	format string
+	// narrowTable is the metric table written in the narrow format.
+	narrowTable string
+	latestState bool
+	deadLetter  event.DeadLetter
+	logger      logger.Logger
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 type LoadParams struct {
 	fx.In
-	Repo   repository.Repository
-	Logger logger.Logger
+	Config     *config.Config
+	Repo       repository.Repository
+	DeadLetter event.DeadLetter
+	Logger     logger.Logger
 }
 
 // Load implements Loader.
-func (l *load) Load(tenantID string, deviceID string, timestamp time.Time, data map[string]interface{}) error {
+func (l *load) Load(record *model.RawDeviceData) error {
 	ctx, cancel := context.WithTimeout(l.ctx, 30*time.Second)
 	defer cancel()
 
-	err := l.repo.InsertRawDeviceData(ctx, tenantID, deviceID, timestamp, data)
+	// The upsert is idempotent, so it goes first: when the history insert
+	// fails, the retry repeats both without harm.
+	if l.latestState {
+		if err := l.repo.UpsertLatestState(ctx, record); err != nil {
+			return fmt.Errorf("failed to update latest state: %w", err)
+		}
+	}
+
+	if l.wide != nil {
+		if table := l.wide.match(record); table != nil {
+			return l.wide.load(ctx, table, record)
+		}
+	}
+
+	if l.format == FormatNarrow {
+		return l.loadNarrow(ctx, record)
+	}
+
+	err := l.repo.InsertRawDeviceData(ctx, record)
 	if err != nil {
 		return err
 	}
@@ -35,16 +75,64 @@ func (l *load) Load(tenantID string, deviceID string, timestamp time.Time, data
 	return nil
 }
 
+// loadNarrow copies the metric rows of record in one transaction. When
+// Postgres rejects some rows for their values, only those go to the DLQ.
+func (l *load) loadNarrow(ctx context.Context, record *model.RawDeviceData) error {
+	return l.repo.InsertMetricRows(ctx, l.narrowTable, explode(record), func(rejected []util.Rejected[model.MetricRow]) error {
+		for _, r := range rejected {
+			l.logger.Warn("Metric row rejected by database",
+				zap.String("tenantID", record.TenantID),
+				zap.String("deviceID", record.DeviceID),
+				zap.String("metric", r.Item.Metric),
+				zap.String("error", privacy.RedactError(r.Err)))
+
+			value, err := json.Marshal(r.Item)
+			if err != nil {
+				return err
+			}
+			key := []byte(record.TenantID + "/" + record.DeviceID)
+			if err := l.deadLetter.WriteSinkFailure(ctx, l.narrowTable, key, value, r.Err); err != nil {
+				return fmt.Errorf("failed to dead-letter rejected metric row: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
 type Loader interface {
-	Load(tenantID string, deviceID string, timestamp time.Time, data map[string]interface{}) error
+	Load(record *model.RawDeviceData) error
 }
 
-func NewLoad(params LoadParams) Loader {
+func NewLoad(params LoadParams) (Loader, error) {
+	cfg := params.Config.Loader
+	switch cfg.Format {
+	case FormatJSONB:
+	case FormatNarrow:
+		if !identifierPattern.MatchString(cfg.NarrowTable) {
+			return nil, fmt.Errorf("invalid narrow table name %q", cfg.NarrowTable)
+		}
+	default:
+		return nil, fmt.Errorf("unknown load format %q, expected %s or %s", cfg.Format, FormatJSONB, FormatNarrow)
+	}
+
+	var wide *wideLoader
+	if path := cfg.WideTablesPath; path != "" {
+		var err error
+		if wide, err = newWideLoader(path, params.Repo); err != nil {
+			return nil, err
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &load{
-		repo:   params.Repo,
-		logger: params.Logger,
-		ctx:    ctx,
-		cancel: cancel,
-	}
+		repo:        params.Repo,
+		wide:        wide,
+		format:      cfg.Format,
+		narrowTable: cfg.NarrowTable,
+		latestState: cfg.LatestState,
+		deadLetter:  params.DeadLetter,
+		logger:      params.Logger,
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
 }
@@ -0,0 +1,92 @@
+package load
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/util"
+	"testing"
+)
+
+// recordingRepo keeps the records inserted into raw_device_data.
+type recordingRepo struct {
+	repository.Repository
+	records []*model.RawDeviceData
+}
+
+func (r *recordingRepo) InsertRawDeviceData(_ context.Context, record *model.RawDeviceData) error {
+	r.records = append(r.records, record)
+	return nil
+}
+
+func TestLoadKeepsLargeCounters(t *testing.T) {
+	const payload = `{"big":9007199254740993,"max":18446744073709551615}`
+
+	var data map[string]interface{}
+	if err := util.UnmarshalJSON([]byte(payload), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &recordingRepo{}
+	loader, err := NewLoad(LoadParams{
+		Config: &config.Config{Loader: config.LoaderConfig{Format: FormatJSONB}},
+		Repo:   repo,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(&model.RawDeviceData{TenantID: "t", DeviceID: "d", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repo.records) != 1 {
+		t.Fatalf("inserted %d records, want 1", len(repo.records))
+	}
+	// pgx encodes the JSONB column with encoding/json.
+	stored, err := json.Marshal(repo.records[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != payload {
+		t.Fatalf("stored %s, want %s", stored, payload)
+	}
+}
+
+func TestConvertBigint(t *testing.T) {
+	got, ok := convert(model.ColumnBigint, json.Number("9007199254740993"))
+	if !ok || got != int64(9007199254740993) {
+		t.Fatalf("convert 2^53+1 = %v, %v", got, ok)
+	}
+	if got, ok := convert(model.ColumnBigint, uint64(1<<53+1)); !ok || got != int64(1<<53+1) {
+		t.Fatalf("convert uint64 = %v, %v", got, ok)
+	}
+	// Values a bigint cannot hold are left for the overflow column.
+	if _, ok := convert(model.ColumnBigint, json.Number("18446744073709551615")); ok {
+		t.Fatal("convert accepted a value above int64")
+	}
+}
+
+func TestExplodeCarriesQuality(t *testing.T) {
+	record := &model.RawDeviceData{
+		TenantID:          "t",
+		DeviceID:          "d",
+		Data:              map[string]interface{}{"env": map[string]interface{}{"temp": json.Number("21.5")}, "on": true, "gone": nil},
+		QualityCode:       2,
+		QualityViolations: []string{"env.temp:range"},
+	}
+
+	rows := explode(record)
+	if len(rows) != 2 || rows[0].Metric != "env.temp" || rows[1].Metric != "on" {
+		t.Fatalf("got %+v, want env.temp and on", rows)
+	}
+	for _, row := range rows {
+		if row.QualityCode != 2 || len(row.QualityViolations) != 1 {
+			t.Fatalf("row %s lost the record's quality: %+v", row.Metric, row)
+		}
+	}
+	if rows[0].ValueDouble == nil || *rows[0].ValueDouble != 21.5 || rows[1].ValueBool == nil || !*rows[1].ValueBool {
+		t.Fatalf("got values %+v", rows)
+	}
+}
@@ -0,0 +1,68 @@
+package load
+
+import (
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/util"
+	"sort"
+	"strings"
+)
+
+// explode turns a record into one metric row per field. Nested objects
+// become dotted metric names, numbers go to value_double, booleans to
+// value_bool and everything else to value_text, with arrays encoded as JSON.
+// Null fields produce no row.
+func explode(record *model.RawDeviceData) []model.MetricRow {
+	rows := make([]model.MetricRow, 0, len(record.Data))
+	violations := record.QualityViolations
+	if violations == nil {
+		violations = []string{}
+	}
+	appendMetrics(&rows, record, violations, nil, record.Data)
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Metric < rows[j].Metric
+	})
+	return rows
+}
+
+func appendMetrics(rows *[]model.MetricRow, record *model.RawDeviceData, violations, prefix []string, data map[string]interface{}) {
+	for field, value := range data {
+		path := append(prefix[:len(prefix):len(prefix)], field)
+		if nested, ok := value.(map[string]interface{}); ok {
+			appendMetrics(rows, record, violations, path, nested)
+			continue
+		}
+
+		row := model.MetricRow{
+			TenantID:          record.TenantID,
+			DeviceID:          record.DeviceID,
+			Timestamp:         record.Timestamp,
+			Metric:            strings.Join(path, "."),
+			QualityCode:       record.QualityCode,
+			QualityViolations: violations,
+		}
+		switch v := value.(type) {
+		case nil:
+			continue
+		case bool:
+			row.ValueBool = &v
+		case string:
+			row.ValueText = &v
+		default:
+			if util.IsNumber(v) {
+				f, err := util.ToFloat64(v)
+				if err == nil {
+					row.ValueDouble = &f
+					break
+				}
+			}
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			text := string(encoded)
+			row.ValueText = &text
+		}
+		*rows = append(*rows, row)
+	}
+}
@@ -0,0 +1,346 @@
+package load
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OverflowColumn holds the fields of a record that have no typed column.
+const OverflowColumn = "extra"
+
+// baseColumns are the fixed columns of every wide table.
+var baseColumns = []string{"tenant_id", "device_id", "timestamp", "quality_code", "quality_violations", OverflowColumn}
+
+// identifierPattern limits table and column names to plain lowercase
+// identifiers within the Postgres length limit.
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// WideTableFile is the YAML document loaded from LOAD_WIDE_TABLES_PATH.
+type WideTableFile struct {
+	WideTables []WideTable `yaml:"wide_tables"`
+}
+
+// WideTable maps a tenant and device type to a table with one typed column
+// per field. Only fields matched by Allow (exact names, or prefixes ending
+// in *) become columns, at most MaxColumns of them. BIGINT columns widen to
+// DOUBLE PRECISION automatically; with WidenToText, scalar columns also widen
+// to TEXT when a field changes type. Everything else goes to the overflow
+// JSONB column.
+type WideTable struct {
+	Tenant      string   `yaml:"tenant"`
+	DeviceType  string   `yaml:"device_type"`
+	Table       string   `yaml:"table"`
+	Allow       []string `yaml:"allow"`
+	MaxColumns  int      `yaml:"max_columns"`
+	WidenToText bool     `yaml:"widen_to_text"`
+}
+
+type wideTable struct {
+	WideTable
+	extract.Selector
+}
+
+type wideLoader struct {
+	tables []wideTable
+	repo   repository.Repository
+
+	mu sync.RWMutex
+	// columns caches the column types per tenant and table, since tenants
+	// can be routed to different schemas. The maps are replaced, never
+	// modified, so readers can keep using a snapshot.
+	columns map[string]map[string]string
+}
+
+func newWideLoader(path string, repo repository.Repository) (*wideLoader, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wide table config: %w", err)
+	}
+
+	var file WideTableFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse wide table config: %w", err)
+	}
+
+	w := &wideLoader{repo: repo, columns: make(map[string]map[string]string)}
+	seen := make(extract.Selectors)
+	for i, table := range file.WideTables {
+		t := wideTable{WideTable: table, Selector: extract.NewSelector(table.Tenant, table.DeviceType)}
+		if err := seen.Add(t.Selector); err != nil {
+			return nil, fmt.Errorf("wide_tables[%d]: %w", i, err)
+		}
+
+		if !identifierPattern.MatchString(table.Table) {
+			return nil, fmt.Errorf("wide_tables[%d]: invalid table name %q", i, table.Table)
+		}
+		if table.MaxColumns < 0 {
+			return nil, fmt.Errorf("wide_tables[%d]: max_columns must not be negative", i)
+		}
+		if len(table.Allow) == 0 {
+			return nil, fmt.Errorf("wide_tables[%d]: allow must list at least one field", i)
+		}
+		w.tables = append(w.tables, t)
+	}
+	return w, nil
+}
+
+func (w *wideLoader) match(record *model.RawDeviceData) *wideTable {
+	identity := extract.Identity{TenantId: record.TenantID, DeviceId: record.DeviceID, DeviceType: record.DeviceType}
+	return extract.BestMatch(identity, w.tables)
+}
+
+// load writes the record as one row. Fields that need a new or wider column
+// trigger a schema change first; fields that still do not fit go to the
+// overflow column.
+func (w *wideLoader) load(ctx context.Context, t *wideTable, record *model.RawDeviceData) error {
+	columns, err := w.tableColumns(ctx, record.TenantID, t.Table)
+	if err != nil {
+		return err
+	}
+
+	row := t.plan(columns, record.Data, true)
+	if len(row.changes) > 0 {
+		columns, err = w.evolve(ctx, record.TenantID, t.Table, row.changes)
+		if err != nil {
+			return fmt.Errorf("failed to evolve table %s: %w", t.Table, err)
+		}
+		row = t.plan(columns, record.Data, false)
+	}
+
+	violations := record.QualityViolations
+	if violations == nil {
+		violations = []string{}
+	}
+	var overflow interface{}
+	if len(row.overflow) > 0 {
+		overflow = row.overflow
+	}
+
+	names := append([]string{}, baseColumns...)
+	values := []interface{}{record.TenantID, record.DeviceID, record.Timestamp, record.QualityCode, violations, overflow}
+	fields := make([]string, 0, len(row.values))
+	for field := range row.values {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		names = append(names, field)
+		values = append(values, row.values[field])
+	}
+
+	if err := w.repo.InsertWideRow(ctx, record.TenantID, t.Table, names, values); err != nil {
+		// Another instance may have changed the table; reload it on retry.
+		w.forget(record.TenantID, t.Table)
+		return err
+	}
+	return nil
+}
+
+func (w *wideLoader) tableColumns(ctx context.Context, tenantID, table string) (map[string]string, error) {
+	w.mu.RLock()
+	columns, ok := w.columns[tenantID+"/"+table]
+	w.mu.RUnlock()
+	if ok {
+		return columns, nil
+	}
+
+	columns, err := w.repo.GetTableColumns(ctx, tenantID, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		// The table does not exist yet.
+		return w.evolve(ctx, tenantID, table, nil)
+	}
+	w.store(tenantID, table, columns)
+	return columns, nil
+}
+
+func (w *wideLoader) evolve(ctx context.Context, tenantID, table string, changes []model.ColumnChange) (map[string]string, error) {
+	columns, err := w.repo.EvolveWideTable(ctx, tenantID, table, changes)
+	if err != nil {
+		return nil, err
+	}
+	w.store(tenantID, table, columns)
+	return columns, nil
+}
+
+func (w *wideLoader) store(tenantID, table string, columns map[string]string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.columns[tenantID+"/"+table] = columns
+}
+
+func (w *wideLoader) forget(tenantID, table string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.columns, tenantID+"/"+table)
+}
+
+type wideRow struct {
+	values   map[string]interface{}
+	overflow map[string]interface{}
+	changes  []model.ColumnChange
+}
+
+// plan assigns every field to a typed column or the overflow column. With
+// evolve set, fields that could get a column are collected as changes
+// instead. Fields are visited in name order so the column limit is applied
+// deterministically.
+func (t *wideTable) plan(columns map[string]string, data map[string]interface{}, evolve bool) wideRow {
+	row := wideRow{values: make(map[string]interface{}), overflow: make(map[string]interface{})}
+	typed := len(columns) - len(baseColumns)
+
+	fields := make([]string, 0, len(data))
+	for field := range data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value := data[field]
+		if !t.allowed(field) {
+			row.overflow[field] = value
+			continue
+		}
+
+		have, exists := columns[field]
+		if value == nil {
+			if !exists {
+				row.overflow[field] = value
+			}
+			continue
+		}
+
+		want := columnType(value)
+		switch {
+		case !exists:
+			if evolve && (t.MaxColumns == 0 || typed < t.MaxColumns) {
+				row.changes = append(row.changes, model.ColumnChange{Column: field, Type: want})
+				typed++
+				continue
+			}
+		case t.accepts(have, want):
+			if converted, ok := convert(have, value); ok {
+				row.values[field] = converted
+				continue
+			}
+		default:
+			if widened := t.widen(have, want); widened != "" && evolve {
+				row.changes = append(row.changes, model.ColumnChange{Column: field, Type: widened, From: have})
+				continue
+			}
+		}
+		row.overflow[field] = value
+	}
+	return row
+}
+
+func (t *wideTable) allowed(field string) bool {
+	if !identifierPattern.MatchString(field) {
+		return false
+	}
+	for _, base := range baseColumns {
+		if field == base {
+			return false
+		}
+	}
+	for _, pattern := range t.Allow {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(field, prefix) {
+				return true
+			}
+		} else if field == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether a value of type want can be stored in a column of
+// type have without changing the column.
+func (t *wideTable) accepts(have, want string) bool {
+	switch {
+	case have == want, have == model.ColumnJSONB:
+		return true
+	case have == model.ColumnDouble:
+		return want == model.ColumnBigint
+	case have == model.ColumnText:
+		return t.WidenToText && want != model.ColumnJSONB
+	}
+	return false
+}
+
+// widen returns the type a column of type have must change to so it can
+// hold want, or "" when the change is not allowed.
+func (t *wideTable) widen(have, want string) string {
+	if have == model.ColumnBigint && want == model.ColumnDouble {
+		return model.ColumnDouble
+	}
+	if t.WidenToText && have != model.ColumnJSONB && want != model.ColumnJSONB {
+		return model.ColumnText
+	}
+	return ""
+}
+
+func columnType(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return model.ColumnBoolean
+	case string:
+		return model.ColumnText
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return model.ColumnDouble
+		}
+		if _, err := v.Int64(); err != nil {
+			return model.ColumnDouble
+		}
+		return model.ColumnBigint
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return model.ColumnBigint
+	case float32, float64:
+		return model.ColumnDouble
+	}
+	return model.ColumnJSONB
+}
+
+// convert turns a payload value into what the column type expects.
+func convert(columnType string, value interface{}) (interface{}, bool) {
+	switch columnType {
+	case model.ColumnBigint:
+		v, err := util.ToInt64(value)
+		return v, err == nil
+	case model.ColumnDouble:
+		v, err := util.ToFloat64(value)
+		return v, err == nil
+	case model.ColumnBoolean:
+		v, ok := value.(bool)
+		return v, ok
+	case model.ColumnText:
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+		encoded, err := json.Marshal(value)
+		return string(encoded), err == nil
+	case model.ColumnJSONB:
+		return value, true
+	}
+	return nil, false
+}
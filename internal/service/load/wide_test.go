@@ -0,0 +1,94 @@
+package load
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"reflect"
+	"testing"
+)
+
+// wideRepo keeps one wide table's columns and its last inserted row.
+type wideRepo struct {
+	repository.Repository
+	columns map[string]string
+	changes []model.ColumnChange
+	row     map[string]interface{}
+}
+
+func (r *wideRepo) GetTableColumns(context.Context, string, string) (map[string]string, error) {
+	return r.columns, nil
+}
+
+func (r *wideRepo) EvolveWideTable(_ context.Context, _, _ string, changes []model.ColumnChange) (map[string]string, error) {
+	columns := map[string]string{
+		"tenant_id": model.ColumnText, "device_id": model.ColumnText, "timestamp": "timestamptz",
+		"quality_code": "smallint", "quality_violations": "text[]", OverflowColumn: model.ColumnJSONB,
+	}
+	for column, typ := range r.columns {
+		columns[column] = typ
+	}
+	for _, change := range changes {
+		columns[change.Column] = change.Type
+	}
+	r.columns = columns
+	r.changes = append(r.changes, changes...)
+	return columns, nil
+}
+
+func (r *wideRepo) InsertWideRow(_ context.Context, _, _ string, columns []string, values []interface{}) error {
+	r.row = make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		r.row[column] = values[i]
+	}
+	return nil
+}
+
+func TestWideLoadWidensColumns(t *testing.T) {
+	repo := &wideRepo{}
+	w := &wideLoader{repo: repo, columns: make(map[string]map[string]string)}
+	table := &wideTable{
+		WideTable: WideTable{Table: "meters", Allow: []string{"power", "status"}},
+		Selector:  extract.NewSelector("", ""),
+	}
+
+	load := func(data map[string]interface{}) {
+		t.Helper()
+		if err := w.load(context.Background(), table, &model.RawDeviceData{TenantID: "t", DeviceID: "d", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load(map[string]interface{}{"power": json.Number("5"), "status": "on"})
+	if repo.columns["power"] != model.ColumnBigint || repo.row["power"] != int64(5) {
+		t.Fatalf("got column %s and value %v, want bigint 5", repo.columns["power"], repo.row["power"])
+	}
+
+	// A fractional value widens the bigint column to double precision.
+	load(map[string]interface{}{"power": json.Number("5.5")})
+	if repo.columns["power"] != model.ColumnDouble || repo.row["power"] != 5.5 {
+		t.Fatalf("got column %s and value %v, want double precision 5.5", repo.columns["power"], repo.row["power"])
+	}
+	want := model.ColumnChange{Column: "power", Type: model.ColumnDouble, From: model.ColumnBigint}
+	if last := repo.changes[len(repo.changes)-1]; !reflect.DeepEqual(last, want) {
+		t.Fatalf("last change = %+v, want %+v", last, want)
+	}
+
+	// Without widen_to_text a type change goes to the overflow column.
+	load(map[string]interface{}{"status": true})
+	if repo.columns["status"] != model.ColumnText || repo.row["status"] != nil {
+		t.Fatalf("status column changed to %s or got %v", repo.columns["status"], repo.row["status"])
+	}
+	if extra, _ := repo.row[OverflowColumn].(map[string]interface{}); extra["status"] != true {
+		t.Fatalf("overflow = %v, want status", repo.row[OverflowColumn])
+	}
+
+	// With it, the column widens to text.
+	table.WidenToText = true
+	load(map[string]interface{}{"power": true})
+	if repo.columns["power"] != model.ColumnText || repo.row["power"] != "true" {
+		t.Fatalf("got column %s and value %v, want text true", repo.columns["power"], repo.row["power"])
+	}
+}
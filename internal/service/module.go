@@ -1,9 +1,20 @@
 package service
 
 import (
+	"etl-pipeline/internal/service/counter"
+	"etl-pipeline/internal/service/deadband"
+	"etl-pipeline/internal/service/enrich"
 	"etl-pipeline/internal/service/extract"
 	"etl-pipeline/internal/service/load"
+	"etl-pipeline/internal/service/partition"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/internal/service/quality"
+	"etl-pipeline/internal/service/schema"
+	"etl-pipeline/internal/service/sink"
+	"etl-pipeline/internal/service/spool"
+	"etl-pipeline/internal/service/timescale"
 	"etl-pipeline/internal/service/transform"
+	"etl-pipeline/internal/service/window"
 
 	"go.uber.org/fx"
 )
@@ -11,5 +22,24 @@ import (
 var Module = fx.Options(
 	fx.Provide(extract.NewHonoExtractor),
 	fx.Provide(transform.NewHonoTransformer),
+	fx.Provide(privacy.NewPolicy),
+	fx.Provide(transform.NewRuleEngine),
+	fx.Provide(transform.NewUnitNormalizer),
+	fx.Provide(transform.NewComputer),
+	fx.Provide(transform.NewFlattener),
+	fx.Provide(enrich.NewRepositorySource),
+	fx.Provide(enrich.NewEnricher),
+	fx.Provide(counter.NewConverter),
+	fx.Provide(schema.NewTracker),
+	fx.Provide(quality.NewChecker),
+	fx.Provide(deadband.NewFilter),
 	fx.Provide(load.NewLoad),
+	fx.Provide(spool.NewSpool),
+	fx.Provide(sink.NewBuiltinStores),
+	fx.Provide(sink.NewDispatcher),
+	fx.Provide(window.NewAggregator),
+	fx.Provide(timescale.NewReconciler),
+	fx.Invoke(timescale.RunReconciler),
+	fx.Provide(partition.NewManager),
+	fx.Invoke(partition.RunManager),
 )
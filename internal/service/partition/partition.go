@@ -0,0 +1,356 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	IntervalDaily   = "daily"
+	IntervalMonthly = "monthly"
+
+	// defaultColumn is the range key used when converting a plain table.
+	defaultColumn = "timestamp"
+
+	// lockName serializes partition maintenance across pipeline instances.
+	lockName = "etl_pipeline_partitions"
+)
+
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// ConfigFile is the YAML document loaded from PARTITION_CONFIG_PATH.
+type ConfigFile struct {
+	Partitions []Table `yaml:"partitions"`
+}
+
+// Table configures range partitioning of one table. The table is expected
+// to be partitioned by range on its time column; with Convert, a plain
+// table such as the migrated raw_device_data is converted once, on Column,
+// keeping its rows in the default partition. Every table gets a default
+// partition <table>_default for rows outside the managed ranges. Premake
+// partitions are kept ready ahead of the current one; partitions that end
+// before Retention are detached and dropped. Tenants, when set, gives every
+// range partition one list partition per tenant plus a default one.
+type Table struct {
+	Table     string   `yaml:"table"`
+	Interval  string   `yaml:"interval"`
+	Premake   int      `yaml:"premake"`
+	Retention string   `yaml:"retention"`
+	Tenants   []string `yaml:"tenants"`
+	Convert   bool     `yaml:"convert"`
+	Column    string   `yaml:"column"`
+}
+
+type table struct {
+	name      string
+	interval  string
+	premake   int
+	retention time.Duration
+	tenants   []string
+	convert   bool
+	column    string
+}
+
+// Manager keeps the partitions of the configured tables in step with time.
+type Manager interface {
+	// Maintain creates upcoming partitions and drops expired ones.
+	Maintain(ctx context.Context) error
+	// Start repeats maintenance every PARTITION_CHECK_INTERVAL until Stop.
+	Start()
+	Stop()
+}
+
+type manager struct {
+	tables        []table
+	checkInterval time.Duration
+	databases     repository.Databases
+	logger        logger.Logger
+	now           func() time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type ManagerParams struct {
+	fx.In
+	Config    *config.Config
+	Databases repository.Databases
+	Logger    logger.Logger
+}
+
+func NewManager(params ManagerParams) (Manager, error) {
+	cfg := params.Config.Partition
+	m := &manager{
+		checkInterval: time.Duration(cfg.CheckInterval) * time.Second,
+		databases:     params.Databases,
+		logger:        params.Logger,
+		now:           time.Now,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if cfg.ConfigPath == "" {
+		return m, nil
+	}
+	if cfg.CheckInterval <= 0 {
+		return nil, errors.New("PARTITION_CHECK_INTERVAL must be positive")
+	}
+
+	content, err := os.ReadFile(cfg.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition config: %w", err)
+	}
+
+	var file ConfigFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse partition config: %w", err)
+	}
+
+	for i, t := range file.Partitions {
+		compiled, err := compile(t)
+		if err != nil {
+			return nil, fmt.Errorf("partitions[%d]: %w", i, err)
+		}
+		m.tables = append(m.tables, compiled)
+	}
+	return m, nil
+}
+
+func compile(t Table) (table, error) {
+	c := table{name: t.Table, interval: t.Interval, premake: t.Premake, tenants: t.Tenants, convert: t.Convert, column: t.Column}
+	if !identifierPattern.MatchString(t.Table) {
+		return c, fmt.Errorf("invalid table name %q", t.Table)
+	}
+	if c.column == "" {
+		c.column = defaultColumn
+	}
+	if !identifierPattern.MatchString(c.column) {
+		return c, fmt.Errorf("invalid column name %q", c.column)
+	}
+	if t.Interval != IntervalDaily && t.Interval != IntervalMonthly {
+		return c, fmt.Errorf("invalid interval %q, expected %s or %s", t.Interval, IntervalDaily, IntervalMonthly)
+	}
+	if t.Premake < 0 {
+		return c, errors.New("premake must not be negative")
+	}
+	if t.Retention != "" {
+		retention, err := util.ParseDuration(t.Retention)
+		if err != nil || retention <= 0 {
+			return c, fmt.Errorf("invalid retention %q", t.Retention)
+		}
+		c.retention = retention
+	}
+
+	// The longest generated name is <table>_pYYYYMMDD_<tenant>.
+	for _, tenant := range t.Tenants {
+		if !identifierPattern.MatchString(tenant) || tenant == "default" {
+			return c, fmt.Errorf("tenant %q cannot be used in a partition name", tenant)
+		}
+		if len(c.partitionName(time.Time{}))+1+len(tenant) > 63 {
+			return c, fmt.Errorf("partition name for tenant %q exceeds 63 characters", tenant)
+		}
+	}
+	if len(c.partitionName(time.Time{}))+len("_default") > 63 {
+		return c, fmt.Errorf("partition names for table %q exceed 63 characters", t.Table)
+	}
+	return c, nil
+}
+
+// layout is the time layout of the partition name suffix.
+func (t table) layout() string {
+	if t.interval == IntervalMonthly {
+		return "200601"
+	}
+	return "20060102"
+}
+
+func (t table) defaultName() string {
+	return t.name + "_default"
+}
+
+func (t table) partitionName(start time.Time) string {
+	return t.name + "_p" + start.Format(t.layout())
+}
+
+// bounds returns the partition range containing ts.
+func (t table) bounds(ts time.Time) (time.Time, time.Time) {
+	ts = ts.UTC()
+	if t.interval == IntervalMonthly {
+		start := time.Date(ts.Year(), ts.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// partitionStart parses the range start from a partition name created by
+// this manager. Other partitions are left alone.
+func (t table) partitionStart(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, t.name+"_p")
+	if !ok || len(suffix) != len(t.layout()) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(t.layout(), suffix, time.UTC)
+	return start, err == nil
+}
+
+// Maintain runs on the main database and on every tenant route, as each
+// holds its own copy of the tables.
+func (m *manager) Maintain(ctx context.Context) error {
+	if len(m.tables) == 0 {
+		return nil
+	}
+
+	return m.databases.Each(ctx, func(name string, db *pgxpool.Pool) error {
+		repo := repository.NewPartitions(db)
+		ran, err := repo.TryLocked(ctx, lockName, func() error {
+			var errs []error
+			for _, t := range m.tables {
+				if err := m.maintain(ctx, repo, name, t); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", t.name, err))
+				}
+			}
+			return errors.Join(errs...)
+		})
+		if err == nil && !ran {
+			m.logger.Debug("Partition maintenance is running elsewhere", zap.String("database", name))
+		}
+		return err
+	})
+}
+
+func (m *manager) maintain(ctx context.Context, repo repository.Partitions, database string, t table) error {
+	column, hasDefault, err := repo.RangeKey(ctx, t.name)
+	if err != nil {
+		return err
+	}
+	if column == "" {
+		if !t.convert {
+			return errors.New("table does not exist or is not partitioned by range; set convert to partition it")
+		}
+		if err := repo.ConvertToPartitioned(ctx, t.name, t.column, t.defaultName()); err != nil {
+			return fmt.Errorf("failed to convert to a partitioned table: %w", err)
+		}
+		m.logger.Info("Converted table to a partitioned table",
+			zap.String("database", database),
+			zap.String("table", t.name),
+			zap.String("default_partition", t.defaultName()))
+		column, hasDefault = t.column, true
+	}
+	if !hasDefault {
+		if err := repo.CreateDefaultPartition(ctx, t.name, t.defaultName()); err != nil {
+			return fmt.Errorf("failed to create %s: %w", t.defaultName(), err)
+		}
+	}
+
+	existing, err := repo.ListPartitions(ctx, t.name)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		exists[name] = true
+	}
+
+	now := m.now()
+	start, end := t.bounds(now)
+	for i := 0; i <= t.premake; i++ {
+		name := t.partitionName(start)
+		if !exists[name] {
+			if err := repo.CreateRangePartition(ctx, t.name, name, column, start, end, t.tenants); err != nil {
+				return fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			m.logger.Info("Created partition",
+				zap.String("database", database),
+				zap.String("table", t.name),
+				zap.String("partition", name))
+		}
+		start, end = t.bounds(end)
+	}
+
+	if t.retention == 0 {
+		return nil
+	}
+	cutoff := now.Add(-t.retention)
+	for _, name := range existing {
+		partitionStart, ok := t.partitionStart(name)
+		if !ok {
+			continue
+		}
+		if _, partitionEnd := t.bounds(partitionStart); partitionEnd.After(cutoff) {
+			continue
+		}
+		if err := repo.DropPartition(ctx, t.name, name); err != nil {
+			return fmt.Errorf("failed to drop %s: %w", name, err)
+		}
+		m.logger.Info("Dropped expired partition",
+			zap.String("database", database),
+			zap.String("table", t.name),
+			zap.String("partition", name))
+	}
+	return nil
+}
+
+func (m *manager) Start() {
+	if len(m.tables) == 0 {
+		close(m.done)
+		return
+	}
+	go m.loop()
+}
+
+func (m *manager) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *manager) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			if err := m.Maintain(ctx); err != nil {
+				m.logger.Error("Failed to maintain partitions", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// RunManager creates the current and upcoming partitions before the
+// pipeline starts consuming, then repeats maintenance on a schedule.
+func RunManager(lc fx.Lifecycle, m Manager) {
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			if err := m.Maintain(ctx); err != nil {
+				return err
+			}
+			m.Start()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			m.Stop()
+			return nil
+		},
+	})
+}
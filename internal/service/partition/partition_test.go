@@ -0,0 +1,112 @@
+package partition
+
+import (
+	"context"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePartitions records the partition changes maintain makes.
+type fakePartitions struct {
+	repository.Partitions
+	column     string
+	hasDefault bool
+	partitions []string
+	calls      []string
+}
+
+func (f *fakePartitions) RangeKey(context.Context, string) (string, bool, error) {
+	return f.column, f.hasDefault, nil
+}
+
+func (f *fakePartitions) ConvertToPartitioned(_ context.Context, table, column, defaultName string) error {
+	f.calls = append(f.calls, "convert "+table+" "+column+" "+defaultName)
+	f.column, f.hasDefault = column, true
+	return nil
+}
+
+func (f *fakePartitions) CreateDefaultPartition(_ context.Context, _, name string) error {
+	f.calls = append(f.calls, "default "+name)
+	return nil
+}
+
+func (f *fakePartitions) ListPartitions(context.Context, string) ([]string, error) {
+	return f.partitions, nil
+}
+
+func (f *fakePartitions) CreateRangePartition(_ context.Context, _, name, column string, from, to time.Time, _ []string) error {
+	f.calls = append(f.calls, "create "+name+" "+column+" "+from.Format("0102")+"-"+to.Format("0102"))
+	return nil
+}
+
+func (f *fakePartitions) DropPartition(_ context.Context, _, name string) error {
+	f.calls = append(f.calls, "drop "+name)
+	return nil
+}
+
+func testManager(now time.Time) *manager {
+	return &manager{logger: logger.NewNop(), now: func() time.Time { return now }}
+}
+
+func TestMaintainConvertsPlainTable(t *testing.T) {
+	tbl, err := compile(Table{Table: "raw_device_data", Interval: IntervalDaily, Premake: 1, Convert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakePartitions{}
+	m := testManager(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	if err := m.maintain(context.Background(), repo, "main", tbl); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"convert raw_device_data timestamp raw_device_data_default",
+		"create raw_device_data_p20240310 timestamp 0310-0311",
+		"create raw_device_data_p20240311 timestamp 0311-0312",
+	}
+	if !reflect.DeepEqual(repo.calls, want) {
+		t.Fatalf("calls = %q, want %q", repo.calls, want)
+	}
+}
+
+func TestMaintainRejectsPlainTableWithoutConvert(t *testing.T) {
+	tbl, err := compile(Table{Table: "raw_device_data", Interval: IntervalDaily})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testManager(time.Now()).maintain(context.Background(), &fakePartitions{}, "main", tbl)
+	if err == nil || !strings.Contains(err.Error(), "set convert") {
+		t.Fatalf("got %v, want an error pointing at convert", err)
+	}
+}
+
+func TestMaintainAddsDefaultAndDropsExpired(t *testing.T) {
+	tbl, err := compile(Table{Table: "metrics", Interval: IntervalMonthly, Retention: "60d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakePartitions{
+		column:     "ts",
+		partitions: []string{"metrics_p202312", "metrics_p202401", "metrics_p202403", "metrics_old"},
+	}
+	m := testManager(time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC))
+
+	if err := m.maintain(context.Background(), repo, "main", tbl); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"default metrics_default", "drop metrics_p202312"}
+	if !reflect.DeepEqual(repo.calls, want) {
+		t.Fatalf("calls = %q, want %q", repo.calls, want)
+	}
+}
+
+func TestCompileRejectsBadColumn(t *testing.T) {
+	_, err := compile(Table{Table: "raw_device_data", Interval: IntervalDaily, Convert: true, Column: "ts; drop"})
+	if err == nil {
+		t.Fatal("expected an invalid column error")
+	}
+}
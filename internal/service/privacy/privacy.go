@@ -0,0 +1,210 @@
+package privacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ActionRedact = "redact"
+	ActionDrop   = "drop"
+	ActionHash   = "hash"
+
+	// Redacted replaces the value of a redacted field.
+	Redacted = "[REDACTED]"
+)
+
+// quoted matches the double-quoted text errors use to echo values, such as
+// strconv's `parsing "John Doe"` or Postgres' invalid input messages.
+var quoted = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// RedactError returns the message of err with every quoted value replaced,
+// for DLQ headers and logs the policy cannot see into.
+func RedactError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return quoted.ReplaceAllLiteralString(err.Error(), `"`+Redacted+`"`)
+}
+
+// PolicyFile is the YAML document loaded from PRIVACY_POLICY_PATH.
+type PolicyFile struct {
+	Privacy []RuleSet `yaml:"privacy"`
+}
+
+// RuleSet lists the sensitive fields of one tenant and device type. Paths
+// are dotted paths into the payload as the device sent it.
+type RuleSet struct {
+	Tenant     string  `yaml:"tenant"`
+	DeviceType string  `yaml:"device_type"`
+	Fields     []Field `yaml:"fields"`
+}
+
+type Field struct {
+	Path   string `yaml:"path"`
+	Action string `yaml:"action"`
+}
+
+// Policy removes or pseudonymizes sensitive fields. The processor applies it
+// before anything is logged or loaded, and the DLQ writer applies it to the
+// raw message, so all three see the same data.
+type Policy interface {
+	// Apply enforces the policy on a device payload in place.
+	Apply(identity extract.Identity, data map[string]interface{}) map[string]interface{}
+	// ApplyMessage enforces the policy on a raw Hono message. It returns
+	// false when the message cannot be decoded and had to be withheld.
+	ApplyMessage(raw []byte) ([]byte, bool)
+}
+
+type compiledRuleSet struct {
+	extract.Selector
+	fields []Field
+}
+
+type policy struct {
+	sets []compiledRuleSet
+	key  []byte
+}
+
+func NewPolicy(config *config.Config) (Policy, error) {
+	cfg := config.Privacy
+	if cfg.PolicyPath == "" {
+		return &policy{}, nil
+	}
+
+	content, err := os.ReadFile(cfg.PolicyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read privacy policy: %w", err)
+	}
+
+	var file PolicyFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse privacy policy: %w", err)
+	}
+
+	p := &policy{key: []byte(cfg.HMACKey)}
+	seen := make(extract.Selectors)
+	for i, set := range file.Privacy {
+		compiled := compiledRuleSet{Selector: extract.NewSelector(set.Tenant, set.DeviceType)}
+		if err := seen.Add(compiled.Selector); err != nil {
+			return nil, fmt.Errorf("privacy[%d]: %w", i, err)
+		}
+
+		for j, field := range set.Fields {
+			if field.Path == "" {
+				return nil, fmt.Errorf("privacy[%d].fields[%d]: missing path", i, j)
+			}
+			switch field.Action {
+			case ActionRedact, ActionDrop:
+			case ActionHash:
+				if len(p.key) == 0 {
+					return nil, fmt.Errorf("privacy[%d].fields[%d]: hash requires PRIVACY_HMAC_KEY", i, j)
+				}
+			default:
+				return nil, fmt.Errorf("privacy[%d].fields[%d]: unknown action %q", i, j, field.Action)
+			}
+			compiled.fields = append(compiled.fields, field)
+		}
+		p.sets = append(p.sets, compiled)
+	}
+	return p, nil
+}
+
+func (p *policy) Apply(identity extract.Identity, data map[string]interface{}) map[string]interface{} {
+	set := p.match(identity)
+	if set == nil {
+		return data
+	}
+
+	for _, field := range set.fields {
+		value, ok := util.GetPath(data, field.Path)
+		if !ok {
+			continue
+		}
+		switch field.Action {
+		case ActionDrop:
+			util.DeletePath(data, field.Path)
+		case ActionRedact:
+			util.SetPath(data, field.Path, Redacted)
+		case ActionHash:
+			if value != nil {
+				util.SetPath(data, field.Path, p.hash(value))
+			}
+		}
+	}
+	return data
+}
+
+// ApplyMessage decodes the message envelope, applies the policy to its
+// value and encodes it again. Without a tenant the policy cannot be chosen,
+// so an undecodable message is withheld entirely while a policy is active.
+func (p *policy) ApplyMessage(raw []byte) ([]byte, bool) {
+	if len(p.sets) == 0 {
+		return raw, true
+	}
+
+	envelope, identity, err := decodeMessage(raw)
+	if err != nil {
+		return nil, false
+	}
+	if data, ok := envelope["value"].(map[string]interface{}); ok {
+		envelope["value"] = p.Apply(identity, data)
+	}
+
+	encoded, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, false
+	}
+	return encoded, true
+}
+
+func decodeMessage(raw []byte) (map[string]interface{}, extract.Identity, error) {
+	var identity extract.Identity
+	var envelope map[string]interface{}
+	if err := util.UnmarshalJSON(raw, &envelope); err != nil {
+		return nil, identity, err
+	}
+
+	headers, _ := envelope["headers"].(map[string]interface{})
+	tenantID, ok := headers["tenant_id"].(string)
+	if !ok {
+		return nil, identity, errors.New("message has no tenant_id header")
+	}
+	identity.TenantId = tenantID
+	identity.DeviceId, _ = headers["device_id"].(string)
+	identity.DeviceType, _ = headers["device_type"].(string)
+	return envelope, identity, nil
+}
+
+// hash returns the hex HMAC-SHA256 of the value, so equal values stay
+// joinable without being recoverable.
+func (p *policy) hash(value interface{}) string {
+	var content []byte
+	switch v := value.(type) {
+	case string:
+		content = []byte(v)
+	case json.Number:
+		content = []byte(v.String())
+	default:
+		content, _ = json.Marshal(v)
+	}
+
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *policy) match(identity extract.Identity) *compiledRuleSet {
+	return extract.BestMatch(identity, p.sets)
+}
@@ -0,0 +1,25 @@
+package privacy
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestRedactError(t *testing.T) {
+	_, parseErr := strconv.ParseFloat("John Doe", 64)
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("cast owner: %w", parseErr), `cast owner: strconv.ParseFloat: parsing "[REDACTED]": invalid syntax`},
+		{fmt.Errorf(`invalid input syntax for type double precision: "a \"quoted\" value"`), `invalid input syntax for type double precision: "[REDACTED]"`},
+		{fmt.Errorf("connection reset"), "connection reset"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := RedactError(tt.err); got != tt.want {
+			t.Errorf("RedactError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package quality
+
+import (
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/cache"
+	"etl-pipeline/pkg/metrics"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RuleRange        = "range"
+	RuleRateOfChange = "rate_of_change"
+	RuleRequired     = "required"
+
+	SeverityUncertain = "uncertain"
+	SeverityBad       = "bad"
+)
+
+// Previous readings for rate-of-change rules are kept for at most
+// maxRateReadings fields, and a reading older than rateWindow is not rated
+// against.
+const (
+	maxRateReadings = 100000
+	rateWindow      = time.Hour
+)
+
+// RuleFile is the YAML document loaded from QUALITY_RULES_PATH.
+type RuleFile struct {
+	QualityRules []RuleSet `yaml:"quality_rules"`
+}
+
+type RuleSet struct {
+	Tenant     string `yaml:"tenant"`
+	DeviceType string `yaml:"device_type"`
+	Rules      []Rule `yaml:"rules"`
+}
+
+// Rule is a single data quality check. Min and Max bound range rules,
+// MaxPerSecond bounds the absolute rate of change, Fields lists the fields a
+// required rule expects.
+type Rule struct {
+	Name         string   `yaml:"name"`
+	Type         string   `yaml:"type"`
+	Field        string   `yaml:"field"`
+	Fields       []string `yaml:"fields"`
+	Min          *float64 `yaml:"min"`
+	Max          *float64 `yaml:"max"`
+	MaxPerSecond float64  `yaml:"max_per_second"`
+	Severity     string   `yaml:"severity"`
+}
+
+// Result is the quality verdict attached to a stored record. Violations never
+// drop the record.
+type Result struct {
+	Code       int
+	Violations []string
+}
+
+type Checker interface {
+	// Check evaluates the rules. The returned commit function records the
+	// readings for rate-of-change rules and counts the violations; it must
+	// only be called once the record has been loaded.
+	Check(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (Result, func())
+}
+
+type compiledRule struct {
+	Rule
+	code int
+}
+
+type compiledRuleSet struct {
+	extract.Selector
+	rules []compiledRule
+}
+
+type reading struct {
+	value     float64
+	timestamp time.Time
+}
+
+type checker struct {
+	sets []compiledRuleSet
+
+	// last holds the previous reading per tenant, device and field for
+	// rate-of-change rules.
+	last *cache.LRU[string, reading]
+}
+
+func newChecker() *checker {
+	return &checker{last: cache.NewLRU[string, reading](maxRateReadings)}
+}
+
+func NewChecker(config *config.Config) (Checker, error) {
+	if config.Quality.RulesPath == "" {
+		return newChecker(), nil
+	}
+
+	content, err := os.ReadFile(config.Quality.RulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quality rules: %w", err)
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse quality rules: %w", err)
+	}
+	return CompileRules(&file)
+}
+
+// CompileRules validates the rule sets and returns a checker for them.
+func CompileRules(file *RuleFile) (Checker, error) {
+	c := newChecker()
+	seen := make(extract.Selectors)
+
+	for i, set := range file.QualityRules {
+		compiled := compiledRuleSet{Selector: extract.NewSelector(set.Tenant, set.DeviceType)}
+		if err := seen.Add(compiled.Selector); err != nil {
+			return nil, fmt.Errorf("quality_rules[%d]: %w", i, err)
+		}
+
+		names := make(map[string]bool)
+		for j, rule := range set.Rules {
+			code, err := validateRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("quality_rules[%d].rules[%d]: %w", i, j, err)
+			}
+			if names[rule.Name] {
+				return nil, fmt.Errorf("quality_rules[%d].rules[%d]: duplicate rule name %q", i, j, rule.Name)
+			}
+			names[rule.Name] = true
+			compiled.rules = append(compiled.rules, compiledRule{Rule: rule, code: code})
+		}
+		c.sets = append(c.sets, compiled)
+	}
+
+	return c, nil
+}
+
+func validateRule(rule Rule) (int, error) {
+	if rule.Name == "" {
+		return 0, errors.New("missing name")
+	}
+
+	switch rule.Type {
+	case RuleRange:
+		if rule.Field == "" {
+			return 0, errors.New("range rule requires field")
+		}
+		if rule.Min == nil && rule.Max == nil {
+			return 0, errors.New("range rule requires min or max")
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return 0, errors.New("range rule min is greater than max")
+		}
+	case RuleRateOfChange:
+		if rule.Field == "" {
+			return 0, errors.New("rate_of_change rule requires field")
+		}
+		if rule.MaxPerSecond <= 0 {
+			return 0, errors.New("rate_of_change rule requires a positive max_per_second")
+		}
+	case RuleRequired:
+		if len(rule.Fields) == 0 && rule.Field == "" {
+			return 0, errors.New("required rule requires field or fields")
+		}
+	default:
+		return 0, fmt.Errorf("unknown rule type %q", rule.Type)
+	}
+
+	switch rule.Severity {
+	case "", SeverityUncertain:
+		return model.QualityUncertain, nil
+	case SeverityBad:
+		return model.QualityBad, nil
+	}
+	return 0, fmt.Errorf("unknown severity %q", rule.Severity)
+}
+
+// Check evaluates the most specific matching rule set. The quality code is
+// the worst severity among the violated rules.
+func (c *checker) Check(identity extract.Identity, timestamp time.Time, data map[string]interface{}) (Result, func()) {
+	result := Result{Code: model.QualityGood}
+
+	set := c.match(identity)
+	if set == nil {
+		return result, func() {}
+	}
+
+	readings := make(map[string]reading)
+	for _, rule := range set.rules {
+		if c.violates(identity, timestamp, rule, data, readings) {
+			result.Violations = append(result.Violations, rule.Name)
+			if rule.code > result.Code {
+				result.Code = rule.code
+			}
+		}
+	}
+
+	return result, func() {
+		for key, r := range readings {
+			if prev, ok := c.last.Get(key); !ok || r.timestamp.After(prev.timestamp) {
+				c.last.Set(key, r, rateWindow)
+			}
+		}
+		for _, name := range result.Violations {
+			metrics.QualityViolationsTotal.WithLabelValues(metrics.Tenant(identity.TenantId), name).Inc()
+		}
+	}
+}
+
+// violates checks one rule. Readings rate-of-change rules should remember are
+// added to readings.
+func (c *checker) violates(identity extract.Identity, timestamp time.Time, rule compiledRule, data map[string]interface{}, readings map[string]reading) bool {
+	switch rule.Type {
+	case RuleRequired:
+		fields := rule.Fields
+		if rule.Field != "" {
+			fields = append([]string{rule.Field}, fields...)
+		}
+		for _, field := range fields {
+			if value, ok := util.GetPath(data, field); !ok || value == nil {
+				return true
+			}
+		}
+		return false
+	case RuleRange:
+		value, ok, valid := numericField(data, rule.Field)
+		if !ok {
+			return false
+		}
+		if !valid {
+			return true
+		}
+		return (rule.Min != nil && value < *rule.Min) || (rule.Max != nil && value > *rule.Max)
+	case RuleRateOfChange:
+		value, ok, valid := numericField(data, rule.Field)
+		if !ok || !valid {
+			return false
+		}
+		key := identity.TenantId + "/" + identity.DeviceId + "/" + rule.Field
+		return c.rateExceeded(key, timestamp, rule, value, readings)
+	}
+	return false
+}
+
+// rateExceeded compares against the previous reading of the same device and
+// field. Out-of-order and duplicate readings are not rated and do not
+// replace the newer reading.
+func (c *checker) rateExceeded(key string, timestamp time.Time, rule compiledRule, value float64, readings map[string]reading) bool {
+	prev, ok := c.last.Get(key)
+	if ok && !timestamp.After(prev.timestamp) {
+		return false
+	}
+	readings[key] = reading{value: value, timestamp: timestamp}
+	if !ok {
+		return false
+	}
+
+	elapsed := timestamp.Sub(prev.timestamp).Seconds()
+	return math.Abs(value-prev.value)/elapsed > rule.MaxPerSecond
+}
+
+func (c *checker) match(identity extract.Identity) *compiledRuleSet {
+	return extract.BestMatch(identity, c.sets)
+}
+
+// numericField reports whether the field is present and, if so, whether it
+// holds a finite number.
+func numericField(data map[string]interface{}, field string) (float64, bool, bool) {
+	value, ok := util.GetPath(data, field)
+	if !ok || value == nil {
+		return 0, false, false
+	}
+	f, err := util.ToFloat64(value)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, true, false
+	}
+	return f, true, true
+}
@@ -0,0 +1,73 @@
+package quality
+
+import (
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/extract"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	limit := 100.0
+	c, err := CompileRules(&RuleFile{QualityRules: []RuleSet{{
+		Rules: []Rule{
+			{Name: "temp_range", Type: RuleRange, Field: "env.temp", Max: &limit},
+			{Name: "power_rate", Type: RuleRateOfChange, Field: "power", MaxPerSecond: 10, Severity: SeverityBad},
+			{Name: "has_power", Type: RuleRequired, Fields: []string{"power"}},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := extract.Identity{TenantId: "t", DeviceId: "d"}
+	start := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	readings := []struct {
+		after      time.Duration
+		data       map[string]interface{}
+		commit     bool
+		code       int
+		violations []string
+	}{
+		{0, map[string]interface{}{"power": json.Number("0"), "env": map[string]interface{}{"temp": json.Number("20")}}, true, model.QualityGood, nil},
+		{time.Second, map[string]interface{}{"env": map[string]interface{}{"temp": json.Number("120")}}, true, model.QualityUncertain, []string{"temp_range", "has_power"}},
+		// The jump is rated against the last committed reading, also when
+		// the same message is checked again after a failed load.
+		{2 * time.Second, map[string]interface{}{"power": json.Number("50")}, false, model.QualityBad, []string{"power_rate"}},
+		{2 * time.Second, map[string]interface{}{"power": json.Number("50")}, true, model.QualityBad, []string{"power_rate"}},
+		{3 * time.Second, map[string]interface{}{"power": json.Number("55")}, true, model.QualityGood, nil},
+		// Out-of-order readings are not rated.
+		{time.Second, map[string]interface{}{"power": json.Number("0")}, true, model.QualityGood, nil},
+	}
+	for i, r := range readings {
+		result, commit := c.Check(device, start.Add(r.after), r.data)
+		if r.commit {
+			commit()
+		}
+		if result.Code != r.code || !reflect.DeepEqual(result.Violations, r.violations) {
+			t.Fatalf("reading %d: got %+v, want code %d and %q", i, result, r.code, r.violations)
+		}
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"missing name", Rule{Type: RuleRequired, Field: "a"}},
+		{"range without bounds", Rule{Name: "r", Type: RuleRange, Field: "a"}},
+		{"rate without limit", Rule{Name: "r", Type: RuleRateOfChange, Field: "a"}},
+		{"unknown type", Rule{Name: "r", Type: "nope", Field: "a"}},
+		{"unknown severity", Rule{Name: "r", Type: RuleRequired, Field: "a", Severity: "fatal"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileRules(&RuleFile{QualityRules: []RuleSet{{Rules: []Rule{tt.rule}}}}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	TypeNumber  = "number"
+	TypeString  = "string"
+	TypeBoolean = "boolean"
+	TypeObject  = "object"
+	TypeArray   = "array"
+)
+
+// A schema that cannot be loaded is retried after a backoff that doubles up
+// to maxLoadBackoff, so a missing table does not cost a query per message.
+const (
+	minLoadBackoff = time.Second
+	maxLoadBackoff = 5 * time.Minute
+)
+
+// Tracker maintains the inferred schema of every tenant and device type and
+// reports drift when a field is added, disappears or changes type.
+type Tracker interface {
+	Observe(identity extract.Identity, data map[string]interface{}) ([]model.SchemaDriftEvent, error)
+}
+
+type entry struct {
+	mu     sync.Mutex
+	loaded bool
+	schema *model.DeviceSchema
+	// loadedAt bounds how long a field counts as unseen, since LastSeen is
+	// only stored when the schema changes.
+	loadedAt time.Time
+	// retryAt and backoff delay loading again after a failure.
+	retryAt time.Time
+	backoff time.Duration
+}
+
+type tracker struct {
+	enabled      bool
+	topic        string
+	removalAfter time.Duration
+	repo         repository.Repository
+	publisher    event.Publisher
+	logger       logger.Logger
+	ctx          context.Context
+	cancel       context.CancelFunc
+
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type TrackerParams struct {
+	fx.In
+	Config    *config.Config
+	Repo      repository.Repository
+	Publisher event.Publisher
+	Logger    logger.Logger
+}
+
+func NewTracker(params TrackerParams) (Tracker, error) {
+	cfg := params.Config.Schema
+	var removalAfter time.Duration
+	if cfg.RemovalAfter != "" {
+		var err error
+		if removalAfter, err = util.ParseDuration(cfg.RemovalAfter); err != nil || removalAfter <= 0 {
+			return nil, fmt.Errorf("invalid SCHEMA_REMOVAL_AFTER %q", cfg.RemovalAfter)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tracker{
+		enabled:      cfg.DriftEnabled,
+		topic:        cfg.DriftTopic,
+		removalAfter: removalAfter,
+		repo:         params.Repo,
+		publisher:    params.Publisher,
+		logger:       params.Logger,
+		ctx:          ctx,
+		cancel:       cancel,
+		entries:      make(map[string]*entry),
+	}, nil
+}
+
+// Observe merges the fields of data into the schema for the identity. The
+// first message of a tenant and device type only establishes a baseline.
+// Drift is emitted once the changed schema is stored, so a failed write
+// reports it again with the next message instead of losing it.
+func (t *tracker) Observe(identity extract.Identity, data map[string]interface{}) ([]model.SchemaDriftEvent, error) {
+	if !t.enabled {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Second)
+	defer cancel()
+
+	events, err := t.observe(ctx, identity, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range events {
+		t.emit(ctx, ev)
+	}
+	return events, nil
+}
+
+// observe updates and stores the schema under the entry lock, so writes of
+// one tenant and device type cannot overtake each other. The cached schema
+// only changes once the write succeeded.
+func (t *tracker) observe(ctx context.Context, identity extract.Identity, data map[string]interface{}) ([]model.SchemaDriftEvent, error) {
+	e := t.entry(identity)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now().UTC()
+	current, loadedAt := e.schema, e.loadedAt
+	baseline := false
+	if !e.loaded {
+		if now.Before(e.retryAt) {
+			return nil, nil
+		}
+		stored, err := t.repo.GetDeviceSchema(ctx, identity.TenantId, identity.DeviceType)
+		if err != nil {
+			e.backoff = min(max(2*e.backoff, minLoadBackoff), maxLoadBackoff)
+			e.retryAt = now.Add(e.backoff)
+			return nil, fmt.Errorf("failed to load schema, retrying in %s: %w", e.backoff, err)
+		}
+		if stored == nil {
+			stored = &model.DeviceSchema{
+				TenantID:   identity.TenantId,
+				DeviceType: identity.DeviceType,
+				Fields:     make(map[string]model.FieldSchema),
+			}
+			baseline = true
+		}
+		current, loadedAt = stored, now
+	}
+
+	next := *current
+	next.Fields = make(map[string]model.FieldSchema, len(current.Fields))
+	for path, field := range current.Fields {
+		next.Fields[path] = field
+	}
+
+	observed := make(map[string]string)
+	collectTypes(observed, "", data)
+
+	var events []model.SchemaDriftEvent
+	changed := baseline
+
+	paths := make([]string, 0, len(observed))
+	for path := range observed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		typ := observed[path]
+
+		field, known := next.Fields[path]
+		if !known {
+			next.Fields[path] = model.FieldSchema{Types: []string{typ}, FirstSeen: now, LastSeen: now}
+			changed = true
+			if !baseline {
+				events = append(events, t.newEvent(model.DriftFieldAdded, identity, path, nil, typ, now))
+			}
+			continue
+		}
+
+		field.LastSeen = now
+		if !containsType(field.Types, typ) {
+			events = append(events, t.newEvent(model.DriftFieldTypeChanged, identity, path, field.Types, typ, now))
+			field.Types = append(append([]string(nil), field.Types...), typ)
+			changed = true
+		}
+		next.Fields[path] = field
+	}
+
+	// Devices often send a subset of their fields, so a field only counts as
+	// removed once none of the devices has sent it for removalAfter.
+	for path, field := range next.Fields {
+		if _, ok := observed[path]; ok || t.removalAfter == 0 {
+			continue
+		}
+		lastSeen := field.LastSeen
+		if lastSeen.Before(loadedAt) {
+			lastSeen = loadedAt
+		}
+		if now.Sub(lastSeen) >= t.removalAfter {
+			events = append(events, t.newEvent(model.DriftFieldRemoved, identity, path, field.Types, "", now))
+			delete(next.Fields, path)
+			changed = true
+		}
+	}
+
+	if changed {
+		next.UpdatedAt = now
+		if err := t.repo.UpsertDeviceSchema(ctx, &next); err != nil {
+			return nil, err
+		}
+	}
+	e.schema, e.loaded, e.loadedAt = &next, true, loadedAt
+
+	if baseline {
+		t.logger.Info("Inferred new device schema",
+			zap.String("tenantID", identity.TenantId),
+			zap.String("deviceType", identity.DeviceType),
+			zap.Int("fields", len(next.Fields)))
+	}
+	return events, nil
+}
+
+func (t *tracker) entry(identity extract.Identity) *entry {
+	key := identity.TenantId + "/" + identity.DeviceType
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	return e
+}
+
+func (t *tracker) newEvent(kind string, identity extract.Identity, field string, oldTypes []string, newType string, now time.Time) model.SchemaDriftEvent {
+	return model.SchemaDriftEvent{
+		Kind:       kind,
+		TenantID:   identity.TenantId,
+		DeviceType: identity.DeviceType,
+		DeviceID:   identity.DeviceId,
+		Field:      field,
+		OldTypes:   oldTypes,
+		NewType:    newType,
+		DetectedAt: now,
+	}
+}
+
+// emit reports a drift event through the log, the drift counter and, when a
+// topic is configured, Kafka.
+func (t *tracker) emit(ctx context.Context, ev model.SchemaDriftEvent) {
+	t.logger.Warn("Schema drift detected",
+		zap.String("kind", ev.Kind),
+		zap.String("tenantID", ev.TenantID),
+		zap.String("deviceType", ev.DeviceType),
+		zap.String("deviceID", ev.DeviceID),
+		zap.String("field", ev.Field),
+		zap.Strings("oldTypes", ev.OldTypes),
+		zap.String("newType", ev.NewType))
+
+	metrics.SchemaDriftTotal.WithLabelValues(metrics.Tenant(ev.TenantID), metrics.DeviceType(ev.DeviceType), ev.Kind).Inc()
+
+	if t.topic == "" {
+		return
+	}
+
+	value, err := json.Marshal(ev)
+	if err != nil {
+		t.logger.Error("Failed to marshal schema drift event", zap.Error(err))
+		return
+	}
+
+	msg := kafka.Message{
+		Key:   []byte(ev.TenantID + "/" + ev.DeviceType),
+		Value: value,
+		Time:  ev.DetectedAt,
+	}
+	if err := t.publisher.WriteMessages(ctx, t.topic, msg); err != nil {
+		t.logger.Error("Failed to publish schema drift event",
+			zap.String("topic", t.topic),
+			zap.Error(err))
+	}
+}
+
+// collectTypes records the JSON type of every field, using dotted paths for
+// nested objects. Nulls carry no type information and are skipped.
+func collectTypes(result map[string]string, prefix string, data map[string]interface{}) {
+	for k, v := range data {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+
+		switch value := v.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			result[path] = TypeObject
+			collectTypes(result, path, value)
+		case []interface{}:
+			result[path] = TypeArray
+		case string:
+			result[path] = TypeString
+		case bool:
+			result[path] = TypeBoolean
+		default:
+			result[path] = TypeNumber
+		}
+	}
+}
+
+func containsType(types []string, typ string) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
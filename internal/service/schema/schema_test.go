@@ -0,0 +1,60 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/logger"
+	"testing"
+)
+
+// schemaRepo stores one schema and fails upserts while fail is set.
+type schemaRepo struct {
+	repository.Repository
+	stored *model.DeviceSchema
+	fail   bool
+}
+
+func (r *schemaRepo) GetDeviceSchema(context.Context, string, string) (*model.DeviceSchema, error) {
+	return r.stored, nil
+}
+
+func (r *schemaRepo) UpsertDeviceSchema(_ context.Context, schema *model.DeviceSchema) error {
+	if r.fail {
+		return errors.New("database unavailable")
+	}
+	r.stored = schema
+	return nil
+}
+
+func TestObserveReportsDriftOnceStored(t *testing.T) {
+	repo := &schemaRepo{}
+	tr := &tracker{enabled: true, repo: repo, logger: logger.NewNop(), ctx: context.Background(), entries: map[string]*entry{}}
+	identity := extract.Identity{TenantId: "t", DeviceId: "d", DeviceType: "meter"}
+
+	if events, err := tr.Observe(identity, map[string]interface{}{"a": 1.0}); err != nil || len(events) != 0 {
+		t.Fatalf("baseline: got %v, %v", events, err)
+	}
+
+	repo.fail = true
+	if events, err := tr.Observe(identity, map[string]interface{}{"a": 1.0, "b": "x"}); err == nil || len(events) != 0 {
+		t.Fatalf("failed write: got %v, %v, want an error and no drift", events, err)
+	}
+	if _, ok := repo.stored.Fields["b"]; ok {
+		t.Fatal("field stored although the write failed")
+	}
+
+	repo.fail = false
+	events, err := tr.Observe(identity, map[string]interface{}{"a": 1.0, "b": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Kind != model.DriftFieldAdded || events[0].Field != "b" {
+		t.Fatalf("got %+v, want b added", events)
+	}
+	if _, ok := repo.stored.Fields["b"]; !ok {
+		t.Fatal("added field was not stored")
+	}
+}
@@ -0,0 +1,486 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"go.uber.org/zap"
+)
+
+// Archive file formats.
+const (
+	FormatParquet    = "parquet"
+	FormatNDJSONGzip = "ndjson.gz"
+)
+
+const (
+	stagingSuffix       = ".staging"
+	defaultRollBytes    = 128 << 20
+	defaultRollInterval = 15 * time.Minute
+	publishTimeout      = 5 * time.Minute
+)
+
+// archiveRow is the Parquet layout of a record. Data keeps the payload as
+// JSON since its fields differ between device types.
+type archiveRow struct {
+	TenantID          string    `parquet:"tenant_id"`
+	DeviceID          string    `parquet:"device_id"`
+	DeviceType        string    `parquet:"device_type,optional"`
+	Timestamp         time.Time `parquet:"timestamp,timestamp(millisecond)"`
+	QualityCode       int32     `parquet:"quality_code"`
+	QualityViolations []string  `parquet:"quality_violations,list"`
+	Data              string    `parquet:"data,json"`
+}
+
+// stagedRecord reads a staged line without decoding the payload.
+type stagedRecord struct {
+	TenantID          string          `json:"tenant_id"`
+	DeviceID          string          `json:"device_id"`
+	DeviceType        string          `json:"device_type"`
+	Timestamp         time.Time       `json:"timestamp"`
+	Data              json.RawMessage `json:"data"`
+	QualityCode       int32           `json:"quality_code"`
+	QualityViolations []string        `json:"quality_violations"`
+}
+
+type stagedFile struct {
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// archiveSink writes records into tenant=/date=/hour= partitions for a data
+// lake. Records are appended to local NDJSON staging files, which Flush
+// syncs to disk so offsets can be committed safely. Staging files roll by
+// size or age and are then converted to the archive format and published
+// to the store. Staging files left over from a previous run are published
+// on start.
+type archiveSink struct {
+	name         string
+	format       string
+	staging      string
+	store        Store
+	rollBytes    int64
+	rollInterval time.Duration
+	host         string
+	logger       logger.Logger
+
+	mu      sync.Mutex
+	open    map[string]*stagedFile
+	pending []string
+	seq     uint64
+
+	// publishMu serializes publishing between the loop and Close.
+	publishMu sync.Mutex
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newArchiveSink(spec Spec, factories []StoreFactory, log logger.Logger) (*archiveSink, error) {
+	if spec.Format != FormatParquet && spec.Format != FormatNDJSONGzip {
+		return nil, fmt.Errorf("unknown archive format %q, expected %s or %s", spec.Format, FormatParquet, FormatNDJSONGzip)
+	}
+	if spec.Staging == "" {
+		return nil, errors.New("staging is required")
+	}
+	if spec.Location == "" {
+		return nil, errors.New("location is required")
+	}
+	if spec.RollBytes < 0 {
+		return nil, errors.New("roll_bytes must not be negative")
+	}
+
+	a := &archiveSink{
+		name:         spec.Name,
+		format:       spec.Format,
+		staging:      spec.Staging,
+		rollBytes:    defaultRollBytes,
+		rollInterval: defaultRollInterval,
+		logger:       log,
+		open:         make(map[string]*stagedFile),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if spec.RollBytes > 0 {
+		a.rollBytes = spec.RollBytes
+	}
+	if spec.RollInterval != "" {
+		interval, err := util.ParseDuration(spec.RollInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid roll_interval %q", spec.RollInterval)
+		}
+		a.rollInterval = interval
+	}
+
+	var err error
+	if a.store, err = openStore(spec.Location, factories); err != nil {
+		return nil, err
+	}
+	if a.host, err = os.Hostname(); err != nil || a.host == "" {
+		a.host = "etl"
+	}
+	a.host = url.PathEscape(a.host)
+
+	if err := os.MkdirAll(a.staging, 0o755); err != nil {
+		return nil, err
+	}
+	// Whatever is staged belongs to a previous run and is complete now.
+	err = filepath.WalkDir(a.staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, stagingSuffix):
+			a.pending = append(a.pending, path)
+		case strings.HasSuffix(path, ".tmp"):
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan staging directory: %w", err)
+	}
+	return a, nil
+}
+
+func (a *archiveSink) Name() string {
+	return a.name
+}
+
+func (a *archiveSink) Write(_ context.Context, record *model.RawDeviceData) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	ts := record.Timestamp.UTC()
+	partition := fmt.Sprintf("tenant=%s/date=%s/hour=%02d", url.PathEscape(record.TenantID), ts.Format("2006-01-02"), ts.Hour())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, ok := a.open[partition]
+	if !ok {
+		if f, err = a.create(partition); err != nil {
+			return err
+		}
+		a.open[partition] = f
+	}
+
+	n, err := f.buf.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if f.size >= a.rollBytes {
+		return a.roll(partition)
+	}
+	return nil
+}
+
+func (a *archiveSink) create(partition string) (*stagedFile, error) {
+	dir := filepath.Join(a.staging, filepath.FromSlash(partition))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	a.seq++
+	name := fmt.Sprintf("part-%s-%d-%d%s", a.host, time.Now().UnixNano(), a.seq, stagingSuffix)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{file: file, buf: bufio.NewWriter(file), opened: time.Now()}, nil
+}
+
+// roll closes the staging file of a partition and queues it for
+// publishing. The caller must hold mu.
+func (a *archiveSink) roll(partition string) error {
+	f := a.open[partition]
+	delete(a.open, partition)
+
+	err := errors.Join(f.buf.Flush(), f.file.Sync(), f.file.Close())
+	a.pending = append(a.pending, f.file.Name())
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// Flush syncs every open staging file, so all records written so far
+// survive a crash.
+func (a *archiveSink) Flush(context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var errs []error
+	for _, f := range a.open {
+		if err := f.buf.Flush(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, f.file.Sync())
+	}
+	return errors.Join(errs...)
+}
+
+func (a *archiveSink) Start() {
+	go a.loop()
+}
+
+// Close publishes everything staged. Files that cannot be published stay
+// staged for the next start.
+func (a *archiveSink) Close() error {
+	close(a.stop)
+	<-a.done
+
+	a.mu.Lock()
+	var errs []error
+	for partition := range a.open {
+		errs = append(errs, a.roll(partition))
+	}
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	errs = append(errs, a.publish(ctx))
+	return errors.Join(errs...)
+}
+
+func (a *archiveSink) loop() {
+	defer close(a.done)
+
+	tick := min(max(a.rollInterval/10, time.Second), time.Minute)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	// Publish what a previous run left behind.
+	a.publishLogged()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.rollExpired()
+			a.publishLogged()
+		case <-a.wake:
+			a.publishLogged()
+		}
+	}
+}
+
+func (a *archiveSink) rollExpired() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for partition, f := range a.open {
+		if time.Since(f.opened) < a.rollInterval {
+			continue
+		}
+		if err := a.roll(partition); err != nil {
+			a.logger.Error("Failed to close staging file", zap.String("sink", a.name), zap.Error(err))
+		}
+	}
+}
+
+func (a *archiveSink) publishLogged() {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	if err := a.publish(ctx); err != nil {
+		a.logger.Error("Failed to publish archive files", zap.String("sink", a.name), zap.Error(err))
+	}
+}
+
+// publish converts and uploads the pending staging files. Failed files are
+// kept pending and tried again later.
+func (a *archiveSink) publish(ctx context.Context) error {
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	var failed []string
+	var errs []error
+	for _, path := range pending {
+		if err := a.publishFile(ctx, path); err != nil {
+			failed = append(failed, path)
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		a.mu.Lock()
+		a.pending = append(failed, a.pending...)
+		a.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+func (a *archiveSink) publishFile(ctx context.Context, path string) error {
+	rel, err := filepath.Rel(a.staging, path)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSuffix(filepath.ToSlash(rel), stagingSuffix) + "." + a.format
+	out := strings.TrimSuffix(path, stagingSuffix) + ".tmp"
+	defer os.Remove(out)
+
+	rows, err := a.convert(path, out)
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		if err := a.store.Put(ctx, key, out); err != nil {
+			return err
+		}
+		a.logger.Info("Published archive file",
+			zap.String("sink", a.name),
+			zap.String("key", key),
+			zap.Int("rows", rows))
+	}
+	if err := errors.Join(os.Remove(out), os.Remove(path)); err != nil {
+		return err
+	}
+
+	// Drop the emptied hour, date and tenant directories. Holding mu keeps
+	// Write from creating a file in one of them meanwhile.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dir := filepath.Dir(path); dir != filepath.Clean(a.staging); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// convert writes the staged records at path to out in the archive format
+// and returns how many it wrote. A line cut off by a crash is skipped.
+func (a *archiveSink) convert(path, out string) (int, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	var rows int
+	if a.format == FormatParquet {
+		rows, err = a.writeParquet(bufio.NewReader(src), dst)
+	} else {
+		rows, err = a.writeGzip(bufio.NewReader(src), dst)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := dst.Sync(); err != nil {
+		return 0, err
+	}
+	return rows, dst.Close()
+}
+
+func (a *archiveSink) writeGzip(src *bufio.Reader, dst io.Writer) (int, error) {
+	zw := gzip.NewWriter(dst)
+	rows := 0
+	err := a.eachLine(src, func(line []byte) error {
+		rows++
+		_, err := zw.Write(line)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rows, zw.Close()
+}
+
+func (a *archiveSink) writeParquet(src *bufio.Reader, dst io.Writer) (int, error) {
+	pw := parquet.NewGenericWriter[archiveRow](dst, parquet.Compression(&parquet.Snappy))
+	batch := make([]archiveRow, 0, 1000)
+	rows := 0
+
+	flush := func() error {
+		_, err := pw.Write(batch)
+		batch = batch[:0]
+		return err
+	}
+
+	err := a.eachLine(src, func(line []byte) error {
+		var record stagedRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			a.logger.Warn("Skipping unreadable staged record", zap.String("sink", a.name), zap.Error(err))
+			return nil
+		}
+		rows++
+		batch = append(batch, archiveRow{
+			TenantID:          record.TenantID,
+			DeviceID:          record.DeviceID,
+			DeviceType:        record.DeviceType,
+			Timestamp:         record.Timestamp,
+			QualityCode:       record.QualityCode,
+			QualityViolations: record.QualityViolations,
+			Data:              string(record.Data),
+		})
+		if len(batch) == cap(batch) {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rows, pw.Close()
+}
+
+// eachLine calls fn for every complete line of src.
+func (a *archiveSink) eachLine(src *bufio.Reader, fn func(line []byte) error) error {
+	for {
+		line, err := src.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				a.logger.Warn("Skipping truncated staged record", zap.String("sink", a.name))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
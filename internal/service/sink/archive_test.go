@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/logger"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchivePublishesStagingLeftByCrash(t *testing.T) {
+	staging, location := t.TempDir(), t.TempDir()
+	hour := filepath.Join(staging, "tenant=acme", "date=2024-03-10", "hour=12")
+	if err := os.MkdirAll(hour, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// One complete record, then a line cut off mid-write, plus a half
+	// converted file.
+	staged := `{"tenant_id":"acme","device_id":"d1","timestamp":"2024-03-10T12:00:00Z","data":{"v":1}}` + "\n" +
+		`{"tenant_id":"acme","device_id":"d2","timest`
+	if err := os.WriteFile(filepath.Join(hour, "part-old-1-1"+stagingSuffix), []byte(staged), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hour, "part-old-1-1.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newArchiveSink(Spec{Name: "lake", Format: FormatNDJSONGzip, Staging: staging, Location: location},
+		[]StoreFactory{dirStoreFactory{}}, logger.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	record := &model.RawDeviceData{TenantID: "acme", DeviceID: "d3", Timestamp: time.Date(2024, 3, 10, 13, 0, 0, 0, time.UTC)}
+	if err := a.Write(context.Background(), record); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := countLines(t, filepath.Join(location, "tenant=acme", "date=2024-03-10", "hour=12", "part-old-1-1."+FormatNDJSONGzip)); got != 1 {
+		t.Fatalf("recovered file holds %d records, want 1", got)
+	}
+	published, err := filepath.Glob(filepath.Join(location, "tenant=acme", "date=2024-03-10", "hour=13", "*."+FormatNDJSONGzip))
+	if err != nil || len(published) != 1 {
+		t.Fatalf("got %v, %v, want one file for the new record", published, err)
+	}
+	entries, err := os.ReadDir(staging)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("staging still holds %v, %v", entries, err)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// fileSink appends records to a file as newline delimited JSON.
+type fileSink struct {
+	name string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newFileSink(name, path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &fileSink{name: name, file: file}, nil
+}
+
+func (s *fileSink) Name() string {
+	return s.name
+}
+
+func (s *fileSink) Write(_ context.Context, record *model.RawDeviceData) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+func (s *fileSink) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
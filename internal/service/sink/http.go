@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const defaultHTTPTimeout = 10 * time.Second
+
+// httpSink posts every record as JSON to a webhook. Any status outside 2xx
+// is a failure.
+type httpSink struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPSink(spec Spec) (*httpSink, error) {
+	if u, err := url.Parse(spec.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", spec.URL)
+	}
+
+	timeout := defaultHTTPTimeout
+	if spec.Timeout != "" {
+		var err error
+		if timeout, err = util.ParseDuration(spec.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", spec.Timeout)
+		}
+	}
+
+	headers := make(map[string]string, len(spec.Headers))
+	for key, value := range spec.Headers {
+		headers[key] = os.ExpandEnv(value)
+	}
+
+	return &httpSink{
+		name:    spec.Name,
+		url:     spec.URL,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *httpSink) Name() string {
+	return s.name
+}
+
+func (s *httpSink) Write(ctx context.Context, record *model.RawDeviceData) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
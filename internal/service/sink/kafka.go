@@ -0,0 +1,35 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/event"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes records as JSON, keyed by tenant and device. Writes
+// wait for the brokers, so failures are retried and dead-lettered like
+// those of any other sink.
+type kafkaSink struct {
+	name     string
+	topic    string
+	producer event.Producer
+}
+
+func newKafkaSink(name, topic string, producer event.Producer) *kafkaSink {
+	return &kafkaSink{name: name, topic: topic, producer: producer}
+}
+
+func (s *kafkaSink) Name() string {
+	return s.name
+}
+
+func (s *kafkaSink) Write(ctx context.Context, record *model.RawDeviceData) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.producer.Produce(ctx, s.topic, kafka.Message{Key: recordKey(record), Value: value})
+}
@@ -0,0 +1,30 @@
+package sink
+
+import (
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/spool"
+)
+
+// postgresSink writes through the loader, so wide tables and the load
+// format apply as usual. The spool takes over while the database is down.
+type postgresSink struct {
+	name   string
+	loader spool.Spool
+}
+
+func newPostgresSink(name string, loader spool.Spool) *postgresSink {
+	return &postgresSink{name: name, loader: loader}
+}
+
+func (s *postgresSink) Name() string {
+	return s.name
+}
+
+func (s *postgresSink) Write(_ context.Context, record *model.RawDeviceData) error {
+	return s.loader.Load(record)
+}
+
+func (s *postgresSink) Flush(ctx context.Context) error {
+	return s.loader.Flush(ctx)
+}
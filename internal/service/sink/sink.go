@@ -0,0 +1,422 @@
+package sink
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/internal/service/spool"
+	"etl-pipeline/pkg/cache"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Sink types.
+const (
+	TypePostgres = "postgres"
+	TypeKafka    = "kafka"
+	TypeFile     = "file"
+	TypeHTTP     = "http"
+	TypeArchive  = "archive"
+)
+
+// Delivery policies. With PolicyAll a record is only done once every sink
+// accepted it; with PolicyRequired only the sinks marked required count.
+const (
+	PolicyAll      = "all"
+	PolicyRequired = "required"
+)
+
+const (
+	defaultAttempts = 3
+	defaultBackoff  = 100 * time.Millisecond
+	deliverTimeout  = 30 * time.Second
+
+	// Deliveries are remembered long enough to cover the reader's retries
+	// of a message.
+	deliveredEntries = 10000
+	deliveredTTL     = 10 * time.Minute
+)
+
+// Sink is one destination of loaded records.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, record *model.RawDeviceData) error
+}
+
+// ConfigFile is the YAML document loaded from SINKS_CONFIG_PATH.
+type ConfigFile struct {
+	Policy string `yaml:"policy"`
+	Sinks  []Spec `yaml:"sinks"`
+}
+
+// Spec configures one sink. Topic applies to kafka sinks, Path to file
+// sinks, URL, Timeout and Headers to http sinks, and the rest to archive
+// sinks. Header values are expanded from the environment so secrets can
+// stay out of the file.
+type Spec struct {
+	Name     string            `yaml:"name"`
+	Type     string            `yaml:"type"`
+	Required bool              `yaml:"required"`
+	Retry    Retry             `yaml:"retry"`
+	Topic    string            `yaml:"topic"`
+	Path     string            `yaml:"path"`
+	URL      string            `yaml:"url"`
+	Timeout  string            `yaml:"timeout"`
+	Headers  map[string]string `yaml:"headers"`
+
+	Format       string `yaml:"format"`
+	Location     string `yaml:"location"`
+	Staging      string `yaml:"staging"`
+	RollBytes    int64  `yaml:"roll_bytes"`
+	RollInterval string `yaml:"roll_interval"`
+}
+
+// flusher is implemented by sinks that buffer records.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// starter and closer are implemented by sinks with background work or
+// open files.
+type starter interface {
+	Start()
+}
+
+type closer interface {
+	Close() error
+}
+
+// Retry is the per sink retry. The backoff doubles after every attempt.
+type Retry struct {
+	Attempts int    `yaml:"attempts"`
+	Backoff  string `yaml:"backoff"`
+}
+
+type target struct {
+	sink     Sink
+	required bool
+	attempts int
+	backoff  time.Duration
+}
+
+// Dispatcher fans a record out to the configured sinks.
+type Dispatcher interface {
+	// Deliver writes the record to every sink and fails when the policy is
+	// not met. Failures the policy tolerates go to the DLQ.
+	Deliver(record *model.RawDeviceData) error
+	// Flush makes every record delivered so far durable in the sinks that
+	// buffer. It must succeed before the matching offsets are committed.
+	Flush(ctx context.Context) error
+}
+
+// Error is a required sink failing a record.
+type Error struct {
+	Sink string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("sink %s: %v", e.Sink, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FailedSinks returns the names of the sinks err reports as failed.
+func FailedSinks(err error) []string {
+	var names []string
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *Error:
+			names = append(names, e.Sink)
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+	return names
+}
+
+type dispatcher struct {
+	targets    []target
+	delivered  *cache.LRU[[sha256.Size]byte, []bool]
+	deadLetter event.DeadLetter
+	logger     logger.Logger
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+type DispatcherParams struct {
+	fx.In
+	Config     *config.Config
+	Loader     spool.Spool
+	Producer   event.Producer
+	DeadLetter event.DeadLetter
+	Stores     []StoreFactory `group:"stores"`
+	Logger     logger.Logger
+	Lifecycle  fx.Lifecycle
+}
+
+// NewDispatcher builds the sinks from SINKS_CONFIG_PATH. Without a config
+// every record goes to Postgres only, as before.
+func NewDispatcher(params DispatcherParams) (Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dispatcher{
+		delivered:  cache.NewLRU[[sha256.Size]byte, []bool](deliveredEntries),
+		deadLetter: params.DeadLetter,
+		logger:     params.Logger,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	if params.Config.Sink.ConfigPath == "" {
+		d.targets = []target{{sink: newPostgresSink(TypePostgres, params.Loader), required: true, attempts: 1}}
+		return d, nil
+	}
+
+	content, err := os.ReadFile(params.Config.Sink.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sink config: %w", err)
+	}
+
+	var file ConfigFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse sink config: %w", err)
+	}
+
+	if file.Policy == "" {
+		file.Policy = PolicyAll
+	}
+	if file.Policy != PolicyAll && file.Policy != PolicyRequired {
+		return nil, fmt.Errorf("unknown sink policy %q, expected %s or %s", file.Policy, PolicyAll, PolicyRequired)
+	}
+	if len(file.Sinks) == 0 {
+		return nil, errors.New("sink config must list at least one sink")
+	}
+
+	seen := make(map[string]bool)
+	for i, spec := range file.Sinks {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("sinks[%d]: name is required", i)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("sinks[%d]: duplicate sink name %q", i, spec.Name)
+		}
+		seen[spec.Name] = true
+
+		t := target{required: spec.Required || file.Policy == PolicyAll, attempts: defaultAttempts, backoff: defaultBackoff}
+		if spec.Retry.Attempts < 0 {
+			return nil, fmt.Errorf("sinks[%d]: retry attempts must not be negative", i)
+		}
+		if spec.Retry.Attempts > 0 {
+			t.attempts = spec.Retry.Attempts
+		}
+		if spec.Retry.Backoff != "" {
+			if t.backoff, err = util.ParseDuration(spec.Retry.Backoff); err != nil || t.backoff < 0 {
+				return nil, fmt.Errorf("sinks[%d]: invalid retry backoff %q", i, spec.Retry.Backoff)
+			}
+		}
+
+		switch spec.Type {
+		case TypePostgres:
+			t.sink = newPostgresSink(spec.Name, params.Loader)
+		case TypeKafka:
+			if spec.Topic == "" {
+				return nil, fmt.Errorf("sinks[%d]: topic is required", i)
+			}
+			t.sink = newKafkaSink(spec.Name, spec.Topic, params.Producer)
+		case TypeFile:
+			if spec.Path == "" {
+				return nil, fmt.Errorf("sinks[%d]: path is required", i)
+			}
+			f, err := newFileSink(spec.Name, spec.Path)
+			if err != nil {
+				return nil, fmt.Errorf("sinks[%d]: %w", i, err)
+			}
+			t.sink = f
+		case TypeHTTP:
+			h, err := newHTTPSink(spec)
+			if err != nil {
+				return nil, fmt.Errorf("sinks[%d]: %w", i, err)
+			}
+			t.sink = h
+		case TypeArchive:
+			a, err := newArchiveSink(spec, params.Stores, params.Logger)
+			if err != nil {
+				return nil, fmt.Errorf("sinks[%d]: %w", i, err)
+			}
+			t.sink = a
+		default:
+			return nil, fmt.Errorf("sinks[%d]: unknown sink type %q", i, spec.Type)
+		}
+		d.targets = append(d.targets, t)
+	}
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			for _, t := range d.targets {
+				if s, ok := t.sink.(starter); ok {
+					s.Start()
+				}
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			d.cancel()
+			var errs []error
+			for _, t := range d.targets {
+				if c, ok := t.sink.(closer); ok {
+					errs = append(errs, c.Close())
+				}
+			}
+			return errors.Join(errs...)
+		},
+	})
+	return d, nil
+}
+
+// Deliver implements Dispatcher. Sinks are written concurrently, each with
+// its own retry. When the record fails, the sinks that took it are
+// remembered, so the reader retrying the message only writes to the sinks
+// that failed instead of duplicating it everywhere else.
+func (d *dispatcher) Deliver(record *model.RawDeviceData) error {
+	if len(d.targets) == 1 {
+		t := d.targets[0]
+		return d.settle(t, d.write(t, record), record)
+	}
+
+	key, err := fingerprint(record)
+	if err != nil {
+		return err
+	}
+	done, ok := d.delivered.Get(key)
+	if !ok {
+		done = make([]bool, len(d.targets))
+	}
+
+	errs := make([]error, len(d.targets))
+	var wg sync.WaitGroup
+	for i, t := range d.targets {
+		if done[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			errs[i] = d.settle(t, d.write(t, record), record)
+		}(i, t)
+	}
+	wg.Wait()
+
+	pending := false
+	next := make([]bool, len(done))
+	for i := range done {
+		next[i] = done[i] || errs[i] == nil
+		pending = pending || !next[i]
+	}
+	if !pending {
+		d.delivered.Delete(key)
+		return nil
+	}
+	d.delivered.Set(key, next, deliveredTTL)
+	return errors.Join(errs...)
+}
+
+// fingerprint identifies a record across retries of its message. The
+// pipeline is deterministic until commit, so a retry yields the same record.
+func fingerprint(record *model.RawDeviceData) ([sha256.Size]byte, error) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return [sha256.Size]byte{}, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	return sha256.Sum256(content), nil
+}
+
+// Flush implements Dispatcher.
+func (d *dispatcher) Flush(ctx context.Context) error {
+	var errs []error
+	for _, t := range d.targets {
+		if f, ok := t.sink.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %w", t.sink.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *dispatcher) write(t target, record *model.RawDeviceData) error {
+	ctx, cancel := context.WithTimeout(d.ctx, deliverTimeout)
+	defer cancel()
+
+	backoff := t.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = t.sink.Write(ctx, record); err == nil || attempt >= t.attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// settle decides what a sink failure means for the record: failures of
+// required sinks fail it, the others are sent to the DLQ.
+func (d *dispatcher) settle(t target, err error, record *model.RawDeviceData) error {
+	if err == nil {
+		return nil
+	}
+	name := t.sink.Name()
+	metrics.SinkFailuresTotal.WithLabelValues(name).Inc()
+	if t.required {
+		return &Error{Sink: name, Err: err}
+	}
+
+	d.logger.Warn("Optional sink failed",
+		zap.String("sink", name),
+		zap.String("tenantID", record.TenantID),
+		zap.String("deviceID", record.DeviceID),
+		zap.String("error", privacy.RedactError(err)))
+
+	value, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		return &Error{Sink: name, Err: fmt.Errorf("failed to marshal record for DLQ: %w", marshalErr)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliverTimeout)
+	defer cancel()
+	if dlqErr := d.deadLetter.WriteSinkFailure(ctx, name, recordKey(record), value, err); dlqErr != nil {
+		// Losing the record silently is worse than loading it twice.
+		return &Error{Sink: name, Err: fmt.Errorf("%w (DLQ write failed: %v)", err, dlqErr)}
+	}
+	return nil
+}
+
+func recordKey(record *model.RawDeviceData) []byte {
+	return []byte(record.TenantID + "/" + record.DeviceID)
+}
@@ -0,0 +1,66 @@
+package sink
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/cache"
+	"etl-pipeline/pkg/logger"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// countingSink fails the first failures writes.
+type countingSink struct {
+	name     string
+	failures int
+	writes   int
+}
+
+func (s *countingSink) Name() string { return s.name }
+
+func (s *countingSink) Write(context.Context, *model.RawDeviceData) error {
+	s.writes++
+	if s.writes <= s.failures {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func TestDeliverRetriesOnlyFailedSinks(t *testing.T) {
+	db := &countingSink{name: "db"}
+	hook := &countingSink{name: "hook", failures: 1}
+	d := &dispatcher{
+		targets: []target{
+			{sink: db, required: true, attempts: 1},
+			{sink: hook, required: true, attempts: 1},
+		},
+		delivered: cache.NewLRU[[sha256.Size]byte, []bool](deliveredEntries),
+		logger:    logger.NewNop(),
+		ctx:       context.Background(),
+	}
+	record := &model.RawDeviceData{TenantID: "t", DeviceID: "d", Timestamp: time.Unix(0, 0)}
+
+	err := d.Deliver(record)
+	if got := FailedSinks(err); !reflect.DeepEqual(got, []string{"hook"}) {
+		t.Fatalf("failed sinks = %q (%v), want hook", got, err)
+	}
+	// The reader retries the message with the same record.
+	retry := *record
+	if err := d.Deliver(&retry); err != nil {
+		t.Fatal(err)
+	}
+	if db.writes != 1 || hook.writes != 2 {
+		t.Fatalf("db written %d times and hook %d times, want 1 and 2", db.writes, hook.writes)
+	}
+
+	// Once every sink has it, a new delivery of the record is written again.
+	if err := d.Deliver(record); err != nil {
+		t.Fatal(err)
+	}
+	if db.writes != 2 {
+		t.Fatalf("db written %d times, want 2", db.writes)
+	}
+}
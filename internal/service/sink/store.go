@@ -0,0 +1,109 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/fx"
+)
+
+// Store publishes finished archive files.
+type Store interface {
+	// Put uploads the local file at path under key. Readers must see either
+	// the whole object or nothing.
+	Put(ctx context.Context, key, path string) error
+}
+
+// StoreFactory opens the Store behind an archive location URL. Factories
+// are registered in the "stores" group, one per URL scheme, so object
+// stores can be plugged in by other modules.
+type StoreFactory interface {
+	Scheme() string
+	Open(location *url.URL) (Store, error)
+}
+
+type BuiltinStoresResult struct {
+	fx.Out
+	Stores []StoreFactory `group:"stores,flatten"`
+}
+
+func NewBuiltinStores() BuiltinStoresResult {
+	return BuiltinStoresResult{Stores: []StoreFactory{dirStoreFactory{}}}
+}
+
+// dirStoreFactory serves file:// locations and plain paths.
+type dirStoreFactory struct{}
+
+func (dirStoreFactory) Scheme() string {
+	return "file"
+}
+
+func (dirStoreFactory) Open(location *url.URL) (Store, error) {
+	if location.Path == "" {
+		return nil, fmt.Errorf("location %q has no path", location)
+	}
+	if err := os.MkdirAll(location.Path, 0o755); err != nil {
+		return nil, err
+	}
+	return &dirStore{root: location.Path}, nil
+}
+
+// dirStore copies files into a local directory. Each file is written under
+// a hidden temporary name and renamed into place once synced.
+type dirStore struct {
+	root string
+}
+
+func (s *dirStore) Put(_ context.Context, key, path string) error {
+	dest := filepath.Join(s.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// openStore resolves an archive location. Locations without a scheme are
+// local directories.
+func openStore(location string, factories []StoreFactory) (Store, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location %q: %w", location, err)
+	}
+	if u.Scheme == "" {
+		u = &url.URL{Scheme: "file", Path: location}
+	}
+	for _, factory := range factories {
+		if factory.Scheme() == u.Scheme {
+			return factory.Open(u)
+		}
+	}
+	return nil, fmt.Errorf("no store registered for scheme %q", u.Scheme)
+}
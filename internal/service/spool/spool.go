@@ -0,0 +1,558 @@
+package spool
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/load"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/metrics"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+const (
+	segmentPrefix  = "segment-"
+	segmentSuffix  = ".spool"
+	checkpointName = "checkpoint"
+
+	// headerSize is the frame header: payload length and CRC-32C.
+	headerSize     = 8
+	maxRecordBytes = 64 << 20
+	replayBatch    = 100
+	maxBackoff     = 30 * time.Second
+	// deadLetterName is the sink name replay failures are reported under.
+	deadLetterName = "spool"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrFull is returned when a record would grow the spool past
+// SPOOL_MAX_BYTES.
+var ErrFull = errors.New("spool is full")
+
+// Spool is a loader that falls back to a local write-ahead log while the
+// database is unavailable. Spooled records are replayed in order once the
+// database is back; until the spool is drained, new records queue behind
+// them.
+type Spool interface {
+	load.Loader
+	// Flush syncs the spool, so spooled records survive a crash.
+	Flush(ctx context.Context) error
+}
+
+type spool struct {
+	enabled      bool
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+	loader       load.Loader
+	deadLetter   event.DeadLetter
+	logger       logger.Logger
+
+	mu       sync.Mutex
+	segments []uint64
+	sizes    map[uint64]int64
+	total    int64
+	// active is the segment being appended to; it is always the last one.
+	active    *os.File
+	activeSeq uint64
+	// nextSeq numbers the next segment. It never goes back, not even once
+	// the spool drains, since the checkpoint discards lower segments.
+	nextSeq uint64
+	// readOffset is the replay position in segments[0].
+	readOffset int64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type SpoolParams struct {
+	fx.In
+	Config     *config.Config
+	Loader     load.Loader
+	DeadLetter event.DeadLetter
+	Logger     logger.Logger
+	Lifecycle  fx.Lifecycle
+}
+
+// NewSpool spools to SPOOL_DIR. Without it records go straight to the
+// loader.
+func NewSpool(params SpoolParams) (Spool, error) {
+	cfg := params.Config.Spool
+	s := &spool{
+		enabled:      cfg.Dir != "",
+		dir:          cfg.Dir,
+		segmentBytes: cfg.SegmentBytes,
+		maxBytes:     cfg.MaxBytes,
+		loader:       params.Loader,
+		deadLetter:   params.DeadLetter,
+		logger:       params.Logger,
+		sizes:        make(map[uint64]int64),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	if !s.enabled {
+		return s, nil
+	}
+	if cfg.SegmentBytes <= 0 || cfg.MaxBytes < cfg.SegmentBytes {
+		return nil, errors.New("SPOOL_SEGMENT_BYTES must be positive and at most SPOOL_MAX_BYTES")
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to open spool: %w", err)
+	}
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go s.replayLoop()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			close(s.stop)
+			<-s.done
+			return s.close()
+		},
+	})
+	return s, nil
+}
+
+// recover loads the segments and the replay position left by a previous
+// run. Appends always start a new segment.
+func (s *spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), segmentPrefix)
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seq)
+		s.sizes[seq] = info.Size()
+		s.total += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	seq, offset, err := s.readCheckpoint()
+	if err != nil {
+		return err
+	}
+	// Segments before the checkpoint were replayed already.
+	for len(s.segments) > 0 && s.segments[0] < seq {
+		if err := s.removeSegment(); err != nil {
+			return err
+		}
+	}
+	if len(s.segments) > 0 && s.segments[0] == seq {
+		s.readOffset = offset
+	}
+	s.nextSeq = max(seq, 1)
+	if len(s.segments) > 0 {
+		s.nextSeq = max(s.nextSeq, s.segments[len(s.segments)-1]+1)
+	}
+	s.updateGauges()
+
+	if len(s.segments) > 0 {
+		s.logger.Info("Spool holds records from a previous run",
+			zap.Int("segments", len(s.segments)),
+			zap.Int64("bytes", s.total))
+	}
+	return nil
+}
+
+func (s *spool) Load(record *model.RawDeviceData) error {
+	if !s.enabled {
+		return s.loader.Load(record)
+	}
+
+	s.mu.Lock()
+	backlog := s.backlog()
+	s.mu.Unlock()
+
+	if !backlog {
+		err := s.loader.Load(record)
+		if err == nil || !unavailable(err) {
+			return err
+		}
+		s.logger.Warn("Database unavailable, spooling record",
+			zap.String("tenantID", record.TenantID),
+			zap.String("deviceID", record.DeviceID),
+			zap.Error(err))
+	}
+	return s.append(record)
+}
+
+// backlog reports whether records are waiting for replay. The caller must
+// hold mu.
+func (s *spool) backlog() bool {
+	if len(s.segments) == 0 {
+		return false
+	}
+	return len(s.segments) > 1 || s.readOffset < s.sizes[s.segments[0]]
+}
+
+func (s *spool) append(record *model.RawDeviceData) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRecordBytes {
+		return fmt.Errorf("record of %d bytes is too large to spool", len(payload))
+	}
+	frame := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[headerSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.total+int64(len(frame)) > s.maxBytes {
+		metrics.SpoolRecordsTotal.WithLabelValues("rejected").Inc()
+		return ErrFull
+	}
+	if s.active == nil || (s.sizes[s.activeSeq] > 0 && s.sizes[s.activeSeq]+int64(len(frame)) > s.segmentBytes) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(frame); err != nil {
+		// A partial frame would corrupt the segment; start a new one.
+		s.sealActive()
+		return err
+	}
+	s.sizes[s.activeSeq] += int64(len(frame))
+	s.total += int64(len(frame))
+	metrics.SpoolRecordsTotal.WithLabelValues("spooled").Inc()
+	s.updateGauges()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate seals the active segment and opens the next one. The caller must
+// hold mu.
+func (s *spool) rotate() error {
+	s.sealActive()
+
+	seq := s.nextSeq
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.active, s.activeSeq = file, seq
+	s.segments = append(s.segments, seq)
+	s.sizes[seq] = 0
+	return nil
+}
+
+func (s *spool) sealActive() {
+	if s.active == nil {
+		return
+	}
+	if err := errors.Join(s.active.Sync(), s.active.Close()); err != nil {
+		s.logger.Error("Failed to seal spool segment", zap.Uint64("segment", s.activeSeq), zap.Error(err))
+	}
+	s.active, s.activeSeq = nil, 0
+}
+
+func (s *spool) Flush(context.Context) error {
+	if !s.enabled {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+	return s.active.Sync()
+}
+
+func (s *spool) replayLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	backoff := time.Second
+
+	for {
+		s.mu.Lock()
+		backlog := s.backlog()
+		s.mu.Unlock()
+
+		if !backlog {
+			select {
+			case <-s.stop:
+				return
+			case <-s.wake:
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		if err := s.replay(); err != nil {
+			s.logger.Warn("Spool replay paused", zap.Duration("backoff", backoff), zap.Error(err))
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = time.Second
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+// replay loads up to replayBatch records from the oldest segment and
+// advances the checkpoint past them. It stops at the first record the
+// database cannot take yet; records the database rejects go to the DLQ.
+func (s *spool) replay() error {
+	s.mu.Lock()
+	seq := s.segments[0]
+	offset := s.readOffset
+	end := s.sizes[seq]
+	sealed := seq != s.activeSeq
+	s.mu.Unlock()
+
+	if offset >= end {
+		if !sealed {
+			return nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.removeSegment()
+	}
+
+	file, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var replayErr error
+	for i := 0; i < replayBatch && offset < end; i++ {
+		payload, next, err := readFrame(file, offset, end)
+		if err != nil {
+			// Without a trustworthy length the rest of the segment cannot
+			// be framed.
+			metrics.SpoolRecordsTotal.WithLabelValues("corrupt").Inc()
+			s.logger.Error("Skipping corrupt spool segment tail",
+				zap.Uint64("segment", seq),
+				zap.Int64("offset", offset),
+				zap.Error(err))
+			offset = end
+			break
+		}
+		if payload == nil {
+			metrics.SpoolRecordsTotal.WithLabelValues("corrupt").Inc()
+			s.logger.Error("Skipping spooled record with bad checksum",
+				zap.Uint64("segment", seq),
+				zap.Int64("offset", offset))
+			offset = next
+			continue
+		}
+
+		if replayErr = s.replayRecord(payload); replayErr != nil {
+			break
+		}
+		offset = next
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readOffset = offset
+	if err := s.writeCheckpoint(seq, offset); err != nil {
+		return errors.Join(replayErr, err)
+	}
+	s.updateGauges()
+	return replayErr
+}
+
+// readFrame reads the frame at offset. It returns a nil payload for a frame
+// whose checksum does not match, and an error when the frame itself is
+// broken.
+func readFrame(r io.Reader, offset, end int64) ([]byte, int64, error) {
+	if end-offset < headerSize {
+		return nil, 0, errors.New("truncated frame header")
+	}
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size > maxRecordBytes || offset+headerSize+size > end {
+		return nil, 0, fmt.Errorf("invalid frame length %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	next := offset + headerSize + size
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, next, nil
+	}
+	return payload, next, nil
+}
+
+func (s *spool) replayRecord(payload []byte) error {
+	var record model.RawDeviceData
+	err := util.UnmarshalJSON(payload, &record)
+	if err == nil {
+		err = s.loader.Load(&record)
+		if err == nil {
+			metrics.SpoolRecordsTotal.WithLabelValues("replayed").Inc()
+			return nil
+		}
+		if unavailable(err) {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	key := []byte(record.TenantID + "/" + record.DeviceID)
+	if dlqErr := s.deadLetter.WriteSinkFailure(ctx, deadLetterName, key, payload, err); dlqErr != nil {
+		return fmt.Errorf("failed to dead-letter spooled record: %w", dlqErr)
+	}
+	metrics.SpoolRecordsTotal.WithLabelValues("dead_lettered").Inc()
+	return nil
+}
+
+// removeSegment deletes the oldest segment once it has been replayed. The
+// caller must hold mu.
+func (s *spool) removeSegment() error {
+	seq := s.segments[0]
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.total -= s.sizes[seq]
+	delete(s.sizes, seq)
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+
+	next := seq + 1
+	if len(s.segments) > 0 {
+		next = s.segments[0]
+	}
+	s.updateGauges()
+	return s.writeCheckpoint(next, 0)
+}
+
+func (s *spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))
+}
+
+func (s *spool) readCheckpoint() (uint64, int64, error) {
+	content, err := os.ReadFile(filepath.Join(s.dir, checkpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var seq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(content), "%d %d", &seq, &offset); err != nil {
+		return 0, 0, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return seq, offset, nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically. A lost update only
+// means some records are replayed twice.
+func (s *spool) writeCheckpoint(seq uint64, offset int64) error {
+	path := filepath.Join(s.dir, checkpointName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, offset)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *spool) updateGauges() {
+	metrics.SpoolBytes.Set(float64(s.total))
+	metrics.SpoolSegments.Set(float64(len(s.segments)))
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealActive()
+	return nil
+}
+
+// unavailable reports whether err means the database cannot be reached or
+// is not accepting writes right now, as opposed to rejecting the record.
+func unavailable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err) || pgconn.SafeToRetry(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exception
+			pgErr.Code == "57P01", // admin_shutdown
+			pgErr.Code == "57P02", // crash_shutdown
+			pgErr.Code == "57P03", // cannot_connect_now
+			pgErr.Code == "53300", // too_many_connections
+			pgErr.Code == "25006": // read_only_sql_transaction, e.g. during failover
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "failed to connect") || strings.Contains(msg, "closed pool") ||
+		strings.Contains(msg, "conn closed")
+}
@@ -0,0 +1,125 @@
+package spool
+
+import (
+	"etl-pipeline/internal/model"
+	"etl-pipeline/pkg/logger"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// budgetLoader takes budget records and then reports the database as
+// unavailable.
+type budgetLoader struct {
+	budget int
+	loaded []string
+}
+
+func (l *budgetLoader) Load(record *model.RawDeviceData) error {
+	if l.budget == 0 {
+		return &pgconn.PgError{Code: "57P03"}
+	}
+	l.budget--
+	l.loaded = append(l.loaded, record.DeviceID)
+	return nil
+}
+
+func openTestSpool(t *testing.T, dir string, loader *budgetLoader) *spool {
+	t.Helper()
+	s := &spool{
+		enabled:      true,
+		dir:          dir,
+		segmentBytes: 1 << 20,
+		maxBytes:     1 << 30,
+		loader:       loader,
+		logger:       logger.NewNop(),
+		sizes:        make(map[uint64]int64),
+		wake:         make(chan struct{}, 1),
+	}
+	if err := s.recover(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func spoolRecord(t *testing.T, s *spool, deviceID string) {
+	t.Helper()
+	if err := s.Load(&model.RawDeviceData{TenantID: "t", DeviceID: deviceID, Timestamp: time.Unix(0, 0)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drain replays until every segment has been replayed and removed.
+func drain(t *testing.T, s *spool) {
+	t.Helper()
+	for len(s.segments) > 0 {
+		if err := s.replay(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecoverResumesAtCheckpointAndSkipsTornFrame(t *testing.T) {
+	dir := t.TempDir()
+	loader := &budgetLoader{}
+	s := openTestSpool(t, dir, loader)
+	for _, device := range []string{"d1", "d2", "d3"} {
+		spoolRecord(t, s, device)
+	}
+
+	// The database comes back for one record only.
+	loader.budget = 1
+	if err := s.replay(); err == nil {
+		t.Fatal("expected replay to stop at the unavailable database")
+	}
+	// A crash tears the frame being appended.
+	path := s.segmentPath(s.activeSeq)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, '{'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loader = &budgetLoader{budget: 100}
+	s = openTestSpool(t, dir, loader)
+	drain(t, s)
+	if !reflect.DeepEqual(loader.loaded, []string{"d2", "d3"}) {
+		t.Fatalf("replayed %q, want d2 and d3", loader.loaded)
+	}
+}
+
+func TestSegmentsAfterDrainSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	loader := &budgetLoader{}
+	s := openTestSpool(t, dir, loader)
+	spoolRecord(t, s, "d1")
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+	loader.budget = 1
+	drain(t, s)
+
+	// The database fails again after the spool drained.
+	spoolRecord(t, s, "d2")
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loader = &budgetLoader{budget: 100}
+	s = openTestSpool(t, dir, loader)
+	drain(t, s)
+	if !reflect.DeepEqual(loader.loaded, []string{"d2"}) {
+		t.Fatalf("replayed %q after restart, want d2", loader.loaded)
+	}
+}
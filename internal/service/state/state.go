@@ -0,0 +1,207 @@
+package state
+
+import (
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// Store keeps per device and field state for a stateful stage in memory and
+// writes changed entries back to Postgres periodically and on shutdown, so
+// the stage can be restored after a restart. Entries of devices that stay
+// silent for longer than the store's TTL are evicted from memory and not
+// restored, so such a device starts over from a fresh baseline.
+type Store interface {
+	Get(tenantID, deviceID, field string) (model.StateEntry, bool)
+	// Put stores entry unless the stored one is newer, so a stale reading
+	// committed late cannot move the state back in time. It reports
+	// whether entry was stored.
+	Put(entry model.StateEntry) bool
+}
+
+type store struct {
+	kind          string
+	repo          repository.Repository
+	logger        logger.Logger
+	flushInterval time.Duration
+	ttl           time.Duration
+	now           func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]model.StateEntry
+	dirty   map[string]bool
+	touched map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStore creates the store for one kind of state and hooks loading and
+// flushing into the application lifecycle. A ttl of zero keeps entries
+// forever.
+func NewStore(lc fx.Lifecycle, kind string, repo repository.Repository, log logger.Logger, flushInterval, ttl time.Duration) Store {
+	s := newStore(kind, repo, log, flushInterval, ttl)
+
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			if err := s.load(ctx); err != nil {
+				return err
+			}
+			go s.flushLoop()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(s.stop)
+			<-s.done
+			return s.flush(ctx)
+		},
+	})
+
+	return s
+}
+
+func newStore(kind string, repo repository.Repository, log logger.Logger, flushInterval, ttl time.Duration) *store {
+	return &store{
+		kind:          kind,
+		repo:          repo,
+		logger:        log,
+		flushInterval: flushInterval,
+		ttl:           ttl,
+		now:           time.Now,
+		entries:       make(map[string]model.StateEntry),
+		dirty:         make(map[string]bool),
+		touched:       make(map[string]time.Time),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func key(tenantID, deviceID, field string) string {
+	return tenantID + "/" + deviceID + "/" + field
+}
+
+func (s *store) Get(tenantID, deviceID, field string) (model.StateEntry, bool) {
+	k := key(tenantID, deviceID, field)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[k]
+	if ok {
+		s.touched[k] = s.now()
+	}
+	return entry, ok
+}
+
+func (s *store) Put(entry model.StateEntry) bool {
+	entry.Kind = s.kind
+	k := key(entry.TenantID, entry.DeviceID, entry.Field)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.entries[k]; ok && current.Timestamp.After(entry.Timestamp) {
+		return false
+	}
+	s.entries[k] = entry
+	s.dirty[k] = true
+	s.touched[k] = s.now()
+	return true
+}
+
+func (s *store) load(ctx context.Context) error {
+	now := s.now()
+	var since time.Time
+	if s.ttl > 0 {
+		since = now.Add(-s.ttl)
+	}
+	entries, err := s.repo.ListPipelineState(ctx, s.kind, since)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		k := key(entry.TenantID, entry.DeviceID, entry.Field)
+		s.entries[k] = entry
+		s.touched[k] = now
+	}
+
+	s.logger.Info("Restored pipeline state",
+		zap.String("kind", s.kind),
+		zap.Int("entries", len(entries)))
+	return nil
+}
+
+func (s *store) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := s.flush(ctx); err != nil {
+				s.logger.Error("Failed to persist pipeline state",
+					zap.String("kind", s.kind),
+					zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// flush writes the dirty entries and evicts the clean ones that were not
+// used within the TTL. Entries that fail to persist are marked dirty again
+// and retried on the next flush.
+func (s *store) flush(ctx context.Context) error {
+	s.mu.Lock()
+	s.evict()
+	if len(s.dirty) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	batch := make([]model.StateEntry, 0, len(s.dirty))
+	for k := range s.dirty {
+		batch = append(batch, s.entries[k])
+	}
+	s.dirty = make(map[string]bool)
+	s.mu.Unlock()
+
+	if err := s.repo.SavePipelineState(ctx, batch); err != nil {
+		s.mu.Lock()
+		for _, entry := range batch {
+			s.dirty[key(entry.TenantID, entry.DeviceID, entry.Field)] = true
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// evict drops clean entries not read or written within the TTL. Dirty
+// entries stay until they are persisted. The caller holds s.mu.
+func (s *store) evict() {
+	if s.ttl <= 0 {
+		return
+	}
+	cutoff := s.now().Add(-s.ttl)
+	for k, touched := range s.touched {
+		if touched.Before(cutoff) && !s.dirty[k] {
+			delete(s.entries, k)
+			delete(s.touched, k)
+		}
+	}
+}
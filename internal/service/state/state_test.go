@@ -0,0 +1,94 @@
+package state
+
+import (
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"testing"
+	"time"
+)
+
+// fakeRepo holds pipeline_state rows in memory.
+type fakeRepo struct {
+	repository.Repository
+	rows  []model.StateEntry
+	saved int
+}
+
+func (r *fakeRepo) ListPipelineState(_ context.Context, kind string, since time.Time) ([]model.StateEntry, error) {
+	var entries []model.StateEntry
+	for _, entry := range r.rows {
+		if entry.Kind == kind && !entry.Timestamp.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (r *fakeRepo) SavePipelineState(_ context.Context, entries []model.StateEntry) error {
+	r.saved += len(entries)
+	return nil
+}
+
+func TestLoadSkipsExpiredEntries(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{rows: []model.StateEntry{
+		{Kind: "deadband", TenantID: "t", DeviceID: "recent", Field: "v", Timestamp: now.Add(-time.Hour)},
+		{Kind: "deadband", TenantID: "t", DeviceID: "silent", Field: "v", Timestamp: now.Add(-48 * time.Hour)},
+	}}
+	s := newStore("deadband", repo, logger.NewNop(), time.Second, 24*time.Hour)
+	s.now = func() time.Time { return now }
+
+	if err := s.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("t", "recent", "v"); !ok {
+		t.Fatal("recent entry was not restored")
+	}
+	if _, ok := s.Get("t", "silent", "v"); ok {
+		t.Fatal("entry older than the TTL was restored")
+	}
+}
+
+func TestFlushEvictsIdleEntries(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	repo := &fakeRepo{}
+	s := newStore("deadband", repo, logger.NewNop(), time.Second, time.Hour)
+	s.now = func() time.Time { return now }
+
+	s.Put(model.StateEntry{TenantID: "t", DeviceID: "idle", Field: "v", Timestamp: now})
+	s.Put(model.StateEntry{TenantID: "t", DeviceID: "active", Field: "v", Timestamp: now})
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	s.Get("t", "active", "v")
+	s.Put(model.StateEntry{TenantID: "t", DeviceID: "unsaved", Field: "v", Timestamp: now.Add(-3 * time.Hour)})
+	now = now.Add(2 * time.Hour)
+	s.Get("t", "active", "v")
+
+	// Only the idle entry is dropped: the unsaved one is still dirty.
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.entries[key("t", "idle", "v")]; ok {
+		t.Fatal("idle entry was kept")
+	}
+	if _, ok := s.entries[key("t", "active", "v")]; !ok {
+		t.Fatal("active entry was evicted")
+	}
+	if repo.saved != 3 {
+		t.Fatalf("saved %d entries, want 3", repo.saved)
+	}
+
+	// Once persisted, the unsaved entry is evicted too.
+	now = now.Add(2 * time.Hour)
+	if err := s.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.entries[key("t", "unsaved", "v")]; ok {
+		t.Fatal("persisted idle entry was kept")
+	}
+}
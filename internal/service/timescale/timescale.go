@@ -0,0 +1,580 @@
+package timescale
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// lockName serializes TimescaleDB changes across pipeline instances.
+const lockName = "etl_pipeline_timescale"
+
+// errDeferred marks a table left for Start to convert.
+var errDeferred = errors.New("conversion deferred")
+
+var (
+	identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+	orderByPattern    = regexp.MustCompile(`(?i)^[a-z_][a-z0-9_]*( (asc|desc))?( nulls (first|last))?$`)
+)
+
+// ConfigFile is the YAML document loaded from TIMESCALE_CONFIG_PATH.
+type ConfigFile struct {
+	Hypertables          []Hypertable          `yaml:"hypertables"`
+	ContinuousAggregates []ContinuousAggregate `yaml:"continuous_aggregates"`
+}
+
+// Hypertable declares how a time-series table is chunked, compressed and
+// expired. Durations accept Go units plus d for days.
+type Hypertable struct {
+	Table         string       `yaml:"table"`
+	TimeColumn    string       `yaml:"time_column"`
+	ChunkInterval string       `yaml:"chunk_interval"`
+	Compression   *Compression `yaml:"compression"`
+	Retention     string       `yaml:"retention"`
+}
+
+type Compression struct {
+	After     string   `yaml:"after"`
+	SegmentBy []string `yaml:"segment_by"`
+	OrderBy   string   `yaml:"order_by"`
+}
+
+// ContinuousAggregate declares a materialized rollup. Query is the SELECT
+// that defines it, including its time_bucket.
+type ContinuousAggregate struct {
+	Name      string   `yaml:"name"`
+	Query     string   `yaml:"query"`
+	Refresh   *Refresh `yaml:"refresh"`
+	Retention string   `yaml:"retention"`
+}
+
+type Refresh struct {
+	StartOffset      string `yaml:"start_offset"`
+	EndOffset        string `yaml:"end_offset"`
+	ScheduleInterval string `yaml:"schedule_interval"`
+}
+
+type hypertable struct {
+	table         string
+	timeColumn    string
+	chunkInterval time.Duration
+	compression   bool
+	compressAfter time.Duration
+	segmentBy     []string
+	orderBy       string
+	retention     time.Duration
+}
+
+type continuousAggregate struct {
+	name      string
+	query     string
+	refresh   *model.RefreshPolicy
+	retention time.Duration
+}
+
+// Reconciler brings the TimescaleDB settings of the pipeline's tables in
+// line with configuration.
+type Reconciler interface {
+	// Reconcile compares the live settings with configuration, logs every
+	// difference and, unless running dry, applies the configured values.
+	Reconcile(ctx context.Context) error
+	// Start converts the configured tables that still hold rows into
+	// hypertables in the background, as that copies every row. Stop
+	// cancels it.
+	Start()
+	Stop()
+}
+
+type reconciler struct {
+	hypertables []hypertable
+	aggregates  []continuousAggregate
+	dryRun      bool
+	databases   repository.Databases
+	// repo and logger belong to the database being reconciled.
+	repo   repository.Timescale
+	logger logger.Logger
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type ReconcilerParams struct {
+	fx.In
+	Config    *config.Config
+	Databases repository.Databases
+	Logger    logger.Logger
+}
+
+func NewReconciler(params ReconcilerParams) (Reconciler, error) {
+	cfg := params.Config.Timescale
+	r := &reconciler{
+		dryRun:    cfg.DryRun,
+		databases: params.Databases,
+		logger:    params.Logger,
+		cancel:    func() {},
+		done:      make(chan struct{}),
+	}
+	if cfg.ConfigPath == "" {
+		return r, nil
+	}
+
+	content, err := os.ReadFile(cfg.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timescale config: %w", err)
+	}
+
+	var file ConfigFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse timescale config: %w", err)
+	}
+
+	for i, h := range file.Hypertables {
+		compiled, err := compileHypertable(h)
+		if err != nil {
+			return nil, fmt.Errorf("hypertables[%d]: %w", i, err)
+		}
+		r.hypertables = append(r.hypertables, compiled)
+	}
+	for i, a := range file.ContinuousAggregates {
+		compiled, err := compileAggregate(a)
+		if err != nil {
+			return nil, fmt.Errorf("continuous_aggregates[%d]: %w", i, err)
+		}
+		r.aggregates = append(r.aggregates, compiled)
+	}
+	return r, nil
+}
+
+func compileHypertable(h Hypertable) (hypertable, error) {
+	c := hypertable{table: h.Table, timeColumn: h.TimeColumn}
+	if !identifierPattern.MatchString(h.Table) {
+		return c, fmt.Errorf("invalid table name %q", h.Table)
+	}
+	if !identifierPattern.MatchString(h.TimeColumn) {
+		return c, fmt.Errorf("invalid time_column %q", h.TimeColumn)
+	}
+
+	var err error
+	if c.chunkInterval, err = parseInterval("chunk_interval", h.ChunkInterval, true); err != nil {
+		return c, err
+	}
+	if c.retention, err = parseInterval("retention", h.Retention, false); err != nil {
+		return c, err
+	}
+
+	if h.Compression != nil {
+		c.compression = true
+		if c.compressAfter, err = parseInterval("compression.after", h.Compression.After, false); err != nil {
+			return c, err
+		}
+		for _, column := range h.Compression.SegmentBy {
+			if !identifierPattern.MatchString(column) {
+				return c, fmt.Errorf("invalid compression.segment_by column %q", column)
+			}
+		}
+		c.segmentBy = h.Compression.SegmentBy
+		c.orderBy, err = normalizeOrderBy(h.Compression.OrderBy)
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+func compileAggregate(a ContinuousAggregate) (continuousAggregate, error) {
+	c := continuousAggregate{name: a.Name, query: strings.TrimRight(strings.TrimSpace(a.Query), ";")}
+	if !identifierPattern.MatchString(a.Name) {
+		return c, fmt.Errorf("invalid name %q", a.Name)
+	}
+	if c.query == "" {
+		return c, errors.New("missing query")
+	}
+
+	var err error
+	if c.retention, err = parseInterval("retention", a.Retention, false); err != nil {
+		return c, err
+	}
+
+	if a.Refresh != nil {
+		policy := model.RefreshPolicy{}
+		if policy.ScheduleInterval, err = parseInterval("refresh.schedule_interval", a.Refresh.ScheduleInterval, true); err != nil {
+			return c, err
+		}
+		if a.Refresh.StartOffset != "" {
+			d, err := parseInterval("refresh.start_offset", a.Refresh.StartOffset, true)
+			if err != nil {
+				return c, err
+			}
+			policy.StartOffset = &d
+		}
+		if a.Refresh.EndOffset != "" {
+			d, err := parseInterval("refresh.end_offset", a.Refresh.EndOffset, false)
+			if err != nil {
+				return c, err
+			}
+			policy.EndOffset = &d
+		}
+		c.refresh = &policy
+	}
+	return c, nil
+}
+
+func parseInterval(name, value string, required bool) (time.Duration, error) {
+	if value == "" {
+		if required {
+			return 0, fmt.Errorf("missing %s", name)
+		}
+		return 0, nil
+	}
+	d, err := util.ParseDuration(value)
+	if err != nil || d < 0 || (required && d == 0) {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+// normalizeOrderBy validates an order_by list and spells it the way the
+// live settings are read back, so the two can be compared.
+func normalizeOrderBy(orderBy string) (string, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		return "", nil
+	}
+
+	var terms []string
+	for _, term := range strings.Split(orderBy, ",") {
+		term = strings.Join(strings.Fields(term), " ")
+		if !orderByPattern.MatchString(term) {
+			return "", fmt.Errorf("invalid compression.order_by term %q", term)
+		}
+		parts := strings.Fields(term)
+		normalized := strings.ToLower(parts[0])
+		if len(parts) > 1 && strings.EqualFold(parts[1], "desc") {
+			normalized += " DESC"
+		}
+		terms = append(terms, normalized)
+	}
+	return strings.Join(terms, ", "), nil
+}
+
+// Reconcile runs on the main database and on every tenant route, as each
+// holds its own copy of the tables.
+func (r *reconciler) Reconcile(ctx context.Context) error {
+	if len(r.hypertables) == 0 && len(r.aggregates) == 0 {
+		return nil
+	}
+
+	return r.databases.Each(ctx, func(name string, db *pgxpool.Pool) error {
+		target := *r
+		target.repo = repository.NewTimescale(db)
+		target.logger = r.logger.WithField("database", name)
+		ran, err := target.repo.TryLocked(ctx, lockName, func() error {
+			return target.reconcile(ctx)
+		})
+		if err == nil && !ran {
+			target.logger.Info("TimescaleDB settings are being changed elsewhere")
+		}
+		return err
+	})
+}
+
+// migrate converts the configured tables that are not hypertables yet,
+// moving their rows into chunks, then reconciles the remaining settings.
+func (r *reconciler) migrate(ctx context.Context) error {
+	return r.databases.Each(ctx, func(name string, db *pgxpool.Pool) error {
+		target := *r
+		target.repo = repository.NewTimescale(db)
+		target.logger = r.logger.WithField("database", name)
+		_, err := target.repo.TryLocked(ctx, lockName, func() error {
+			converted := 0
+			for _, h := range target.hypertables {
+				live, err := target.repo.GetHypertable(ctx, h.table)
+				if err != nil {
+					return err
+				}
+				if live != nil {
+					continue
+				}
+				target.logger.Info("Converting table to a hypertable", zap.String("table", h.table))
+				if err := target.repo.CreateHypertable(ctx, h.table, h.timeColumn, h.chunkInterval, true); err != nil {
+					return fmt.Errorf("failed to convert %s: %w", h.table, err)
+				}
+				target.logger.Info("Converted table to a hypertable", zap.String("table", h.table))
+				converted++
+			}
+			if converted == 0 {
+				return nil
+			}
+			return target.reconcile(ctx)
+		})
+		return err
+	})
+}
+
+func (r *reconciler) Start() {
+	if len(r.hypertables) == 0 || r.dryRun {
+		close(r.done)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go func() {
+		defer close(r.done)
+		if err := r.migrate(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Error("Failed to convert tables to hypertables", zap.Error(err))
+		}
+	}()
+}
+
+func (r *reconciler) Stop() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *reconciler) reconcile(ctx context.Context) error {
+	version, err := r.repo.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		return errors.New("timescale config is set but the timescaledb extension is not installed")
+	}
+
+	drift, deferred := 0, false
+	for _, h := range r.hypertables {
+		n, err := r.reconcileHypertable(ctx, h)
+		drift += n
+		if errors.Is(err, errDeferred) {
+			deferred = true
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reconcile hypertable %s: %w", h.table, err)
+		}
+	}
+	// Continuous aggregates may be defined over a table still waiting to
+	// become a hypertable; they follow once it is converted.
+	aggregates := r.aggregates
+	if deferred {
+		aggregates = nil
+	}
+	for _, a := range aggregates {
+		n, err := r.reconcileAggregate(ctx, a)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile continuous aggregate %s: %w", a.name, err)
+		}
+		drift += n
+	}
+
+	r.logger.Info("Reconciled TimescaleDB settings",
+		zap.String("version", version),
+		zap.Int("drift", drift),
+		zap.Bool("dryRun", r.dryRun))
+	return nil
+}
+
+func (r *reconciler) reconcileHypertable(ctx context.Context, h hypertable) (int, error) {
+	live, err := r.repo.GetHypertable(ctx, h.table)
+	if err != nil {
+		return 0, err
+	}
+
+	drift := 0
+	if live == nil {
+		drift++
+		r.report(h.table, "hypertable", "none", h.timeColumn)
+		if !r.dryRun {
+			// Moving existing rows into chunks locks the table for as long
+			// as the copy takes, so that is left to Start.
+			hasRows, err := r.repo.HasRows(ctx, h.table)
+			if err != nil {
+				return drift, err
+			}
+			if hasRows {
+				r.logger.Warn("Table has rows and is converted to a hypertable in the background",
+					zap.String("table", h.table))
+				return drift, errDeferred
+			}
+			if err := r.repo.CreateHypertable(ctx, h.table, h.timeColumn, h.chunkInterval, false); err != nil {
+				return drift, err
+			}
+		}
+		live = &model.Hypertable{Table: h.table, TimeColumn: h.timeColumn, ChunkInterval: h.chunkInterval}
+	}
+
+	if live.TimeColumn != h.timeColumn {
+		// The partitioning column cannot be changed in place.
+		drift++
+		r.report(h.table, "time_column", live.TimeColumn, h.timeColumn)
+	}
+
+	if live.ChunkInterval != h.chunkInterval {
+		drift++
+		r.report(h.table, "chunk_interval", live.ChunkInterval.String(), h.chunkInterval.String())
+		r.apply(h.table, "chunk_interval", func() error {
+			return r.repo.SetChunkInterval(ctx, h.table, h.chunkInterval)
+		})
+	}
+
+	if h.compression && (!live.CompressionEnabled ||
+		strings.Join(live.SegmentBy, ", ") != strings.Join(h.segmentBy, ", ") || live.OrderBy != h.orderBy) {
+		drift++
+		r.report(h.table, "compression",
+			fmt.Sprintf("enabled=%t segment_by=[%s] order_by=[%s]", live.CompressionEnabled, strings.Join(live.SegmentBy, ", "), live.OrderBy),
+			fmt.Sprintf("enabled=true segment_by=[%s] order_by=[%s]", strings.Join(h.segmentBy, ", "), h.orderBy))
+		r.apply(h.table, "compression", func() error {
+			return r.repo.SetCompression(ctx, h.table, h.segmentBy, h.orderBy)
+		})
+	}
+
+	if h.compression {
+		n, err := r.reconcilePolicy(ctx, h.table, repository.PolicyCompression, h.compressAfter)
+		if err != nil {
+			return drift, err
+		}
+		drift += n
+	}
+
+	n, err := r.reconcilePolicy(ctx, h.table, repository.PolicyRetention, h.retention)
+	return drift + n, err
+}
+
+func (r *reconciler) reconcileAggregate(ctx context.Context, a continuousAggregate) (int, error) {
+	exists, err := r.repo.ContinuousAggregateExists(ctx, a.name)
+	if err != nil {
+		return 0, err
+	}
+
+	drift := 0
+	if !exists {
+		drift++
+		r.report(a.name, "continuous_aggregate", "none", "created")
+		if r.dryRun {
+			return drift, nil
+		}
+		if err := r.repo.CreateContinuousAggregate(ctx, a.name, a.query); err != nil {
+			return drift, err
+		}
+	}
+
+	if a.refresh != nil {
+		live, err := r.repo.GetRefreshPolicy(ctx, a.name)
+		if err != nil {
+			return drift, err
+		}
+		if live == nil || !sameRefresh(*live, *a.refresh) {
+			drift++
+			r.report(a.name, "refresh_policy", formatRefresh(live), formatRefresh(a.refresh))
+			r.apply(a.name, "refresh_policy", func() error {
+				return r.repo.SetRefreshPolicy(ctx, a.name, *a.refresh)
+			})
+		}
+	}
+
+	n, err := r.reconcilePolicy(ctx, a.name, repository.PolicyRetention, a.retention)
+	return drift + n, err
+}
+
+// reconcilePolicy makes a compression or retention policy match after; zero
+// means the policy should not exist.
+func (r *reconciler) reconcilePolicy(ctx context.Context, relation, policy string, after time.Duration) (int, error) {
+	live, err := r.repo.GetPolicy(ctx, relation, policy)
+	if err != nil {
+		return 0, err
+	}
+
+	var current time.Duration
+	if live != nil {
+		current = *live
+	}
+	if current == after {
+		return 0, nil
+	}
+
+	r.report(relation, policy+"_policy", formatInterval(live), formatInterval(&after))
+	r.apply(relation, policy+"_policy", func() error {
+		return r.repo.SetPolicy(ctx, relation, policy, after)
+	})
+	return 1, nil
+}
+
+func (r *reconciler) report(relation, setting, live, desired string) {
+	r.logger.Warn("TimescaleDB settings drifted from config",
+		zap.String("relation", relation),
+		zap.String("setting", setting),
+		zap.String("live", live),
+		zap.String("desired", desired))
+}
+
+// apply changes a setting unless running dry. Failures are logged rather
+// than returned: a setting TimescaleDB refuses to change, such as
+// compression on a table with compressed chunks, must not stop ingestion.
+func (r *reconciler) apply(relation, setting string, change func() error) {
+	if r.dryRun {
+		return
+	}
+	if err := change(); err != nil {
+		r.logger.Error("Failed to apply TimescaleDB setting",
+			zap.String("relation", relation),
+			zap.String("setting", setting),
+			zap.Error(err))
+	}
+}
+
+func sameRefresh(a, b model.RefreshPolicy) bool {
+	return a.ScheduleInterval == b.ScheduleInterval &&
+		sameOffset(a.StartOffset, b.StartOffset) && sameOffset(a.EndOffset, b.EndOffset)
+}
+
+func sameOffset(a, b *time.Duration) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func formatRefresh(p *model.RefreshPolicy) string {
+	if p == nil {
+		return "none"
+	}
+	return fmt.Sprintf("start=%s end=%s every=%s",
+		formatInterval(p.StartOffset), formatInterval(p.EndOffset), p.ScheduleInterval)
+}
+
+func formatInterval(d *time.Duration) string {
+	if d == nil || *d == 0 {
+		return "none"
+	}
+	return d.String()
+}
+
+// RunReconciler reconciles TimescaleDB settings before the pipeline starts
+// consuming and converts tables holding rows once it runs.
+func RunReconciler(lc fx.Lifecycle, r Reconciler) {
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			if err := r.Reconcile(ctx); err != nil {
+				return err
+			}
+			r.Start()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			r.Stop()
+			return nil
+		},
+	})
+}
@@ -0,0 +1,99 @@
+package timescale
+
+import (
+	"context"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/pkg/logger"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeTimescale has no hypertables yet; tables listed in rows hold data.
+type fakeTimescale struct {
+	repository.Timescale
+	rows  map[string]bool
+	calls []string
+}
+
+func (f *fakeTimescale) Version(context.Context) (string, error) { return "2.14.0", nil }
+
+func (f *fakeTimescale) GetHypertable(context.Context, string) (*model.Hypertable, error) {
+	return nil, nil
+}
+
+func (f *fakeTimescale) HasRows(_ context.Context, table string) (bool, error) {
+	return f.rows[table], nil
+}
+
+func (f *fakeTimescale) CreateHypertable(_ context.Context, table, _ string, _ time.Duration, migrateData bool) error {
+	if migrateData {
+		f.calls = append(f.calls, "migrate "+table)
+	} else {
+		f.calls = append(f.calls, "create "+table)
+	}
+	return nil
+}
+
+func (f *fakeTimescale) GetPolicy(context.Context, string, string) (*time.Duration, error) {
+	return nil, nil
+}
+
+func (f *fakeTimescale) SetPolicy(_ context.Context, relation, policy string, _ time.Duration) error {
+	f.calls = append(f.calls, policy+" "+relation)
+	return nil
+}
+
+func (f *fakeTimescale) ContinuousAggregateExists(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeTimescale) CreateContinuousAggregate(_ context.Context, view, _ string) error {
+	f.calls = append(f.calls, "aggregate "+view)
+	return nil
+}
+
+func testReconciler(t *testing.T, repo *fakeTimescale) *reconciler {
+	t.Helper()
+	r := &reconciler{repo: repo, logger: logger.NewNop()}
+	for _, h := range []Hypertable{
+		{Table: "empty", TimeColumn: "ts", ChunkInterval: "1d", Retention: "30d"},
+		{Table: "full", TimeColumn: "ts", ChunkInterval: "1d", Retention: "30d"},
+	} {
+		compiled, err := compileHypertable(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.hypertables = append(r.hypertables, compiled)
+	}
+	compiled, err := compileAggregate(ContinuousAggregate{Name: "full_hourly", Query: "SELECT 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.aggregates = append(r.aggregates, compiled)
+	return r
+}
+
+func TestReconcileDefersTablesWithRows(t *testing.T) {
+	repo := &fakeTimescale{rows: map[string]bool{"full": true}}
+	if err := testReconciler(t, repo).reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// full keeps its rows where they are and its aggregate waits for it.
+	want := []string{"create empty", "retention empty"}
+	if !reflect.DeepEqual(repo.calls, want) {
+		t.Fatalf("calls = %q, want %q", repo.calls, want)
+	}
+}
+
+func TestReconcileCreatesEmptyTables(t *testing.T) {
+	repo := &fakeTimescale{}
+	if err := testReconciler(t, repo).reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"create empty", "retention empty", "create full", "retention full", "aggregate full_hourly"}
+	if !reflect.DeepEqual(repo.calls, want) {
+		t.Fatalf("calls = %q, want %q", repo.calls, want)
+	}
+}
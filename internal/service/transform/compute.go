@@ -0,0 +1,143 @@
+package transform
+
+import (
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/expr"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExpressionFile is the YAML document loaded from TRANSFORM_EXPRESSIONS_PATH.
+type ExpressionFile struct {
+	ComputedFields []ExpressionSet `yaml:"computed_fields"`
+}
+
+// ExpressionSet lists derived fields for one tenant and device type.
+type ExpressionSet struct {
+	Tenant     string            `yaml:"tenant"`
+	DeviceType string            `yaml:"device_type"`
+	Fields     []ExpressionField `yaml:"fields"`
+}
+
+type ExpressionField struct {
+	Name string `yaml:"name"`
+	Expr string `yaml:"expr"`
+}
+
+// FieldError reports a computed field that could not be evaluated. The
+// remaining fields of the record are still computed.
+type FieldError struct {
+	Field string
+	Expr  string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("computed field %s (%s): %v", e.Field, e.Expr, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type Computer interface {
+	Compute(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, []*FieldError)
+}
+
+type computedField struct {
+	name    string
+	program *expr.Program
+}
+
+type compiledExpressionSet struct {
+	extract.Selector
+	fields []computedField
+}
+
+type computer struct {
+	sets []compiledExpressionSet
+}
+
+func NewComputer(config *config.Config) (Computer, error) {
+	if config.Transform.ExpressionsPath == "" {
+		return &computer{}, nil
+	}
+
+	content, err := os.ReadFile(config.Transform.ExpressionsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read computed fields: %w", err)
+	}
+
+	var file ExpressionFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse computed fields: %w", err)
+	}
+	return CompileExpressions(&file)
+}
+
+// CompileExpressions compiles every expression once so evaluation at ingest
+// time never has to parse.
+func CompileExpressions(file *ExpressionFile) (Computer, error) {
+	c := &computer{}
+	seen := make(extract.Selectors)
+
+	for i, set := range file.ComputedFields {
+		sel := extract.NewSelector(set.Tenant, set.DeviceType)
+		if err := seen.Add(sel); err != nil {
+			return nil, fmt.Errorf("computed_fields[%d]: %w", i, err)
+		}
+
+		compiled := compiledExpressionSet{Selector: sel}
+		for j, field := range set.Fields {
+			if field.Name == "" {
+				return nil, fmt.Errorf("computed_fields[%d].fields[%d]: missing name", i, j)
+			}
+			program, err := expr.Compile(field.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("computed_fields[%d].fields[%d] (%s): %w", i, j, field.Name, err)
+			}
+			compiled.fields = append(compiled.fields, computedField{name: field.Name, program: program})
+		}
+		c.sets = append(c.sets, compiled)
+	}
+
+	return c, nil
+}
+
+// Compute evaluates the matching expression set in order, so later fields
+// can refer to earlier ones. A null result leaves the field unset.
+func (c *computer) Compute(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, []*FieldError) {
+	set := c.match(identity)
+	if set == nil {
+		return data, nil
+	}
+
+	var errs []*FieldError
+	for _, field := range set.fields {
+		value, err := field.program.Eval(data)
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field.name, Expr: field.program.Source(), Err: err})
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		if !util.SetPath(data, field.name, value) {
+			errs = append(errs, &FieldError{
+				Field: field.name,
+				Expr:  field.program.Source(),
+				Err:   errors.New("target parent is not an object"),
+			})
+		}
+	}
+	return data, errs
+}
+
+func (c *computer) match(identity extract.Identity) *compiledExpressionSet {
+	return extract.BestMatch(identity, c.sets)
+}
@@ -0,0 +1,113 @@
+package transform
+
+import (
+	"etl-pipeline/config"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// ArraysIndex flattens array elements into <key><sep><index> fields.
+	ArraysIndex = "index"
+	// ArraysJSON keeps arrays as a single JSON value.
+	ArraysJSON = "json"
+)
+
+type Flattener interface {
+	Flatten(data map[string]interface{}) (map[string]interface{}, error)
+}
+
+type flattener struct {
+	enabled   bool
+	separator string
+	maxDepth  int
+	arrays    string
+	keyCase   string
+}
+
+func NewFlattener(config *config.Config) (Flattener, error) {
+	cfg := config.Transform
+	if cfg.FlattenArrays != ArraysIndex && cfg.FlattenArrays != ArraysJSON {
+		return nil, fmt.Errorf("unsupported flatten array mode %q", cfg.FlattenArrays)
+	}
+	if !util.ValidKeyCase(cfg.FlattenKeyCase) {
+		return nil, fmt.Errorf("unsupported flatten key case %q", cfg.FlattenKeyCase)
+	}
+	if cfg.FlattenSeparator == "" {
+		return nil, fmt.Errorf("flatten separator must not be empty")
+	}
+	if cfg.FlattenMaxDepth < 0 {
+		return nil, fmt.Errorf("flatten max depth must not be negative")
+	}
+
+	return &flattener{
+		enabled:   cfg.Flatten,
+		separator: cfg.FlattenSeparator,
+		maxDepth:  cfg.FlattenMaxDepth,
+		arrays:    cfg.FlattenArrays,
+		keyCase:   cfg.FlattenKeyCase,
+	}, nil
+}
+
+// Flatten turns nested objects into top-level keys joined by the separator.
+// Objects below the depth limit are kept as nested JSON values; a depth of 0
+// means unlimited. Two source paths mapping to the same key is an error
+// rather than a silent overwrite.
+func (f *flattener) Flatten(data map[string]interface{}) (map[string]interface{}, error) {
+	if !f.enabled {
+		return data, nil
+	}
+
+	result := make(map[string]interface{}, len(data))
+	if err := f.flattenMap(result, "", data, 1); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *flattener) flattenMap(result map[string]interface{}, prefix string, data map[string]interface{}, depth int) error {
+	for k, v := range data {
+		key, err := util.ConvertKeyCase(k, f.keyCase)
+		if err != nil {
+			return err
+		}
+		if err := f.flattenValue(result, f.join(prefix, key), v, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *flattener) flattenValue(result map[string]interface{}, key string, value interface{}, depth int) error {
+	canDescend := f.maxDepth == 0 || depth < f.maxDepth
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if canDescend && len(v) > 0 {
+			return f.flattenMap(result, key, v, depth+1)
+		}
+	case []interface{}:
+		if canDescend && f.arrays == ArraysIndex && len(v) > 0 {
+			for i, item := range v {
+				if err := f.flattenValue(result, f.join(key, strconv.Itoa(i)), item, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if _, exists := result[key]; exists {
+		return fmt.Errorf("flattened key %q is produced by more than one field", key)
+	}
+	result[key] = value
+	return nil
+}
+
+func (f *flattener) join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + f.separator + key
+}
@@ -0,0 +1,82 @@
+package transform
+
+import (
+	"etl-pipeline/config"
+	"etl-pipeline/pkg/util"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestFlattener(t *testing.T, cfg config.TransformConfig) Flattener {
+	t.Helper()
+	cfg.Flatten = true
+	if cfg.FlattenSeparator == "" {
+		cfg.FlattenSeparator = "_"
+	}
+	if cfg.FlattenArrays == "" {
+		cfg.FlattenArrays = ArraysJSON
+	}
+	if cfg.FlattenKeyCase == "" {
+		cfg.FlattenKeyCase = util.KeyCaseKeep
+	}
+	f, err := NewFlattener(&config.Config{Transform: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFlatten(t *testing.T) {
+	data := func() map[string]interface{} {
+		return map[string]interface{}{
+			"phase": map[string]interface{}{"L1": map[string]interface{}{"V": 230}},
+			"tags":  []interface{}{"a", map[string]interface{}{"b": 1}},
+			"empty": map[string]interface{}{},
+		}
+	}
+	tests := []struct {
+		name string
+		cfg  config.TransformConfig
+		want map[string]interface{}
+	}{
+		{"defaults", config.TransformConfig{}, map[string]interface{}{
+			"phase_L1_V": 230,
+			"tags":       []interface{}{"a", map[string]interface{}{"b": 1}},
+			"empty":      map[string]interface{}{},
+		}},
+		{"indexed arrays", config.TransformConfig{FlattenArrays: ArraysIndex, FlattenSeparator: "."}, map[string]interface{}{
+			"phase.L1.V": 230,
+			"tags.0":     "a",
+			"tags.1.b":   1,
+			"empty":      map[string]interface{}{},
+		}},
+		{"depth limit", config.TransformConfig{FlattenMaxDepth: 2, FlattenKeyCase: util.KeyCaseLower}, map[string]interface{}{
+			"phase_l1": map[string]interface{}{"V": 230},
+			"tags":     []interface{}{"a", map[string]interface{}{"b": 1}},
+			"empty":    map[string]interface{}{},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTestFlattener(t, tt.cfg).Flatten(data())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlattenRejectsCollisions(t *testing.T) {
+	f := newTestFlattener(t, config.TransformConfig{})
+	_, err := f.Flatten(map[string]interface{}{
+		"a":   map[string]interface{}{"b": 1},
+		"a_b": 2,
+	})
+	if err == nil || !strings.Contains(err.Error(), "more than one field") {
+		t.Fatalf("got %v, want a collision error", err)
+	}
+}
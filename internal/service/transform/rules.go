@@ -0,0 +1,359 @@
+package transform
+
+import (
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OpRename    = "rename"
+	OpDrop      = "drop"
+	OpDropNulls = "drop_nulls"
+	OpCast      = "cast"
+	OpDefault   = "default"
+	OpCase      = "case"
+	OpMove      = "move"
+	OpWhitelist = "whitelist"
+	OpBlacklist = "blacklist"
+
+	CastInt    = "int"
+	CastFloat  = "float"
+	CastString = "string"
+	CastBool   = "bool"
+)
+
+// RuleFile is the YAML document loaded from TRANSFORM_RULES_PATH.
+type RuleFile struct {
+	RuleSets []RuleSet `yaml:"rule_sets"`
+}
+
+// RuleSet is an ordered list of rules applied to one tenant and device type.
+type RuleSet struct {
+	Name       string `yaml:"name"`
+	Tenant     string `yaml:"tenant"`
+	DeviceType string `yaml:"device_type"`
+	Rules      []Rule `yaml:"rules"`
+}
+
+// Rule is a single declarative operation. Which fields are used depends on Op.
+type Rule struct {
+	Op     string      `yaml:"op"`
+	Field  string      `yaml:"field"`
+	From   string      `yaml:"from"`
+	To     string      `yaml:"to"`
+	Fields []string    `yaml:"fields"`
+	Type   string      `yaml:"type"`
+	Value  interface{} `yaml:"value"`
+	Case   string      `yaml:"case"`
+}
+
+type RuleEngine interface {
+	Apply(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error)
+}
+
+type ruleFunc func(data map[string]interface{}) (map[string]interface{}, error)
+
+type compiledRuleSet struct {
+	name string
+	extract.Selector
+	rules []ruleFunc
+}
+
+type ruleEngine struct {
+	sets []compiledRuleSet
+}
+
+func NewRuleEngine(config *config.Config) (RuleEngine, error) {
+	if config.Transform.RulesPath == "" {
+		return &ruleEngine{}, nil
+	}
+
+	file, err := LoadRuleFile(config.Transform.RulesPath)
+	if err != nil {
+		return nil, err
+	}
+	return CompileRules(file)
+}
+
+// LoadRuleFile reads and parses a rule file without compiling it.
+func LoadRuleFile(path string) (*RuleFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transform rules: %w", err)
+	}
+
+	var file RuleFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse transform rules: %w", err)
+	}
+	return &file, nil
+}
+
+// CompileRules validates every rule set and returns an engine for them.
+func CompileRules(file *RuleFile) (RuleEngine, error) {
+	engine := &ruleEngine{}
+	seen := make(extract.Selectors)
+
+	for i, set := range file.RuleSets {
+		name := set.Name
+		if name == "" {
+			name = fmt.Sprintf("rule_sets[%d]", i)
+		}
+
+		sel := extract.NewSelector(set.Tenant, set.DeviceType)
+		if err := seen.Add(sel); err != nil {
+			return nil, fmt.Errorf("rule set %s: %w", name, err)
+		}
+
+		compiled := compiledRuleSet{name: name, Selector: sel}
+		for j, rule := range set.Rules {
+			fn, err := compileRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("rule set %s: rules[%d] (%s): %w", name, j, rule.Op, err)
+			}
+			compiled.rules = append(compiled.rules, fn)
+		}
+		engine.sets = append(engine.sets, compiled)
+	}
+
+	return engine, nil
+}
+
+// Apply runs the most specific rule set matching the identity. Exact tenant
+// matches win over exact device type matches, which win over wildcards.
+func (e *ruleEngine) Apply(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error) {
+	set := e.match(identity)
+	if set == nil {
+		return data, nil
+	}
+
+	var err error
+	for _, rule := range set.rules {
+		data, err = rule(data)
+		if err != nil {
+			return nil, fmt.Errorf("rule set %s: %w", set.name, err)
+		}
+	}
+	return data, nil
+}
+
+func (e *ruleEngine) match(identity extract.Identity) *compiledRuleSet {
+	return extract.BestMatch(identity, e.sets)
+}
+
+func compileRule(rule Rule) (ruleFunc, error) {
+	switch rule.Op {
+	case OpRename:
+		if rule.From == "" || rule.To == "" {
+			return nil, errors.New("rename requires from and to")
+		}
+		if strings.Contains(rule.To, ".") {
+			return nil, errors.New("rename target must be a key name, use move for paths")
+		}
+		return renameRule(rule.From, rule.To), nil
+	case OpMove:
+		if rule.From == "" || rule.To == "" {
+			return nil, errors.New("move requires from and to")
+		}
+		return moveRule(rule.From, rule.To), nil
+	case OpDrop, OpBlacklist:
+		if len(rule.Fields) == 0 {
+			return nil, fmt.Errorf("%s requires fields", rule.Op)
+		}
+		return dropRule(rule.Fields), nil
+	case OpDropNulls:
+		return dropNullsRule, nil
+	case OpWhitelist:
+		if len(rule.Fields) == 0 {
+			return nil, errors.New("whitelist requires fields")
+		}
+		return whitelistRule(rule.Fields), nil
+	case OpCast:
+		if rule.Field == "" {
+			return nil, errors.New("cast requires field")
+		}
+		switch rule.Type {
+		case CastInt, CastFloat, CastString, CastBool:
+		default:
+			return nil, fmt.Errorf("unsupported cast type %q", rule.Type)
+		}
+		return castRule(rule.Field, rule.Type), nil
+	case OpDefault:
+		if rule.Field == "" {
+			return nil, errors.New("default requires field")
+		}
+		if rule.Value == nil {
+			return nil, errors.New("default requires value")
+		}
+		return defaultRule(rule.Field, rule.Value), nil
+	case OpCase:
+		if !util.ValidKeyCase(rule.Case) {
+			return nil, fmt.Errorf("unsupported case %q", rule.Case)
+		}
+		return caseRule(rule.Case), nil
+	case "":
+		return nil, errors.New("missing op")
+	}
+	return nil, fmt.Errorf("unknown op %q", rule.Op)
+}
+
+func renameRule(from, to string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		value, ok := util.DeletePath(data, from)
+		if !ok {
+			return data, nil
+		}
+		segments := util.SplitPath(from)
+		segments[len(segments)-1] = to
+		util.SetPath(data, strings.Join(segments, "."), value)
+		return data, nil
+	}
+}
+
+func moveRule(from, to string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		value, ok := util.DeletePath(data, from)
+		if !ok {
+			return data, nil
+		}
+		if !util.SetPath(data, to, value) {
+			return nil, fmt.Errorf("cannot move %s to %s: target parent is not an object", from, to)
+		}
+		return data, nil
+	}
+}
+
+func dropRule(fields []string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		for _, field := range fields {
+			util.DeletePath(data, field)
+		}
+		return data, nil
+	}
+}
+
+func dropNullsRule(data map[string]interface{}) (map[string]interface{}, error) {
+	for k, v := range data {
+		if v == nil {
+			delete(data, k)
+		}
+	}
+	return data, nil
+}
+
+func whitelistRule(fields []string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		result := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if value, ok := util.GetPath(data, field); ok {
+				util.SetPath(result, field, value)
+			}
+		}
+		return result, nil
+	}
+}
+
+func castRule(field, typ string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		value, ok := util.GetPath(data, field)
+		if !ok || value == nil {
+			return data, nil
+		}
+		cast, err := castValue(value, typ)
+		if err != nil {
+			return nil, fmt.Errorf("cast %s to %s: %w", field, typ, err)
+		}
+		util.SetPath(data, field, cast)
+		return data, nil
+	}
+}
+
+func castValue(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case CastInt:
+		return util.ToInt64(value)
+	case CastFloat:
+		return util.ToFloat64(value)
+	case CastString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return fmt.Sprint(value), nil
+	case CastBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(v))
+		}
+		f, err := util.ToFloat64(value)
+		if err != nil {
+			return nil, err
+		}
+		return f != 0, nil
+	}
+	return nil, fmt.Errorf("unsupported cast type %q", typ)
+}
+
+func defaultRule(field string, value interface{}) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		if current, ok := util.GetPath(data, field); ok && current != nil {
+			return data, nil
+		}
+		util.SetPath(data, field, value)
+		return data, nil
+	}
+}
+
+func caseRule(style string) ruleFunc {
+	return func(data map[string]interface{}) (map[string]interface{}, error) {
+		return convertKeys(data, style)
+	}
+}
+
+// convertKeys converts every key of data, including those of nested
+// objects. Two keys converting to the same one, such as fooBar and foo_bar,
+// are an error rather than one silently replacing the other.
+func convertKeys(data map[string]interface{}, style string) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		key, _ := util.ConvertKeyCase(k, style)
+		if _, exists := result[key]; exists {
+			return nil, fmt.Errorf("converted key %q is produced by more than one field", key)
+		}
+		converted, err := convertNested(v, style)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = converted
+	}
+	return result, nil
+}
+
+// convertNested converts the keys of objects nested in v, including
+// objects inside arrays.
+func convertNested(v interface{}, style string) (interface{}, error) {
+	switch child := v.(type) {
+	case map[string]interface{}:
+		return convertKeys(child, style)
+	case []interface{}:
+		result := make([]interface{}, len(child))
+		for i, item := range child {
+			converted, err := convertNested(item, style)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	}
+	return v, nil
+}
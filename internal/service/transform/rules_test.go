@@ -0,0 +1,271 @@
+package transform
+
+import (
+	"encoding/json"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/util"
+	"strings"
+	"testing"
+)
+
+var testIdentity = extract.Identity{TenantId: "acme", DeviceId: "meter-1", DeviceType: "meter"}
+
+func applyRules(t *testing.T, rules []Rule, input string) (string, error) {
+	t.Helper()
+	engine, err := CompileRules(&RuleFile{RuleSets: []RuleSet{{Name: "test", Rules: rules}}})
+	if err != nil {
+		t.Fatalf("CompileRules: %v", err)
+	}
+
+	var data map[string]interface{}
+	if err := util.UnmarshalJSON([]byte(input), &data); err != nil {
+		t.Fatal(err)
+	}
+	result, err := engine.Apply(testIdentity, data)
+	if err != nil {
+		return "", err
+	}
+	output, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), nil
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		input string
+		want  string
+	}{
+		{
+			name:  "rename top level",
+			rules: []Rule{{Op: OpRename, From: "temp", To: "temperature"}},
+			input: `{"temp":21.5,"hum":40}`,
+			want:  `{"hum":40,"temperature":21.5}`,
+		},
+		{
+			name:  "rename nested keeps parent",
+			rules: []Rule{{Op: OpRename, From: "env.temp", To: "temperature"}},
+			input: `{"env":{"temp":21.5}}`,
+			want:  `{"env":{"temperature":21.5}}`,
+		},
+		{
+			name:  "rename missing field",
+			rules: []Rule{{Op: OpRename, From: "temp", To: "temperature"}},
+			input: `{"hum":40}`,
+			want:  `{"hum":40}`,
+		},
+		{
+			name:  "move into new object",
+			rules: []Rule{{Op: OpMove, From: "temp", To: "env.temperature"}},
+			input: `{"temp":21.5}`,
+			want:  `{"env":{"temperature":21.5}}`,
+		},
+		{
+			name:  "move out of object",
+			rules: []Rule{{Op: OpMove, From: "env.temp", To: "temp"}},
+			input: `{"env":{"temp":21.5,"hum":40}}`,
+			want:  `{"env":{"hum":40},"temp":21.5}`,
+		},
+		{
+			name:  "drop",
+			rules: []Rule{{Op: OpDrop, Fields: []string{"debug", "env.raw"}}},
+			input: `{"debug":"x","env":{"raw":"y","temp":1},"hum":40}`,
+			want:  `{"env":{"temp":1},"hum":40}`,
+		},
+		{
+			name:  "blacklist",
+			rules: []Rule{{Op: OpBlacklist, Fields: []string{"secret"}}},
+			input: `{"secret":"s","temp":1}`,
+			want:  `{"temp":1}`,
+		},
+		{
+			name:  "whitelist",
+			rules: []Rule{{Op: OpWhitelist, Fields: []string{"temp", "env.hum", "missing"}}},
+			input: `{"temp":1,"env":{"hum":40,"raw":"y"},"other":2}`,
+			want:  `{"env":{"hum":40},"temp":1}`,
+		},
+		{
+			name:  "drop nulls",
+			rules: []Rule{{Op: OpDropNulls}},
+			input: `{"temp":null,"hum":40}`,
+			want:  `{"hum":40}`,
+		},
+		{
+			name:  "cast to int truncates",
+			rules: []Rule{{Op: OpCast, Field: "count", Type: CastInt}},
+			input: `{"count":"12.7"}`,
+			want:  `{"count":12}`,
+		},
+		{
+			name:  "cast to float",
+			rules: []Rule{{Op: OpCast, Field: "env.temp", Type: CastFloat}},
+			input: `{"env":{"temp":"21.5"}}`,
+			want:  `{"env":{"temp":21.5}}`,
+		},
+		{
+			name:  "cast to string",
+			rules: []Rule{{Op: OpCast, Field: "serial", Type: CastString}},
+			input: `{"serial":12345678901234567890}`,
+			want:  `{"serial":"12345678901234567890"}`,
+		},
+		{
+			name:  "cast to bool",
+			rules: []Rule{{Op: OpCast, Field: "on", Type: CastBool}, {Op: OpCast, Field: "off", Type: CastBool}},
+			input: `{"on":"true","off":0}`,
+			want:  `{"off":false,"on":true}`,
+		},
+		{
+			name:  "cast skips null",
+			rules: []Rule{{Op: OpCast, Field: "count", Type: CastInt}},
+			input: `{"count":null}`,
+			want:  `{"count":null}`,
+		},
+		{
+			name:  "default fills missing and null",
+			rules: []Rule{{Op: OpDefault, Field: "unit", Value: "C"}, {Op: OpDefault, Field: "env.hum", Value: 0}},
+			input: `{"env":{"hum":null}}`,
+			want:  `{"env":{"hum":0},"unit":"C"}`,
+		},
+		{
+			name:  "default keeps value",
+			rules: []Rule{{Op: OpDefault, Field: "unit", Value: "C"}},
+			input: `{"unit":"F"}`,
+			want:  `{"unit":"F"}`,
+		},
+		{
+			name:  "case snake",
+			rules: []Rule{{Op: OpCase, Case: util.KeyCaseSnake}},
+			input: `{"powerFactor":1,"phaseData":{"lineVoltage":230}}`,
+			want:  `{"phase_data":{"line_voltage":230},"power_factor":1}`,
+		},
+		{
+			name:  "case converts objects in arrays",
+			rules: []Rule{{Op: OpCase, Case: util.KeyCaseSnake}},
+			input: `{"phaseList":[{"lineVoltage":230},[{"maxCurrent":16}],"rawValue"]}`,
+			want:  `{"phase_list":[{"line_voltage":230},[{"max_current":16}],"rawValue"]}`,
+		},
+		{
+			name:  "case lower",
+			rules: []Rule{{Op: OpCase, Case: util.KeyCaseLower}},
+			input: `{"Temp":1}`,
+			want:  `{"temp":1}`,
+		},
+		{
+			name: "rules run in order",
+			rules: []Rule{
+				{Op: OpRename, From: "t", To: "temp"},
+				{Op: OpCast, Field: "temp", Type: CastFloat},
+				{Op: OpWhitelist, Fields: []string{"temp"}},
+			},
+			input: `{"t":"21","junk":1}`,
+			want:  `{"temp":21}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyRules(t, tt.rules, tt.input)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Apply = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		input string
+		want  string
+	}{
+		{"cast invalid int", []Rule{{Op: OpCast, Field: "count", Type: CastInt}}, `{"count":"abc"}`, "cast count to int"},
+		{"cast int out of range", []Rule{{Op: OpCast, Field: "count", Type: CastInt}}, `{"count":18446744073709551615}`, "out of int64 range"},
+		{"move below scalar", []Rule{{Op: OpMove, From: "temp", To: "unit.value"}}, `{"temp":1,"unit":"C"}`, "target parent is not an object"},
+		{"case collision", []Rule{{Op: OpCase, Case: util.KeyCaseSnake}}, `{"fooBar":1,"foo_bar":2}`, `converted key "foo_bar" is produced by more than one field`},
+		{"nested case collision", []Rule{{Op: OpCase, Case: util.KeyCaseLower}}, `{"meta":[{"Id":1,"ID":2}]}`, `converted key "id"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := applyRules(t, tt.rules, tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Apply error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file RuleFile
+		want string
+	}{
+		{"missing op", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{}}}}}, "missing op"},
+		{"unknown op", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: "explode"}}}}}, "unknown op"},
+		{"rename path target", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpRename, From: "a", To: "b.c"}}}}}, "use move"},
+		{"drop without fields", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpDrop}}}}}, "requires fields"},
+		{"whitelist without fields", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpWhitelist}}}}}, "requires fields"},
+		{"cast unknown type", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpCast, Field: "a", Type: "date"}}}}}, "unsupported cast type"},
+		{"default without value", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpDefault, Field: "a"}}}}}, "requires value"},
+		{"unknown case", RuleFile{RuleSets: []RuleSet{{Rules: []Rule{{Op: OpCase, Case: "kebab"}}}}}, "unsupported case"},
+		{"duplicate selector", RuleFile{RuleSets: []RuleSet{{Tenant: "acme"}, {Tenant: "acme", DeviceType: "*"}}}, "duplicate selector"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileRules(&tt.file)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("CompileRules error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetPrecedence(t *testing.T) {
+	tag := func(name string) []Rule {
+		return []Rule{{Op: OpDefault, Field: "set", Value: name}}
+	}
+	all := []RuleSet{
+		{Name: "wildcard", Rules: tag("wildcard")},
+		{Name: "device type", DeviceType: "meter", Rules: tag("device type")},
+		{Name: "tenant", Tenant: "acme", Rules: tag("tenant")},
+		{Name: "tenant and device type", Tenant: "acme", DeviceType: "meter", Rules: tag("tenant and device type")},
+		{Name: "other tenant", Tenant: "globex", DeviceType: "meter", Rules: tag("other tenant")},
+	}
+
+	tests := []struct {
+		name     string
+		sets     []RuleSet
+		identity extract.Identity
+		want     string
+	}{
+		{"exact beats everything", all, testIdentity, "tenant and device type"},
+		{"tenant beats device type", all[:3], testIdentity, "tenant"},
+		{"device type beats wildcard", all[:2], testIdentity, "device type"},
+		{"wildcard matches any identity", all[:1], extract.Identity{TenantId: "initech", DeviceType: "pump"}, "wildcard"},
+		{"other device type falls back to tenant", all, extract.Identity{TenantId: "acme", DeviceType: "pump"}, "tenant"},
+		{"other tenant falls back to device type", all[:4], extract.Identity{TenantId: "initech", DeviceType: "meter"}, "device type"},
+		{"no match leaves data alone", all[4:], testIdentity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine, err := CompileRules(&RuleFile{RuleSets: tt.sets})
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := engine.Apply(tt.identity, map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := result["set"].(string)
+			if got != tt.want {
+				t.Fatalf("matched rule set %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
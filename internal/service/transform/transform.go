@@ -18,7 +18,7 @@ type transform struct {
 // transform implements Transform.
 func (t *transform) Transform(input []byte) (time.Time, map[string]interface{}, error) {
 	var raw rawData
-	if err := json.Unmarshal(input, &raw); err != nil {
+	if err := util.UnmarshalJSON(input, &raw); err != nil {
 		return time.Time{}, nil, errors.New("failed to unmarshal RawData: " + err.Error())
 	}
 
@@ -31,7 +31,7 @@ func (t *transform) Transform(input []byte) (time.Time, map[string]interface{},
 	}
 
 	var data map[string]interface{}
-	if err := json.Unmarshal(raw.Data, &data); err != nil {
+	if err := util.UnmarshalJSON(raw.Data, &data); err != nil {
 		return time.Time{}, nil, errors.New("failed to unmarshal 'data' field: " + err.Error())
 	}
 
@@ -0,0 +1,40 @@
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"etl-pipeline/pkg/util"
+	"testing"
+)
+
+func TestTransformKeepsLargeCounters(t *testing.T) {
+	input := `{"timestamp":"2024-01-01T00:00:00Z","data":{"energy_total":9007199254740993,"pulse_count":18446744073709551615}}`
+
+	_, data, err := NewTransform().Transform([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"energyTotal":9007199254740993,"pulseCount":18446744073709551615}`
+	if string(output) != want {
+		t.Fatalf("Transform = %s, want %s", output, want)
+	}
+}
+
+func TestCastIntKeepsLargeCounters(t *testing.T) {
+	var data map[string]interface{}
+	if err := util.UnmarshalJSON([]byte(`{"big":9007199254740993,"max":18446744073709551615}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := castValue(data["big"], CastInt)
+	if err != nil || got != int64(9007199254740993) {
+		t.Fatalf("cast big = %v, %v", got, err)
+	}
+	if _, err := castValue(data["max"], CastInt); !errors.Is(err, util.ErrIntRange) {
+		t.Fatalf("cast max error = %v, want %v", err, util.ErrIntRange)
+	}
+}
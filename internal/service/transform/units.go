@@ -0,0 +1,322 @@
+package transform
+
+import (
+	"etl-pipeline/config"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OriginalUnitsKey holds the unit each normalized field was reported in when
+// record_original is enabled.
+const OriginalUnitsKey = "_original_units"
+
+// unit converts a value to the canonical unit of its dimension:
+// canonical = value*scale + offset.
+type unit struct {
+	name      string
+	dimension string
+	canonical string
+	scale     *big.Rat
+	offset    *big.Rat
+}
+
+func newUnit(dimension, canonical, scale, offset string) unit {
+	s, _ := new(big.Rat).SetString(scale)
+	o, _ := new(big.Rat).SetString(offset)
+	return unit{dimension: dimension, canonical: canonical, scale: s, offset: o}
+}
+
+// units maps unit symbols to conversions. Canonical units are Wh for
+// energy, W for power, °C for temperature, and the plain SI unit otherwise.
+// Symbols are case-sensitive: mW is a milliwatt, MW a megawatt.
+var units = map[string]unit{
+	"Wh":   newUnit("energy", "Wh", "1", "0"),
+	"kWh":  newUnit("energy", "Wh", "1000", "0"),
+	"MWh":  newUnit("energy", "Wh", "1000000", "0"),
+	"GWh":  newUnit("energy", "Wh", "1000000000", "0"),
+	"J":    newUnit("energy", "Wh", "1/3600", "0"),
+	"kJ":   newUnit("energy", "Wh", "1000/3600", "0"),
+	"mW":   newUnit("power", "W", "1/1000", "0"),
+	"W":    newUnit("power", "W", "1", "0"),
+	"kW":   newUnit("power", "W", "1000", "0"),
+	"MW":   newUnit("power", "W", "1000000", "0"),
+	"var":  newUnit("reactive_power", "var", "1", "0"),
+	"kvar": newUnit("reactive_power", "var", "1000", "0"),
+	"VA":   newUnit("apparent_power", "VA", "1", "0"),
+	"kVA":  newUnit("apparent_power", "VA", "1000", "0"),
+	"mV":   newUnit("voltage", "V", "1/1000", "0"),
+	"V":    newUnit("voltage", "V", "1", "0"),
+	"kV":   newUnit("voltage", "V", "1000", "0"),
+	"MV":   newUnit("voltage", "V", "1000000", "0"),
+	"mA":   newUnit("current", "A", "1/1000", "0"),
+	"A":    newUnit("current", "A", "1", "0"),
+	"Hz":   newUnit("frequency", "Hz", "1", "0"),
+	"C":    newUnit("temperature", "°C", "1", "0"),
+	"°C":   newUnit("temperature", "°C", "1", "0"),
+	"degC": newUnit("temperature", "°C", "1", "0"),
+	"F":    newUnit("temperature", "°C", "5/9", "-160/9"),
+	"°F":   newUnit("temperature", "°C", "5/9", "-160/9"),
+	"degF": newUnit("temperature", "°C", "5/9", "-160/9"),
+	"K":    newUnit("temperature", "°C", "1", "-5463/20"),
+}
+
+// foldedUnits maps lower-case spellings such as kwh to their symbol. Symbols
+// with an m or M prefix are left out, as milli and mega differ only in case.
+var foldedUnits = func() map[string]string {
+	folded := make(map[string]string, len(units))
+	for symbol := range units {
+		if len(symbol) > 1 && (symbol[0] == 'm' || symbol[0] == 'M') {
+			continue
+		}
+		folded[strings.ToLower(symbol)] = symbol
+	}
+	return folded
+}()
+
+// suffixUnits are the symbols suffix_keys detects in key names. Suffixes
+// that are also common words or abbreviations, such as var (variance), K
+// or VA, are left out; fields reported in those units must be configured.
+var suffixUnits = map[string]bool{
+	"Wh": true, "kWh": true, "MWh": true, "GWh": true,
+	"kW": true, "MW": true,
+	"kvar": true, "kVA": true, "kV": true, "Hz": true,
+}
+
+// lookupUnit matches the exact symbol first and falls back to a
+// case-insensitive match where that cannot be confused.
+func lookupUnit(name string) (unit, bool) {
+	name = strings.TrimSpace(name)
+	symbol, ok := unitSymbol(name)
+	u := units[symbol]
+	u.name = name
+	return u, ok
+}
+
+func unitSymbol(name string) (string, bool) {
+	if _, ok := units[name]; ok {
+		return name, true
+	}
+	symbol, ok := foldedUnits[strings.ToLower(name)]
+	return symbol, ok
+}
+
+// UnitFile is the YAML document loaded from TRANSFORM_UNITS_PATH.
+type UnitFile struct {
+	Units []UnitSet `yaml:"units"`
+}
+
+// UnitSet declares the units a tenant and device type report fields in.
+type UnitSet struct {
+	Tenant     string `yaml:"tenant"`
+	DeviceType string `yaml:"device_type"`
+	// Fields maps field paths to the unit the device reports them in.
+	Fields map[string]string `yaml:"fields"`
+	// SuffixKeys detects units from key suffixes such as energy_kwh and
+	// renames the field to the canonical suffix (energy_wh).
+	SuffixKeys bool `yaml:"suffix_keys"`
+	// RecordOriginal stores the reported unit under _original_units.
+	RecordOriginal bool `yaml:"record_original"`
+}
+
+type UnitNormalizer interface {
+	Normalize(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error)
+}
+
+type compiledUnitSet struct {
+	extract.Selector
+	fields         map[string]unit
+	fieldNames     []string
+	suffixKeys     bool
+	recordOriginal bool
+}
+
+type unitNormalizer struct {
+	sets []compiledUnitSet
+}
+
+func NewUnitNormalizer(config *config.Config) (UnitNormalizer, error) {
+	if config.Transform.UnitsPath == "" {
+		return &unitNormalizer{}, nil
+	}
+
+	content, err := os.ReadFile(config.Transform.UnitsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unit map: %w", err)
+	}
+
+	var file UnitFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse unit map: %w", err)
+	}
+	return CompileUnits(&file)
+}
+
+// CompileUnits validates that every configured unit is known.
+func CompileUnits(file *UnitFile) (UnitNormalizer, error) {
+	n := &unitNormalizer{}
+	seen := make(extract.Selectors)
+
+	for i, set := range file.Units {
+		sel := extract.NewSelector(set.Tenant, set.DeviceType)
+		if err := seen.Add(sel); err != nil {
+			return nil, fmt.Errorf("units[%d]: %w", i, err)
+		}
+
+		compiled := compiledUnitSet{
+			Selector:       sel,
+			fields:         make(map[string]unit, len(set.Fields)),
+			suffixKeys:     set.SuffixKeys,
+			recordOriginal: set.RecordOriginal,
+		}
+		for field, name := range set.Fields {
+			u, ok := lookupUnit(name)
+			if !ok {
+				return nil, fmt.Errorf("units[%d]: unknown unit %q for field %s", i, name, field)
+			}
+			compiled.fields[field] = u
+			compiled.fieldNames = append(compiled.fieldNames, field)
+		}
+		sort.Strings(compiled.fieldNames)
+		n.sets = append(n.sets, compiled)
+	}
+
+	return n, nil
+}
+
+// Normalize converts configured and suffix-detected fields to canonical
+// units. A unit embedded in a string value ("12.5 kWh") takes precedence
+// over the configured one. Conversions use exact rational arithmetic so
+// integer scaling of large counters does not lose precision.
+func (n *unitNormalizer) Normalize(identity extract.Identity, data map[string]interface{}) (map[string]interface{}, error) {
+	set := n.match(identity)
+	if set == nil {
+		return data, nil
+	}
+
+	original := make(map[string]interface{})
+
+	for _, field := range set.fieldNames {
+		value, ok := util.GetPath(data, field)
+		if !ok || value == nil {
+			continue
+		}
+		converted, reported, err := convertValue(value, set.fields[field])
+		if err != nil {
+			return nil, fmt.Errorf("normalize %s: %w", field, err)
+		}
+		util.SetPath(data, field, converted)
+		original[field] = reported
+	}
+
+	if set.suffixKeys {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, done := original[key]; done {
+				continue
+			}
+			base, u, ok := splitUnitSuffix(key)
+			if !ok || data[key] == nil {
+				continue
+			}
+			converted, reported, err := convertValue(data[key], u)
+			if err != nil {
+				return nil, fmt.Errorf("normalize %s: %w", key, err)
+			}
+			target := base + "_" + canonicalSuffix(u)
+			if _, exists := data[target]; exists && target != key {
+				return nil, fmt.Errorf("normalize %s: target field %s already exists", key, target)
+			}
+			delete(data, key)
+			data[target] = converted
+			original[target] = reported
+		}
+	}
+
+	if set.recordOriginal && len(original) > 0 {
+		data[OriginalUnitsKey] = original
+	}
+	return data, nil
+}
+
+func (n *unitNormalizer) match(identity extract.Identity) *compiledUnitSet {
+	return extract.BestMatch(identity, n.sets)
+}
+
+// convertValue returns the canonical value and the unit it was reported in.
+func convertValue(value interface{}, configured unit) (interface{}, string, error) {
+	u := configured
+	reported := ""
+
+	if v, ok := value.(string); ok {
+		numeric, suffix := splitValueUnit(v)
+		if suffix != "" {
+			parsed, ok := lookupUnit(suffix)
+			if !ok {
+				return nil, "", fmt.Errorf("unknown unit %q", suffix)
+			}
+			if parsed.dimension != configured.dimension {
+				return nil, "", fmt.Errorf("unit %q is not a %s unit", suffix, configured.dimension)
+			}
+			u, reported = parsed, suffix
+		}
+		value = numeric
+	}
+	number, err := util.ToRat(value)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if reported == "" {
+		reported = u.name
+	}
+
+	number.Mul(number, u.scale)
+	number.Add(number, u.offset)
+	return util.RatToNumber(number), reported, nil
+}
+
+// splitValueUnit splits "12.5 kWh" or "12.5kWh" into number and unit.
+func splitValueUnit(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 {
+		c := s[i-1]
+		if (c >= '0' && c <= '9') || c == '.' {
+			break
+		}
+		i--
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i:])
+}
+
+// splitUnitSuffix recognizes keys such as energy_kwh or power_kW whose
+// suffix is one of suffixUnits.
+func splitUnitSuffix(key string) (string, unit, bool) {
+	i := strings.LastIndex(key, "_")
+	if i <= 0 || i == len(key)-1 {
+		return "", unit{}, false
+	}
+	symbol, ok := unitSymbol(key[i+1:])
+	if !ok || !suffixUnits[symbol] {
+		return "", unit{}, false
+	}
+	u := units[symbol]
+	u.name = key[i+1:]
+	return key[:i], u, true
+}
+
+func canonicalSuffix(u unit) string {
+	return strings.ToLower(u.canonical)
+}
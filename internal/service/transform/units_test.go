@@ -0,0 +1,70 @@
+package transform
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConvertValueUnitCase(t *testing.T) {
+	watt, _ := lookupUnit("W")
+	volt, _ := lookupUnit("V")
+
+	tests := []struct {
+		value      string
+		configured unit
+		want       string
+	}{
+		{"5 mW", watt, "0.005"},
+		{"5 MW", watt, "5000000"},
+		{"5 kW", watt, "5000"},
+		{"5 KW", watt, "5000"},
+		{"5 mV", volt, "0.005"},
+		{"5 MV", volt, "5000000"},
+		{"5 mw", watt, ""},
+		{"5 Mv", volt, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, _, err := convertValue(tt.value, tt.configured)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convertValue: %v", err)
+			}
+			if got.(json.Number).String() != tt.want {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitUnitSuffixAllowList(t *testing.T) {
+	tests := []struct {
+		key       string
+		field     string
+		canonical string
+		ok        bool
+	}{
+		{"energy_kwh", "energy", "Wh", true},
+		{"power_kW", "power", "W", true},
+		{"power_MW", "power", "W", true},
+		{"power_mw", "", "", false},
+		{"ambient_c", "", "", false},
+		{"ambient_k", "", "", false},
+		{"ambient_K", "", "", false},
+		{"voltage_var", "", "", false},
+		{"apparent_va", "", "", false},
+		{"reactive_kvar", "reactive", "var", true},
+		{"grid_hz", "grid", "Hz", true},
+	}
+	for _, tt := range tests {
+		field, u, ok := splitUnitSuffix(tt.key)
+		if ok != tt.ok || field != tt.field || u.canonical != tt.canonical {
+			t.Errorf("splitUnitSuffix(%q) = %q, %q, %t", tt.key, field, u.canonical, ok)
+		}
+	}
+}
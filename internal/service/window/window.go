@@ -0,0 +1,358 @@
+package window
+
+import (
+	"context"
+	"encoding/json"
+	"etl-pipeline/config"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/event"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/internal/service/privacy"
+	"etl-pipeline/pkg/logger"
+	"etl-pipeline/pkg/util"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// TablePrefix is prepended to the window label to name the aggregate table,
+// e.g. device_data_agg_15m.
+const TablePrefix = "device_data_agg_"
+
+var labelPattern = regexp.MustCompile(`^[0-9]+[smhd]$`)
+
+// Aggregator maintains event-time tumbling windows per device and field.
+type Aggregator interface {
+	// Add folds the numeric fields of a loaded record into its windows.
+	Add(identity extract.Identity, timestamp time.Time, data map[string]interface{})
+	// Flush writes every open window and late correction, so all records
+	// added so far are stored. It must succeed before the matching offsets
+	// are committed, as windows live in memory until written.
+	Flush(ctx context.Context) error
+}
+
+type resolution struct {
+	label string
+	size  time.Duration
+	table string
+}
+
+type windowKey struct {
+	resolution int
+	tenantID   string
+	deviceID   string
+	field      string
+	bucket     time.Time
+}
+
+type batchKey struct {
+	resolution int
+	tenantID   string
+}
+
+type aggregator struct {
+	resolutions     []resolution
+	allowedLateness time.Duration
+	flushInterval   time.Duration
+	repo            repository.Repository
+	deadLetter      event.DeadLetter
+	logger          logger.Logger
+
+	mu      sync.Mutex
+	windows map[windowKey]*model.Aggregate
+	// late holds partial aggregates for windows that were already closed.
+	// They are merged into the stored rows on the next flush.
+	late map[windowKey]*model.Aggregate
+	// watermarks holds the newest event time seen per device.
+	watermarks map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type AggregatorParams struct {
+	fx.In
+	Lifecycle  fx.Lifecycle
+	Config     *config.Config
+	Repo       repository.Repository
+	DeadLetter event.DeadLetter
+	Logger     logger.Logger
+}
+
+func NewAggregator(params AggregatorParams) (Aggregator, error) {
+	cfg := params.Config.Window
+
+	a := &aggregator{
+		allowedLateness: time.Duration(cfg.AllowedLateness) * time.Second,
+		flushInterval:   time.Duration(cfg.FlushInterval) * time.Second,
+		repo:            params.Repo,
+		deadLetter:      params.DeadLetter,
+		logger:          params.Logger,
+		windows:         make(map[windowKey]*model.Aggregate),
+		late:            make(map[windowKey]*model.Aggregate),
+		watermarks:      make(map[string]time.Time),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	for _, label := range cfg.Sizes {
+		if !labelPattern.MatchString(label) {
+			return nil, fmt.Errorf("invalid window size %q, expected e.g. 1m or 15m", label)
+		}
+		size, err := util.ParseDuration(label)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid window size %q", label)
+		}
+		a.resolutions = append(a.resolutions, resolution{label: label, size: size, table: TablePrefix + label})
+	}
+
+	if len(a.resolutions) == 0 {
+		return a, nil
+	}
+	if cfg.AllowedLateness < 0 || cfg.FlushInterval <= 0 {
+		return nil, fmt.Errorf("window lateness must not be negative and flush interval must be positive")
+	}
+
+	params.Lifecycle.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			for _, res := range a.resolutions {
+				if err := a.repo.CreateAggregateTable(ctx, res.table); err != nil {
+					return fmt.Errorf("failed to create %s: %w", res.table, err)
+				}
+			}
+			go a.flushLoop()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			close(a.stop)
+			<-a.done
+			// Open windows are written as partial aggregates; the upsert
+			// merges the rest in after a restart.
+			return a.flush(ctx, true)
+		},
+	})
+
+	return a, nil
+}
+
+func (a *aggregator) Add(identity extract.Identity, timestamp time.Time, data map[string]interface{}) {
+	if len(a.resolutions) == 0 {
+		return
+	}
+
+	deviceKey := identity.TenantId + "/" + identity.DeviceId
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	watermark := a.watermarks[deviceKey]
+	if timestamp.After(watermark) {
+		a.watermarks[deviceKey] = timestamp
+	}
+
+	for field, raw := range data {
+		if !util.IsNumber(raw) {
+			continue
+		}
+		value, err := util.ToFloat64(raw)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		for i, res := range a.resolutions {
+			key := windowKey{
+				resolution: i,
+				tenantID:   identity.TenantId,
+				deviceID:   identity.DeviceId,
+				field:      field,
+				bucket:     timestamp.UTC().Truncate(res.size),
+			}
+
+			target := a.windows
+			if a.closed(key, res, watermark) {
+				target = a.late
+			}
+			agg, ok := target[key]
+			if !ok {
+				agg = &model.Aggregate{
+					TenantID: key.tenantID,
+					DeviceID: key.deviceID,
+					Field:    field,
+					Bucket:   key.bucket,
+				}
+				target[key] = agg
+			}
+			agg.Add(value, timestamp)
+		}
+	}
+}
+
+// closed reports whether the window has passed the device watermark plus
+// the allowed lateness. Windows that are still open in memory accept data.
+func (a *aggregator) closed(key windowKey, res resolution, watermark time.Time) bool {
+	if _, open := a.windows[key]; open {
+		return false
+	}
+	return !key.bucket.Add(res.size + a.allowedLateness).After(watermark)
+}
+
+func (a *aggregator) Flush(ctx context.Context) error {
+	if len(a.resolutions) == 0 {
+		return nil
+	}
+	return a.flush(ctx, true)
+}
+
+func (a *aggregator) flushLoop() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := a.flush(ctx, false); err != nil {
+				a.logger.Error("Failed to write window aggregates", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// flush writes closed windows and late corrections. A window closes when
+// its device watermark passes its end plus the allowed lateness, or when the
+// device has been silent for that long in wall-clock time. With all set,
+// every open window is written; later data for it is merged into the
+// stored row like a late correction.
+func (a *aggregator) flush(ctx context.Context, all bool) error {
+	now := time.Now().UTC()
+	// Batches are per tenant, as each tenant may be routed to its own
+	// database.
+	batches := make(map[batchKey][]model.Aggregate)
+
+	a.mu.Lock()
+	for key, agg := range a.windows {
+		res := a.resolutions[key.resolution]
+		end := key.bucket.Add(res.size + a.allowedLateness)
+		watermark := a.watermarks[key.tenantID+"/"+key.deviceID]
+		if all || !end.After(watermark) || !end.After(now) {
+			bk := batchKey{key.resolution, key.tenantID}
+			batches[bk] = append(batches[bk], *agg)
+			delete(a.windows, key)
+		}
+	}
+	for key, agg := range a.late {
+		bk := batchKey{key.resolution, key.tenantID}
+		batches[bk] = append(batches[bk], *agg)
+		delete(a.late, key)
+	}
+	a.pruneWatermarks(now)
+	a.mu.Unlock()
+
+	var firstErr error
+	for k, batch := range batches {
+		table := a.resolutions[k.resolution].table
+		rejected, pending, err := util.Bisect(batch, func(aggregates []model.Aggregate) error {
+			return a.repo.UpsertAggregates(ctx, table, aggregates)
+		}, repository.IsDataError)
+		a.reject(ctx, table, rejected)
+		if err != nil {
+			// Upserts merge, so only what was not written may be retried.
+			a.requeue(k.resolution, pending)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		a.logger.Debug("Wrote window aggregates",
+			zap.String("table", table),
+			zap.String("tenantID", k.tenantID),
+			zap.Int("count", len(batch)-len(rejected)))
+	}
+	return firstErr
+}
+
+// pruneWatermarks forgets devices whose every window has closed by the wall
+// clock. Data arriving for them later closes the same way, so the outcome
+// does not change. The caller holds mu.
+func (a *aggregator) pruneWatermarks(now time.Time) {
+	var horizon time.Duration
+	for _, res := range a.resolutions {
+		horizon = max(horizon, res.size)
+	}
+	cutoff := now.Add(-horizon - a.allowedLateness)
+	for device, watermark := range a.watermarks {
+		if watermark.Before(cutoff) {
+			delete(a.watermarks, device)
+		}
+	}
+}
+
+// reject sends aggregates the database refused to the DLQ instead of
+// retrying them forever.
+func (a *aggregator) reject(ctx context.Context, table string, rejected []util.Rejected[model.Aggregate]) {
+	for _, r := range rejected {
+		a.logger.Warn("Window aggregate rejected by database",
+			zap.String("table", table),
+			zap.String("tenantID", r.Item.TenantID),
+			zap.String("deviceID", r.Item.DeviceID),
+			zap.String("field", r.Item.Field),
+			zap.String("error", privacy.RedactError(r.Err)))
+
+		value, err := json.Marshal(r.Item)
+		if err == nil {
+			err = a.deadLetter.WriteSinkFailure(ctx, table, []byte(r.Item.TenantID+"/"+r.Item.DeviceID), value, r.Err)
+		}
+		if err != nil {
+			a.logger.Error("Failed to dead-letter window aggregate", zap.String("table", table), zap.Error(err))
+		}
+	}
+}
+
+// requeue keeps aggregates that failed to write so the next flush retries
+// them as late corrections.
+func (a *aggregator) requeue(resolution int, batch []model.Aggregate) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := range batch {
+		agg := batch[i]
+		key := windowKey{
+			resolution: resolution,
+			tenantID:   agg.TenantID,
+			deviceID:   agg.DeviceID,
+			field:      agg.Field,
+			bucket:     agg.Bucket,
+		}
+		if existing, ok := a.late[key]; ok {
+			merge(existing, &agg)
+			continue
+		}
+		a.late[key] = &agg
+	}
+}
+
+func merge(into, from *model.Aggregate) {
+	if from.Min < into.Min {
+		into.Min = from.Min
+	}
+	if from.Max > into.Max {
+		into.Max = from.Max
+	}
+	if !from.LastTime.Before(into.LastTime) {
+		into.Last = from.Last
+		into.LastTime = from.LastTime
+	}
+	into.Sum += from.Sum
+	into.Count += from.Count
+}
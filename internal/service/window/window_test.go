@@ -0,0 +1,109 @@
+package window
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"etl-pipeline/internal/model"
+	"etl-pipeline/internal/repository"
+	"etl-pipeline/internal/service/extract"
+	"etl-pipeline/pkg/logger"
+	"testing"
+	"time"
+)
+
+// mergingRepo merges upserted aggregates the way UpsertAggregates does.
+type mergingRepo struct {
+	repository.Repository
+	fail   error
+	writes int
+	rows   map[string]*model.Aggregate
+}
+
+func (r *mergingRepo) UpsertAggregates(_ context.Context, _ string, aggregates []model.Aggregate) error {
+	if r.fail != nil {
+		return r.fail
+	}
+	r.writes++
+	for i := range aggregates {
+		agg := aggregates[i]
+		key := agg.DeviceID + "/" + agg.Field + "/" + agg.Bucket.Format(time.RFC3339)
+		if row, ok := r.rows[key]; ok {
+			merge(row, &agg)
+			continue
+		}
+		r.rows[key] = &agg
+	}
+	return nil
+}
+
+func newTestAggregator(repo repository.Repository) *aggregator {
+	return &aggregator{
+		resolutions:     []resolution{{label: "1m", size: time.Minute, table: TablePrefix + "1m"}},
+		allowedLateness: 10 * time.Second,
+		repo:            repo,
+		logger:          logger.NewNop(),
+		windows:         make(map[windowKey]*model.Aggregate),
+		late:            make(map[windowKey]*model.Aggregate),
+		watermarks:      make(map[string]time.Time),
+	}
+}
+
+func TestFlushWritesOpenWindowsAndMergesLaterData(t *testing.T) {
+	repo := &mergingRepo{rows: map[string]*model.Aggregate{}}
+	a := newTestAggregator(repo)
+	device := extract.Identity{TenantId: "t", DeviceId: "d"}
+	start := time.Now().UTC().Truncate(time.Minute)
+
+	a.Add(device, start.Add(time.Second), map[string]interface{}{"temp": json.Number("1")})
+	a.Add(device, start.Add(2*time.Second), map[string]interface{}{"temp": json.Number("3")})
+
+	// A commit failing to flush keeps the windows for the next attempt.
+	repo.fail = errors.New("database unavailable")
+	if err := a.Flush(context.Background()); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	repo.fail = nil
+	if err := a.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Add(device, start.Add(3*time.Second), map[string]interface{}{"temp": json.Number("5")})
+	if err := a.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if repo.writes != 2 || len(repo.rows) != 1 {
+		t.Fatalf("got %d writes of %d rows, want 2 writes of 1 row", repo.writes, len(repo.rows))
+	}
+	for _, row := range repo.rows {
+		if row.Count != 3 || row.Sum != 9 || row.Min != 1 || row.Max != 5 || row.Last != 5 {
+			t.Fatalf("got %+v, want count 3, sum 9, min 1, max 5, last 5", *row)
+		}
+	}
+	if len(a.windows) != 0 || len(a.late) != 0 {
+		t.Fatalf("windows left in memory: %d open, %d late", len(a.windows), len(a.late))
+	}
+}
+
+func TestFlushPrunesSilentDevices(t *testing.T) {
+	repo := &mergingRepo{rows: map[string]*model.Aggregate{}}
+	a := newTestAggregator(repo)
+	old := time.Now().UTC().Add(-time.Hour)
+
+	a.Add(extract.Identity{TenantId: "t", DeviceId: "old"}, old, map[string]interface{}{"temp": json.Number("1")})
+	a.Add(extract.Identity{TenantId: "t", DeviceId: "new"}, time.Now(), map[string]interface{}{"temp": json.Number("1")})
+	if err := a.flush(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := a.watermarks["t/old"]; ok {
+		t.Fatal("watermark of a silent device was kept")
+	}
+	if _, ok := a.watermarks["t/new"]; !ok {
+		t.Fatal("watermark of an active device was pruned")
+	}
+	if len(repo.rows) != 1 || len(a.windows) != 1 {
+		t.Fatalf("got %d stored and %d open windows, want 1 and 1", len(repo.rows), len(a.windows))
+	}
+}
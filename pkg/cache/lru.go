@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU is a size-bounded cache whose entries also expire after a per-entry
+// TTL. It is safe for concurrent use.
+type LRU[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[K]*list.Element
+	order    *list.List
+	now      func() time.Time
+	onEvict  func(key K, value V)
+}
+
+type entry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+func NewLRU[K comparable, V any](capacity int) *LRU[K, V] {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &LRU[K, V]{
+		capacity: capacity,
+		items:    make(map[K]*list.Element, capacity),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// OnEvict registers fn to be called, with the cache locked, whenever an
+// entry is removed. fn must not use the cache.
+func (c *LRU[K, V]) OnEvict(fn func(key K, value V)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onEvict = fn
+}
+
+// Get returns the cached value and marks it as recently used. Expired
+// entries are removed and reported as missing.
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*entry[K, V])
+	if c.now().After(e.expiresAt) {
+		c.removeElement(el)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// Set stores value for ttl, evicting the least recently used entry when the
+// cache is full.
+func (c *LRU[K, V]) Set(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value = value
+		e.expiresAt = expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *LRU[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Expire removes every expired entry. Get only drops the entries it looks
+// up, so caches holding resources call Expire periodically.
+func (c *LRU[K, V]) Expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*entry[K, V]).expiresAt) {
+			c.removeElement(el)
+		}
+		el = prev
+	}
+}
+
+func (c *LRU[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.onEvict != nil {
+		for el := c.order.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*entry[K, V])
+			c.onEvict(e.key, e.value)
+		}
+	}
+	c.items = make(map[K]*list.Element, c.capacity)
+	c.order.Init()
+}
+
+func (c *LRU[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *LRU[K, V]) removeElement(el *list.Element) {
+	e := el.Value.(*entry[K, V])
+	c.order.Remove(el)
+	delete(c.items, e.key)
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
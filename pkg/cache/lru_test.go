@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUExpire(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewLRU[string, int](10)
+	c.now = func() time.Time { return now }
+	var evicted []string
+	c.OnEvict(func(key string, _ int) { evicted = append(evicted, key) })
+
+	c.Set("short", 1, time.Second)
+	c.Set("long", 2, time.Hour)
+	c.Set("shorter", 3, time.Millisecond)
+	now = now.Add(time.Minute)
+	c.Expire()
+
+	if c.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", c.Len())
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Fatal("unexpired entry was removed")
+	}
+	if len(evicted) != 2 {
+		t.Fatalf("evicted %v, want short and shorter", evicted)
+	}
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU[string, int](2)
+	c.Set("a", 1, time.Hour)
+	c.Set("b", 2, time.Hour)
+	c.Get("a")
+	c.Set("c", 3, time.Hour)
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("least recently used entry was kept")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("recently used entry was evicted")
+	}
+}
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	loggerCustom "etl-pipeline/pkg/logger"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrations run, so only
+// one instance migrates at a time.
+const migrationLockKey int64 = 4_419_202_611
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// mainOnlyMarker starts the up file of migrations for pipeline metadata,
+// such as the device registry, that only the main database holds. Tenant
+// routes skip them.
+const mainOnlyMarker = "-- main only"
+
+const (
+	createSchemaMigrations = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    BIGINT      PRIMARY KEY,
+		name       TEXT        NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)
+	`
+	listSchemaMigrations  = `SELECT version, applied_at FROM schema_migrations`
+	insertSchemaMigration = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+	deleteSchemaMigration = `DELETE FROM schema_migrations WHERE version = $1`
+)
+
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	MainOnly bool
+}
+
+type MigrationStatus struct {
+	Migration
+	// AppliedAt is nil for pending migrations.
+	AppliedAt *time.Time
+}
+
+type Migrator interface {
+	// Up applies all pending migrations and returns how many ran.
+	Up(ctx context.Context) (int, error)
+	// Down rolls back the latest steps applied migrations.
+	Down(ctx context.Context, steps int) (int, error)
+	Status(ctx context.Context) ([]MigrationStatus, error)
+}
+
+type migrator struct {
+	pool       *pgxpool.Pool
+	logger     loggerCustom.Logger
+	migrations []Migration
+}
+
+func NewMigrator(pool *pgxpool.Pool, log loggerCustom.Logger) (Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{pool: pool, logger: log, migrations: migrations}, nil
+}
+
+// NewTenantMigrator migrates a tenant route's schema or database, which
+// only holds device records, so main only migrations are left out.
+func NewTenantMigrator(pool *pgxpool.Pool, log loggerCustom.Logger) (Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	tenant := migrations[:0]
+	for _, m := range migrations {
+		if !m.MainOnly {
+			tenant = append(tenant, m)
+		}
+	}
+	return &migrator{pool: pool, logger: log, migrations: tenant}, nil
+}
+
+// loadMigrations pairs NNNN_name.up.sql with NNNN_name.down.sql, ordered by
+// version.
+func loadMigrations(files fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %q", entry.Name())
+		}
+		content, err := fs.ReadFile(files, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+			m.MainOnly = strings.HasPrefix(m.Up, mainOnlyMarker)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (m *migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+	err := m.locked(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (m *migrator) Down(ctx context.Context, steps int) (int, error) {
+	count := 0
+	err := m.locked(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration, false); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if _, err := m.pool.Exec(ctx, createSchemaMigrations); err != nil {
+		return nil, err
+	}
+	applied, err := listApplied(ctx, m.pool)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		s := MigrationStatus{Migration: migration}
+		if at, ok := applied[migration.Version]; ok {
+			s.AppliedAt = &at
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+// locked runs fn on one connection while holding the migration lock.
+func (m *migrator) locked(ctx context.Context, fn func(conn *pgxpool.Conn, applied map[int64]time.Time) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		// The lock must be released even when ctx is already done.
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			m.logger.Error("Failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, createSchemaMigrations); err != nil {
+		return err
+	}
+	applied, err := listApplied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, applied)
+}
+
+// apply runs one migration and records it in the same transaction.
+func (m *migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql, record, args := migration.Up, insertSchemaMigration, []interface{}{migration.Version, migration.Name}
+	if !up {
+		sql, record, args = migration.Down, deleteSchemaMigration, []interface{}{migration.Version}
+	}
+
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	m.logger.Info("Applied migration",
+		zap.Int64("version", migration.Version),
+		zap.String("name", migration.Name),
+		zap.Bool("up", up))
+	return nil
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+func listApplied(ctx context.Context, q querier) (map[int64]time.Time, error) {
+	rows, err := q.Query(ctx, listSchemaMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,29 @@
+package database
+
+import "testing"
+
+func TestTenantMigrationsSkipMainOnly(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainOnly := map[string]bool{}
+	for _, m := range migrations {
+		if m.MainOnly {
+			mainOnly[m.Name] = true
+		}
+	}
+	if len(mainOnly) != 3 || !mainOnly["device_schema"] || !mainOnly["pipeline_state"] || !mainOnly["devices"] {
+		t.Fatalf("main only migrations = %v", mainOnly)
+	}
+
+	m, err := NewTenantMigrator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range m.(*migrator).migrations {
+		if migration.MainOnly {
+			t.Fatalf("tenant migrator runs %d_%s", migration.Version, migration.Name)
+		}
+	}
+}
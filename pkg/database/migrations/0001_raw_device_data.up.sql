@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS raw_device_data (
+    tenant_id TEXT        NOT NULL,
+    device_id TEXT        NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    data      JSONB       NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS raw_device_data_device_idx
+    ON raw_device_data (tenant_id, device_id, timestamp DESC);
+
+CREATE INDEX IF NOT EXISTS raw_device_data_data_idx
+    ON raw_device_data USING GIN (data);
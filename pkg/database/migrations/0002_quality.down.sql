@@ -0,0 +1,3 @@
+ALTER TABLE raw_device_data
+    DROP COLUMN IF EXISTS quality_violations,
+    DROP COLUMN IF EXISTS quality_code;
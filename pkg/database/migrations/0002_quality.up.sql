@@ -0,0 +1,3 @@
+ALTER TABLE raw_device_data
+    ADD COLUMN IF NOT EXISTS quality_code       SMALLINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS quality_violations TEXT[]   NOT NULL DEFAULT '{}';
@@ -0,0 +1,8 @@
+-- main only
+CREATE TABLE IF NOT EXISTS device_schema (
+    tenant_id   TEXT        NOT NULL,
+    device_type TEXT        NOT NULL,
+    fields      JSONB       NOT NULL,
+    updated_at  TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (tenant_id, device_type)
+);
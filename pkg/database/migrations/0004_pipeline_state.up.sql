@@ -0,0 +1,10 @@
+-- main only
+CREATE TABLE IF NOT EXISTS pipeline_state (
+    kind      TEXT        NOT NULL,
+    tenant_id TEXT        NOT NULL,
+    device_id TEXT        NOT NULL,
+    field     TEXT        NOT NULL,
+    value     JSONB,
+    timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (kind, tenant_id, device_id, field)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS devices;
+DROP FUNCTION IF EXISTS notify_device_changed();
@@ -0,0 +1,23 @@
+-- main only
+CREATE TABLE IF NOT EXISTS devices (
+    tenant_id    TEXT  NOT NULL,
+    device_id    TEXT  NOT NULL,
+    site         TEXT,
+    asset_type   TEXT,
+    meter_serial TEXT,
+    timezone     TEXT,
+    attributes   JSONB NOT NULL DEFAULT '{}',
+    PRIMARY KEY (tenant_id, device_id)
+);
+
+CREATE OR REPLACE FUNCTION notify_device_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('device_changed', COALESCE(NEW.tenant_id, OLD.tenant_id) || '/' ||
+                                        COALESCE(NEW.device_id, OLD.device_id));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS devices_changed ON devices;
+CREATE TRIGGER devices_changed AFTER INSERT OR UPDATE OR DELETE ON devices
+    FOR EACH ROW EXECUTE FUNCTION notify_device_changed();
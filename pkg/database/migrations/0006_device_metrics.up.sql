@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS device_metrics (
+    tenant_id    TEXT             NOT NULL,
+    device_id    TEXT             NOT NULL,
+    ts           TIMESTAMPTZ      NOT NULL,
+    metric       TEXT             NOT NULL,
+    value_double DOUBLE PRECISION,
+    value_text   TEXT,
+    value_bool   BOOLEAN,
+    quality_code       SMALLINT NOT NULL DEFAULT 0,
+    quality_violations TEXT[]   NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS device_metrics_metric_idx
+    ON device_metrics (tenant_id, device_id, metric, ts DESC);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS device_latest_state (
+    tenant_id   TEXT        NOT NULL,
+    device_id   TEXT        NOT NULL,
+    -- Latest value of every field the device has reported.
+    data        JSONB       NOT NULL DEFAULT '{}',
+    -- Reading time of every value in data, by field.
+    field_times JSONB       NOT NULL DEFAULT '{}',
+    updated_at  TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (tenant_id, device_id)
+);
@@ -12,8 +12,9 @@ import (
 	"go.uber.org/fx"
 )
 
-func NewDatabase(lc fx.Lifecycle, config *config.Config, log loggerCustom.Logger) (*pgxpool.Pool, error) {
-	dsn := fmt.Sprintf(
+// DSN builds the connection string of the main database.
+func DSN(config *config.Config) string {
+	return fmt.Sprintf(
 		"postgres://%s:%s@%s:%s/%s?sslmode=%s",
 		config.DB.User,
 		config.DB.Password,
@@ -22,12 +23,26 @@ func NewDatabase(lc fx.Lifecycle, config *config.Config, log loggerCustom.Logger
 		config.DB.DBName,
 		config.DB.SSLMode,
 	)
+}
 
-	pool, err := pgxpool.Connect(context.Background(), dsn)
+func NewDatabase(lc fx.Lifecycle, config *config.Config, log loggerCustom.Logger) (*pgxpool.Pool, error) {
+	pool, err := pgxpool.Connect(context.Background(), DSN(config))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to TimescaleDB: %w", err)
 	}
 
+	if config.DB.AutoMigrate {
+		migrator, err := NewMigrator(pool, log)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		if _, err := migrator.Up(context.Background()); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
 			pool.Close()
@@ -0,0 +1,425 @@
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"etl-pipeline/pkg/util"
+)
+
+var (
+	ErrDivisionByZero = errors.New("division by zero")
+	ErrNotInteger     = errors.New("bit operation on non-integer value")
+	ErrOverflow       = errors.New("integer overflow")
+)
+
+// Program is a compiled expression. It is safe for concurrent use.
+type Program struct {
+	source string
+	root   node
+	fields []string
+}
+
+// Compile parses src once so it can be evaluated against many records.
+func Compile(src string) (*Program, error) {
+	root, fields, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: src, root: root, fields: fields}, nil
+}
+
+// Source returns the expression text the program was compiled from.
+func (p *Program) Source() string {
+	return p.source
+}
+
+// Fields returns the field paths the expression reads.
+func (p *Program) Fields() []string {
+	return p.fields
+}
+
+// Eval evaluates the program against a decoded record. Missing fields
+// evaluate to null and null propagates through arithmetic, so an absent
+// input yields a null result rather than an error.
+func (p *Program) Eval(data map[string]interface{}) (interface{}, error) {
+	return p.root.eval(data)
+}
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *fieldNode) eval(data map[string]interface{}) (interface{}, error) {
+	value, ok := util.GetPath(data, n.path)
+	if !ok {
+		return nil, nil
+	}
+	return normalize(value), nil
+}
+
+func (n *ternaryNode) eval(data map[string]interface{}) (interface{}, error) {
+	cond, err := n.cond.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.then.eval(data)
+	}
+	return n.otherwise.eval(data)
+}
+
+func (n *unaryNode) eval(data map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(data)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(x), nil
+	}
+	if x == nil {
+		return nil, nil
+	}
+
+	switch n.op {
+	case "-":
+		switch v := x.(type) {
+		case int64:
+			if v == math.MinInt64 {
+				return nil, ErrOverflow
+			}
+			return -v, nil
+		case float64:
+			return -v, nil
+		}
+		return nil, fmt.Errorf("cannot negate %s", typeName(x))
+	case "~":
+		v, ok := x.(int64)
+		if !ok {
+			return nil, ErrNotInteger
+		}
+		return ^v, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *binaryNode) eval(data map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(data)
+		if err != nil {
+			return nil, err
+		}
+		return truthy(right), nil
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(data)
+		if err != nil {
+			return nil, err
+		}
+		return truthy(right), nil
+	}
+
+	right, err := n.right.eval(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	}
+
+	if left == nil || right == nil {
+		return nil, nil
+	}
+
+	switch n.op {
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right)
+	case "+":
+		if ls, ok := left.(string); ok {
+			if rs, ok := right.(string); ok {
+				return ls + rs, nil
+			}
+		}
+		return arithmetic(n.op, left, right)
+	case "-", "*", "/", "%":
+		return arithmetic(n.op, left, right)
+	case "&", "|", "^", "&^", "<<", ">>":
+		return bitwise(n.op, left, right)
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *callNode) eval(data map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	result, err := n.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return result, nil
+}
+
+// normalize maps decoded JSON values onto the evaluator's value model:
+// int64, float64, string, bool, nil, or an opaque object/array.
+func normalize(v interface{}) interface{} {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+		return n.String()
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case int64:
+		return x != 0
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+func equal(left, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == nil && right == nil
+	}
+	if isNumeric(left) && isNumeric(right) {
+		li, lok := left.(int64)
+		ri, rok := right.(int64)
+		if lok && rok {
+			return li == ri
+		}
+		return toFloat(left) == toFloat(right)
+	}
+	switch l := left.(type) {
+	case string:
+		r, ok := right.(string)
+		return ok && l == r
+	case bool:
+		r, ok := right.(bool)
+		return ok && l == r
+	}
+	return false
+}
+
+func compare(op string, left, right interface{}) (interface{}, error) {
+	var cmp int
+	switch {
+	case isNumeric(left) && isNumeric(right):
+		li, lok := left.(int64)
+		ri, rok := right.(int64)
+		if lok && rok {
+			cmp = compareOrdered(li, ri)
+		} else {
+			cmp = compareOrdered(toFloat(left), toFloat(right))
+		}
+	default:
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("cannot compare %s and %s", typeName(left), typeName(right))
+		}
+		cmp = compareOrdered(ls, rs)
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+func compareOrdered[T int64 | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func arithmetic(op string, left, right interface{}) (interface{}, error) {
+	if !isNumeric(left) || !isNumeric(right) {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(left), typeName(right))
+	}
+
+	li, lok := left.(int64)
+	ri, rok := right.(int64)
+	if lok && rok && op != "/" {
+		switch op {
+		case "+":
+			return addInt64(li, ri)
+		case "-":
+			return subInt64(li, ri)
+		case "*":
+			return mulInt64(li, ri)
+		case "%":
+			if ri == 0 {
+				return nil, ErrDivisionByZero
+			}
+			return li % ri, nil
+		}
+	}
+
+	lf, rf := toFloat(left), toFloat(right)
+	switch op {
+	case "+":
+		return finite(lf + rf)
+	case "-":
+		return finite(lf - rf)
+	case "*":
+		return finite(lf * rf)
+	case "/":
+		if rf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return finite(lf / rf)
+	case "%":
+		if rf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return finite(math.Mod(lf, rf))
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+// addInt64, subInt64 and mulInt64 fail with ErrOverflow instead of wrapping
+// around.
+func addInt64(a, b int64) (interface{}, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return nil, ErrOverflow
+	}
+	return sum, nil
+}
+
+func subInt64(a, b int64) (interface{}, error) {
+	diff := a - b
+	if (b > 0 && diff > a) || (b < 0 && diff < a) {
+		return nil, ErrOverflow
+	}
+	return diff, nil
+}
+
+func mulInt64(a, b int64) (interface{}, error) {
+	if a == 0 || b == 0 {
+		return int64(0), nil
+	}
+	product := a * b
+	if product/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return nil, ErrOverflow
+	}
+	return product, nil
+}
+
+func bitwise(op string, left, right interface{}) (interface{}, error) {
+	li, lok := left.(int64)
+	ri, rok := right.(int64)
+	if !lok || !rok {
+		return nil, ErrNotInteger
+	}
+
+	switch op {
+	case "&":
+		return li & ri, nil
+	case "|":
+		return li | ri, nil
+	case "^":
+		return li ^ ri, nil
+	case "&^":
+		return li &^ ri, nil
+	case "<<", ">>":
+		if ri < 0 || ri > 63 {
+			return nil, fmt.Errorf("shift count %d out of range", ri)
+		}
+		if op == "<<" {
+			return li << uint(ri), nil
+		}
+		return li >> uint(ri), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", op)
+}
+
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return math.NaN()
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
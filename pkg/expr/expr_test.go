@@ -0,0 +1,156 @@
+package expr
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+var testData = map[string]interface{}{
+	"a":     json.Number("6"),
+	"big":   json.Number("9223372036854775807"),
+	"ratio": json.Number("0.5"),
+	"name":  "meter",
+	"on":    true,
+	"env":   map[string]interface{}{"temp": json.Number("21.5")},
+}
+
+func eval(t *testing.T, src string) (interface{}, error) {
+	t.Helper()
+	program, err := Compile(src)
+	if err != nil {
+		t.Fatalf("Compile(%q): %v", src, err)
+	}
+	return program.Eval(testData)
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 4 - 3", int64(3)},
+		{"7 / 2", 3.5},
+		{"7 % 4", int64(3)},
+		{"a & 0x4 != 0", true},
+		{"a & 0x1 != 0", false},
+		{"1 << 2 + 1", int64(5)},
+		{"a > 5 && ratio < 1 || false", true},
+		{"!on ? 1 : 2", int64(2)},
+		{"-a", int64(-6)},
+		{"~0", int64(-1)},
+		{"env.temp * 2", 43.0},
+		{`name + "-1"`, "meter-1"},
+		{"missing + 1", nil},
+		{"missing == null", true},
+		{"coalesce(missing, 3)", int64(3)},
+		{"isnull(missing)", true},
+		{"min(3, 1.5, 2)", 1.5},
+		{"max(a, 2)", int64(6)},
+		{"abs(-3)", int64(3)},
+		{"round(2.345, 2)", 2.35},
+		{"round(1234, -2)", 1200.0},
+		{"round(123, -400)", 0.0},
+		{"round(0, 400)", 0.0},
+		{"round(1e300, 10)", 1e300},
+		{"int(2.9)", int64(2)},
+		{`float("1.5")`, 1.5},
+		{"big - 1", int64(math.MaxInt64 - 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got, err := eval(t, tt.src)
+			if err != nil {
+				t.Fatalf("Eval: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %v (%T), want %v (%T)", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want error
+	}{
+		{"big + 1", ErrOverflow},
+		{"-big - 2", ErrOverflow},
+		{"big * 2", ErrOverflow},
+		{"-(-big - 1)", ErrOverflow},
+		{"abs(-big - 1)", ErrOverflow},
+		{"1 / 0", ErrDivisionByZero},
+		{"1 % 0", ErrDivisionByZero},
+		{"1.5 & 1", ErrNotInteger},
+		{"pow(10, 400)", nil},
+		{"sqrt(-1)", nil},
+		{"log(0)", nil},
+		{"1e300 * 1e300", nil},
+		{"1e308 + 1e308 - 1e308", nil},
+		{`float("inf")`, nil},
+		{`float("nan")`, nil},
+		{"int(1e300)", nil},
+		{`name * 2`, nil},
+		{"1 << 64", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got, err := eval(t, tt.src)
+			if err == nil {
+				t.Fatalf("got %v, want an error", got)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"empty", " ", "empty expression"},
+		{"unknown function", "nope(1)", "unknown function"},
+		{"arity", "abs(1, 2)", "called with 2 arguments"},
+		{"unbalanced", "(1 + 2", "expected ')'"},
+		{"trailing", "1 2", "unexpected"},
+		{"bad path", "a..b", "invalid field path"},
+		{"bad character", "a # b", "unexpected character"},
+		{"unterminated string", `"abc`, "unterminated string"},
+		{"number out of range", "1e400", "invalid number"},
+		{"too long", strings.Repeat("1+", MaxLength/2) + "1", "longer than"},
+		{"nested parentheses", strings.Repeat("(", MaxDepth+1) + "1" + strings.Repeat(")", MaxDepth+1), "nested deeper"},
+		{"nested unary", strings.Repeat("-", MaxDepth+1) + "1", "nested deeper"},
+		{"nested calls", strings.Repeat("abs(", MaxDepth+1) + "1" + strings.Repeat(")", MaxDepth+1), "nested deeper"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	program, err := Compile("env.temp > 20 && coalesce(a, 0) > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]bool{}
+	for _, f := range program.Fields() {
+		fields[f] = true
+	}
+	if len(fields) != 2 || !fields["env.temp"] || !fields["a"] {
+		t.Fatalf("got fields %v", program.Fields())
+	}
+}
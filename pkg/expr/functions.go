@@ -0,0 +1,199 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"etl-pipeline/pkg/util"
+)
+
+type function struct {
+	minArgs int
+	// maxArgs is -1 for variadic functions.
+	maxArgs int
+	// nullable functions receive null arguments instead of short-circuiting
+	// to a null result.
+	nullable bool
+	impl     func(args []interface{}) (interface{}, error)
+}
+
+func (f function) call(args []interface{}) (interface{}, error) {
+	if !f.nullable {
+		for _, arg := range args {
+			if arg == nil {
+				return nil, nil
+			}
+		}
+	}
+	return f.impl(args)
+}
+
+var functions = map[string]function{
+	"abs":      {minArgs: 1, maxArgs: 1, impl: absFn},
+	"min":      {minArgs: 1, maxArgs: -1, impl: extremeFn(-1)},
+	"max":      {minArgs: 1, maxArgs: -1, impl: extremeFn(1)},
+	"pow":      {minArgs: 2, maxArgs: 2, impl: float2(math.Pow)},
+	"sqrt":     {minArgs: 1, maxArgs: 1, impl: float1(math.Sqrt)},
+	"floor":    {minArgs: 1, maxArgs: 1, impl: float1(math.Floor)},
+	"ceil":     {minArgs: 1, maxArgs: 1, impl: float1(math.Ceil)},
+	"round":    {minArgs: 1, maxArgs: 2, impl: roundFn},
+	"log":      {minArgs: 1, maxArgs: 1, impl: float1(math.Log)},
+	"log10":    {minArgs: 1, maxArgs: 1, impl: float1(math.Log10)},
+	"exp":      {minArgs: 1, maxArgs: 1, impl: float1(math.Exp)},
+	"sin":      {minArgs: 1, maxArgs: 1, impl: float1(math.Sin)},
+	"cos":      {minArgs: 1, maxArgs: 1, impl: float1(math.Cos)},
+	"tan":      {minArgs: 1, maxArgs: 1, impl: float1(math.Tan)},
+	"atan2":    {minArgs: 2, maxArgs: 2, impl: float2(math.Atan2)},
+	"int":      {minArgs: 1, maxArgs: 1, impl: intFn},
+	"float":    {minArgs: 1, maxArgs: 1, impl: floatFn},
+	"coalesce": {minArgs: 1, maxArgs: -1, nullable: true, impl: coalesceFn},
+	"isnull":   {minArgs: 1, maxArgs: 1, nullable: true, impl: isNullFn},
+}
+
+func float1(fn func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, err := numberArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return finite(fn(x))
+	}
+}
+
+func float2(fn func(float64, float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		x, err := numberArg(args[0])
+		if err != nil {
+			return nil, err
+		}
+		y, err := numberArg(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return finite(fn(x, y))
+	}
+}
+
+func absFn(args []interface{}) (interface{}, error) {
+	if i, ok := args[0].(int64); ok {
+		if i == math.MinInt64 {
+			return nil, ErrOverflow
+		}
+		if i < 0 {
+			return -i, nil
+		}
+		return i, nil
+	}
+	x, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return finite(math.Abs(x))
+}
+
+func extremeFn(sign int) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		best := args[0]
+		if !isNumeric(best) {
+			return nil, fmt.Errorf("expected number, got %s", typeName(best))
+		}
+		for _, arg := range args[1:] {
+			if !isNumeric(arg) {
+				return nil, fmt.Errorf("expected number, got %s", typeName(arg))
+			}
+			less, _ := compare("<", arg, best)
+			if (sign < 0) == less.(bool) && !equal(arg, best) {
+				best = arg
+			}
+		}
+		return best, nil
+	}
+}
+
+func roundFn(args []interface{}) (interface{}, error) {
+	x, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		return finite(math.Round(x))
+	}
+	digits, ok := args[1].(int64)
+	if !ok {
+		return nil, fmt.Errorf("digits must be an integer, got %s", typeName(args[1]))
+	}
+	scale := math.Pow(10, float64(digits))
+	switch {
+	case scale == 0:
+		// No float64 reaches that many digits left of the point.
+		return float64(0), nil
+	case math.IsInf(scale, 0) || math.IsInf(x*scale, 0):
+		// x has no digits that fine, so it is already rounded.
+		return finite(x)
+	}
+	return finite(math.Round(x*scale) / scale)
+}
+
+func intFn(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		return util.ToInt64(v)
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		return strconv.ParseInt(v, 0, 64)
+	}
+	return nil, fmt.Errorf("cannot convert %s to int", typeName(args[0]))
+}
+
+func floatFn(args []interface{}) (interface{}, error) {
+	if s, ok := args[0].(string); ok {
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return finite(x)
+	}
+	x, err := numberArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return finite(x)
+}
+
+func coalesceFn(args []interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
+
+func isNullFn(args []interface{}) (interface{}, error) {
+	return args[0] == nil, nil
+}
+
+func numberArg(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return 0, fmt.Errorf("expected number, got %s", typeName(v))
+}
+
+// finite rejects NaN and infinities, which JSONB cannot store.
+func finite(x float64) (interface{}, error) {
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil, fmt.Errorf("result %v is not a finite number", x)
+	}
+	return x, nil
+}
@@ -0,0 +1,118 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are matched longest first.
+var operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "<<", ">>", "&^",
+	"+", "-", "*", "/", "%", "<", ">", "!", "&", "|", "^", "~", "?", ":",
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var b strings.Builder
+			for end < len(src) && rune(src[end]) != c {
+				if src[end] == '\\' && end+1 < len(src) {
+					end++
+				}
+				b.WriteByte(src[end])
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokString, text: b.String(), pos: i})
+			i = end + 1
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			end := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				end += 2
+				for end < len(src) && isHexDigit(src[end]) {
+					end++
+				}
+			} else {
+				for end < len(src) && (unicode.IsDigit(rune(src[end])) || src[end] == '.') {
+					end++
+				}
+				if end < len(src) && (src[end] == 'e' || src[end] == 'E') {
+					end++
+					if end < len(src) && (src[end] == '+' || src[end] == '-') {
+						end++
+					}
+					for end < len(src) && unicode.IsDigit(rune(src[end])) {
+						end++
+					}
+				}
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:end], pos: i})
+			i = end
+		case c == '_' || unicode.IsLetter(c):
+			end := i
+			for end < len(src) && (src[end] == '_' || src[end] == '.' ||
+				unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	tokens = append(tokens, token{kind: tokEOF, pos: len(src)})
+	return tokens, nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,275 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxLength bounds the source size of a single expression.
+	MaxLength = 1024
+	// MaxDepth bounds nesting so a hostile expression cannot exhaust the stack.
+	MaxDepth = 64
+)
+
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "|": 4, "^": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5, "&": 5, "&^": 5,
+}
+
+type node interface {
+	eval(data map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+type fieldNode struct {
+	path string
+}
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+type ternaryNode struct {
+	cond, then, otherwise node
+}
+
+type callNode struct {
+	name string
+	fn   function
+	args []node
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int
+	fields map[string]bool
+}
+
+func parse(src string) (node, []string, error) {
+	if len(src) > MaxLength {
+		return nil, nil, fmt.Errorf("expression longer than %d characters", MaxLength)
+	}
+	if strings.TrimSpace(src) == "" {
+		return nil, nil, errors.New("empty expression")
+	}
+
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &parser{tokens: tokens, fields: make(map[string]bool)}
+	root, err := p.parseTernary()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+
+	fields := make([]string, 0, len(p.fields))
+	for field := range p.fields {
+		fields = append(fields, field)
+	}
+	return root, fields, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return fmt.Errorf("expression nested deeper than %d", MaxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) parseTernary() (node, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	cond, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokOp || tok.text != "?" {
+		return cond, nil
+	}
+	p.next()
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.next(); tok.kind != tokOp || tok.text != ":" {
+		return nil, fmt.Errorf("expected ':' at %d", tok.pos)
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return &ternaryNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+func (p *parser) parseBinary(minPrec int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrecedence[tok.text]
+		if tok.kind != tokOp || !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "-" || tok.text == "!" || tok.text == "~" || tok.text == "^") {
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		op := tok.text
+		if op == "^" {
+			op = "~"
+		}
+		return &unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		value, err := parseNumber(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at %d", tok.text, tok.pos)
+		}
+		return &literalNode{value: value}, nil
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+	case tokLParen:
+		x, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("expected ')' at %d", closing.pos)
+		}
+		return x, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "nil":
+			return &literalNode{value: nil}, nil
+		}
+		if p.peek().kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		if strings.HasPrefix(tok.text, ".") || strings.HasSuffix(tok.text, ".") || strings.Contains(tok.text, "..") {
+			return nil, fmt.Errorf("invalid field path %q at %d", tok.text, tok.pos)
+		}
+		p.fields[tok.text] = true
+		return &fieldNode{path: tok.text}, nil
+	case tokEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.text, name.pos)
+	}
+	p.next()
+
+	var args []node
+	if p.peek().kind != tokRParen {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if closing := p.next(); closing.kind != tokRParen {
+		return nil, fmt.Errorf("expected ')' at %d", closing.pos)
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("function %s called with %d arguments", name.text, len(args))
+	}
+	return &callNode{name: name.text, fn: fn, args: args}, nil
+}
+
+func parseNumber(text string) (interface{}, error) {
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "0x") {
+		return strconv.ParseInt(lower[2:], 16, 64)
+	}
+	if !strings.ContainsAny(lower, ".e") {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i, nil
+		}
+	}
+	return strconv.ParseFloat(text, 64)
+}
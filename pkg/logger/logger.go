@@ -58,6 +58,11 @@ func NewLogger(cfg *config.Config) Logger {
 	return &standardLogger{zapLogger: logger}
 }
 
+// NewNop returns a Logger that discards everything, for tests.
+func NewNop() Logger {
+	return &standardLogger{zapLogger: zap.NewNop()}
+}
+
 func (l *standardLogger) WithField(key string, value interface{}) Logger {
 	return &standardLogger{zapLogger: l.zapLogger.With(zap.Any(key, value))}
 }
@@ -0,0 +1,69 @@
+package metrics
+
+import "sync"
+
+// Label values for tenants and device types that are not reported by name.
+const (
+	OtherTenant   = "other"
+	UnknownTenant = "unknown"
+)
+
+// labelSet keeps the first values seen, up to limit, as label values; the
+// rest share OtherTenant so label cardinality stays bounded.
+type labelSet struct {
+	sync.Mutex
+	limit int
+	seen  map[string]struct{}
+}
+
+var (
+	tenants     = &labelSet{limit: 100, seen: make(map[string]struct{})}
+	deviceTypes = &labelSet{limit: 100, seen: make(map[string]struct{})}
+)
+
+func (s *labelSet) setLimit(limit int) {
+	s.Lock()
+	defer s.Unlock()
+	s.limit = limit
+}
+
+func (s *labelSet) value(v string) string {
+	if v == "" {
+		return UnknownTenant
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.seen[v]; ok {
+		return v
+	}
+	if len(s.seen) < s.limit {
+		s.seen[v] = struct{}{}
+		return v
+	}
+	return OtherTenant
+}
+
+// SetTenantLimit sets how many distinct tenants get their own label value.
+func SetTenantLimit(limit int) {
+	tenants.setLimit(limit)
+}
+
+// SetDeviceTypeLimit sets how many distinct device types get their own
+// label value.
+func SetDeviceTypeLimit(limit int) {
+	deviceTypes.setLimit(limit)
+}
+
+// Tenant returns the label value for tenantID. The first tenants seen, up
+// to the limit, keep their ID; the rest share OtherTenant so label
+// cardinality stays bounded.
+func Tenant(tenantID string) string {
+	return tenants.value(tenantID)
+}
+
+// DeviceType returns the label value for deviceType, bounded like Tenant.
+func DeviceType(deviceType string) string {
+	return deviceTypes.value(deviceType)
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "etl_pipeline"
+
+var (
+	SchemaDriftTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_drift_total",
+		Help:      "Schema drift events detected, by kind.",
+	}, []string{"tenant", "device_type", "kind"})
+
+	QualityViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quality_violations_total",
+		Help:      "Data quality rule violations, by rule.",
+	}, []string{"tenant", "rule"})
+
+	SinkFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_failures_total",
+		Help:      "Records a sink failed to deliver after its retries, by sink.",
+	}, []string{"sink"})
+
+	SpoolRecordsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spool_records_total",
+		Help:      "Records handled by the disk spool, by result.",
+	}, []string{"result"})
+
+	SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_bytes",
+		Help:      "Bytes held by the disk spool.",
+	})
+
+	SpoolSegments = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_segments",
+		Help:      "Segment files held by the disk spool.",
+	})
+
+	MessagesConsumedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages read from Kafka, by topic.",
+	}, []string{"topic"})
+
+	MessagesProcessedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_processed_total",
+		Help:      "Messages that went through every stage, by tenant.",
+	}, []string{"tenant"})
+
+	MessagesFailedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_total",
+		Help:      "Messages that still failed after all retries, by topic.",
+	}, []string{"topic"})
+
+	StageFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stage_failures_total",
+		Help:      "Messages that failed after all retries, by tenant, failing stage and error class.",
+	}, []string{"tenant", "stage", "class"})
+
+	DLQWritesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dlq_writes_total",
+		Help:      "Messages written to the DLQ, by the sink that failed (pipeline for whole messages) and result.",
+	}, []string{"sink", "result"})
+
+	CommitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commits_total",
+		Help:      "Offset commit batches, by result.",
+	}, []string{"result"})
+
+	CommittedMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "committed_messages_total",
+		Help:      "Messages whose offsets were committed.",
+	})
+
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent in each pipeline stage.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"stage"})
+
+	EndToEndDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "end_to_end_seconds",
+		Help:      "Time from a message being appended to Kafka until it is processed.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+	})
+
+	PoolQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_queue_depth",
+		Help:      "Messages waiting for a worker.",
+	})
+
+	PoolBusyWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_busy_workers",
+		Help:      "Workers processing a message.",
+	})
+
+	PendingCommits = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pending_commits",
+		Help:      "Processed messages whose offsets are not committed yet.",
+	})
+
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Messages behind the partition high-water mark, as of the last message read.",
+	}, []string{"topic", "partition"})
+
+	ReaderLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reader_lag",
+		Help:      "Consumer lag reported by the Kafka reader stats.",
+	})
+
+	ReaderQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reader_queue_length",
+		Help:      "Messages fetched by the Kafka reader but not read yet.",
+	})
+)
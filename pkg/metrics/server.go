@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"etl-pipeline/config"
+	"etl-pipeline/pkg/logger"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// RunServer serves the default registry on METRICS_ADDR at /metrics.
+func RunServer(lc fx.Lifecycle, cfg *config.Config, log logger.Logger) {
+	SetTenantLimit(cfg.Metrics.MaxTenants)
+	SetDeviceTypeLimit(cfg.Metrics.MaxDeviceTypes)
+	if cfg.Metrics.Addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: cfg.Metrics.Addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			listener, err := net.Listen("tcp", cfg.Metrics.Addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Error("Metrics server stopped", zap.Error(err))
+				}
+			}()
+			log.Info("Serving metrics", zap.String("addr", cfg.Metrics.Addr))
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			return server.Shutdown(ctx)
+		},
+	})
+}
+
+var Module = fx.Options(
+	fx.Invoke(RunServer),
+)
@@ -0,0 +1,36 @@
+package util
+
+// Rejected is an item Bisect isolated, with the error writing it alone.
+type Rejected[T any] struct {
+	Item T
+	Err  error
+}
+
+// Bisect writes items as one batch. When the batch fails with an error
+// isolatable reports as caused by its contents, the halves are written on
+// their own, recursively, until the failing items are isolated. The rest
+// is written normally. Any other error stops the bisection and is returned
+// along with the items not written yet. write must be atomic.
+func Bisect[T any](items []T, write func([]T) error, isolatable func(error) bool) ([]Rejected[T], []T, error) {
+	if len(items) == 0 {
+		return nil, nil, nil
+	}
+	err := write(items)
+	if err == nil {
+		return nil, nil, nil
+	}
+	if !isolatable(err) {
+		return nil, items, err
+	}
+	if len(items) == 1 {
+		return []Rejected[T]{{Item: items[0], Err: err}}, nil, nil
+	}
+
+	mid := len(items) / 2
+	left, pending, err := Bisect(items[:mid], write, isolatable)
+	if err != nil {
+		return left, append(pending, items[mid:]...), err
+	}
+	right, pending, err := Bisect(items[mid:], write, isolatable)
+	return append(left, right...), pending, err
+}
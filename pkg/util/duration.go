@@ -0,0 +1,54 @@
+package util
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// ParseDuration accepts time.ParseDuration units plus d for days, e.g. 90d
+// or 1d12h. Days come first, as the largest unit.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("empty duration")
+	}
+	days, rest, ok := strings.Cut(s, "d")
+	if !ok {
+		return time.ParseDuration(s)
+	}
+
+	sign := time.Duration(1)
+	if strings.HasPrefix(days, "-") {
+		sign, days = -1, days[1:]
+	} else {
+		days = strings.TrimPrefix(days, "+")
+	}
+	if days == "" || strings.Trim(days, "0123456789.") != "" {
+		return 0, errors.New("invalid duration " + s)
+	}
+	// Days are parsed as hours so fractions such as 1.5d work.
+	d, err := time.ParseDuration(days + "h")
+	if err != nil {
+		return 0, errors.New("invalid duration " + s)
+	}
+	if d > math.MaxInt64/24 {
+		return 0, errors.New("duration out of range " + s)
+	}
+	d *= 24
+
+	if rest != "" {
+		if strings.ContainsAny(rest[:1], "+-") {
+			return 0, errors.New("invalid duration " + s)
+		}
+		r, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, errors.New("invalid duration " + s)
+		}
+		if d > math.MaxInt64-r {
+			return 0, errors.New("duration out of range " + s)
+		}
+		d += r
+	}
+	return sign * d, nil
+}
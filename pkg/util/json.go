@@ -0,0 +1,23 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// UnmarshalJSON decodes data into v like json.Unmarshal, but keeps numbers as
+// json.Number so large integers and decimals are not rounded through float64.
+func UnmarshalJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
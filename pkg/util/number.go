@@ -0,0 +1,179 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ToFloat64 converts a decoded JSON value to float64. Strings are accepted
+// when they hold a plain number.
+func ToFloat64(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot convert %T to number", v)
+}
+
+// ErrIntRange is returned for values that do not fit into an int64.
+var ErrIntRange = errors.New("value out of int64 range")
+
+// ToInt64 converts a decoded JSON value to int64 without going through
+// float64 when the value is already an exact integer. Fractions are
+// truncated; values outside the int64 range are an error rather than being
+// wrapped.
+func ToInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return parseInt64(n.String())
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, fmt.Errorf("%d: %w", n, ErrIntRange)
+		}
+		return int64(n), nil
+	case string:
+		return parseInt64(strings.TrimSpace(n))
+	}
+	f, err := ToFloat64(v)
+	if err != nil {
+		return 0, err
+	}
+	return floatToInt64(f)
+}
+
+func parseInt64(s string) (int64, error) {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return i, nil
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%s: %w", s, ErrIntRange)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return floatToInt64(f)
+}
+
+// floatToInt64 truncates f. float64(math.MaxInt64) rounds up to 2^63, which
+// is already out of range.
+func floatToInt64(f float64) (int64, error) {
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v: %w", f, ErrIntRange)
+	}
+	return int64(f), nil
+}
+
+// IsNumber reports whether v is a numeric value produced by the decoder or by
+// an earlier transform.
+func IsNumber(v interface{}) bool {
+	switch v.(type) {
+	case json.Number, float64, float32, int, int32, int64, uint64:
+		return true
+	}
+	return false
+}
+
+// ToRat converts a decoded JSON number to an exact rational, so arithmetic on
+// large counters does not lose precision.
+func ToRat(v interface{}) (*big.Rat, error) {
+	switch n := v.(type) {
+	case json.Number:
+		r, ok := new(big.Rat).SetString(n.String())
+		if !ok {
+			return nil, fmt.Errorf("invalid number %q", n)
+		}
+		return r, nil
+	case string:
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(n))
+		if !ok {
+			return nil, fmt.Errorf("invalid number %q", n)
+		}
+		return r, nil
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), nil
+	case int64:
+		return new(big.Rat).SetInt64(n), nil
+	case uint64:
+		return new(big.Rat).SetUint64(n), nil
+	}
+	f, err := ToFloat64(v)
+	if err != nil {
+		return nil, err
+	}
+	r := new(big.Rat)
+	if r.SetFloat64(f) == nil {
+		return nil, fmt.Errorf("invalid number %v", f)
+	}
+	return r, nil
+}
+
+// maxExactDecimals bounds the decimals RatToNumber writes out exactly.
+const maxExactDecimals = 30
+
+// RatToNumber renders r exactly when it has a finite decimal expansion of
+// reasonable length, such as 0.15 or 1.0000000001. Other values, such as a
+// third or a joule in watt hours, are rounded to the nearest float64 and
+// written with the fewest digits that read back as it.
+func RatToNumber(r *big.Rat) json.Number {
+	if r.IsInt() {
+		return json.Number(r.Num().String())
+	}
+	if decimals, ok := decimalPlaces(r.Denom()); ok {
+		return json.Number(r.FloatString(decimals))
+	}
+	f, _ := r.Float64()
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+}
+
+// decimalPlaces returns how many decimals 1/denom needs, which is finite
+// only when denom has no prime factors besides 2 and 5.
+func decimalPlaces(denom *big.Int) (int, bool) {
+	d := new(big.Int).Set(denom)
+	twos := int(d.TrailingZeroBits())
+	d.Rsh(d, uint(twos))
+
+	fives := 0
+	five, q, r := big.NewInt(5), new(big.Int), new(big.Int)
+	for {
+		q.QuoRem(d, five, r)
+		if r.Sign() != 0 {
+			break
+		}
+		d.Set(q)
+		fives++
+	}
+	decimals := max(twos, fives)
+	return decimals, d.IsInt64() && d.Int64() == 1 && decimals <= maxExactDecimals
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestToInt64(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  int64
+		err   error
+	}{
+		{"json number above 2^53", json.Number("9007199254740993"), 9007199254740993, nil},
+		{"json number max int64", json.Number("9223372036854775807"), math.MaxInt64, nil},
+		{"json number min int64", json.Number("-9223372036854775808"), math.MinInt64, nil},
+		{"json number above int64", json.Number("9223372036854775808"), 0, ErrIntRange},
+		{"json number max uint64", json.Number("18446744073709551615"), 0, ErrIntRange},
+		{"json number exponent", json.Number("1e3"), 1000, nil},
+		{"json number exponent above int64", json.Number("1e19"), 0, ErrIntRange},
+		{"json number fraction", json.Number("12.9"), 12, nil},
+		{"uint64 above 2^53", uint64(1<<53 + 1), 1<<53 + 1, nil},
+		{"uint64 above int64", uint64(math.MaxUint64), 0, ErrIntRange},
+		{"string above 2^53", " 9007199254740993 ", 9007199254740993, nil},
+		{"string above int64", "18446744073709551615", 0, ErrIntRange},
+		{"float64 2^63", float64(1 << 63), 0, ErrIntRange},
+		{"float64 NaN", math.NaN(), 0, ErrIntRange},
+		{"float64 -Inf", math.Inf(-1), 0, ErrIntRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToInt64(tt.value)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ToInt64(%v) error = %v, want %v", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ToInt64(%v) = %d, %v, want %d", tt.value, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestToRatUint64(t *testing.T) {
+	r, err := ToRat(uint64(math.MaxUint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := RatToNumber(r); got != "18446744073709551615" {
+		t.Fatalf("RatToNumber = %s", got)
+	}
+}
+
+func TestRatToNumber(t *testing.T) {
+	tests := []struct {
+		value string
+		want  json.Number
+	}{
+		{"42", "42"},
+		{"-0.5", "-0.5"},
+		{"0.15", "0.15"},
+		{"1.0000000001", "1.0000000001"},
+		{"123456789.123456789123", "123456789.123456789123"},
+		{"1/3", "0.3333333333333333"},
+		{"1/3600", "0.0002777777777777778"},
+		{"1/3600000000", "2.7777777777777777e-10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			r, ok := new(big.Rat).SetString(tt.value)
+			if !ok {
+				t.Fatalf("invalid test value %q", tt.value)
+			}
+			if got := RatToNumber(r); got != tt.want {
+				t.Fatalf("RatToNumber(%s) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJSONRoundTrip(t *testing.T) {
+	input := `{"big":9007199254740993,"max":18446744073709551615,"neg":-9223372036854775808,"small":1.5}`
+
+	var data map[string]interface{}
+	if err := UnmarshalJSON([]byte(input), &data); err != nil {
+		t.Fatal(err)
+	}
+	output, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != input {
+		t.Fatalf("round trip = %s, want %s", output, input)
+	}
+}
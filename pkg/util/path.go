@@ -0,0 +1,68 @@
+package util
+
+import "strings"
+
+// SplitPath splits a dotted field path such as "phase.l1.v" into its segments.
+func SplitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// GetPath returns the value at a dotted path in data. Missing segments and
+// non-object parents yield (nil, false) instead of panicking.
+func GetPath(data map[string]interface{}, path string) (interface{}, bool) {
+	segments := SplitPath(path)
+	var current interface{} = data
+	for _, segment := range segments {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[segment]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// SetPath stores value at a dotted path in data, creating intermediate
+// objects as needed. It returns false when a non-object value is in the way.
+func SetPath(data map[string]interface{}, path string, value interface{}) bool {
+	segments := SplitPath(path)
+	current := data
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := current[segment]
+		if !ok || next == nil {
+			child := make(map[string]interface{})
+			current[segment] = child
+			current = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		current = child
+	}
+	current[segments[len(segments)-1]] = value
+	return true
+}
+
+// DeletePath removes the value at a dotted path and returns it.
+func DeletePath(data map[string]interface{}, path string) (interface{}, bool) {
+	segments := SplitPath(path)
+	current := data
+	for _, segment := range segments[:len(segments)-1] {
+		child, ok := current[segment].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current = child
+	}
+	last := segments[len(segments)-1]
+	value, ok := current[last]
+	if ok {
+		delete(current, last)
+	}
+	return value, ok
+}
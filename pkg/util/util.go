@@ -1,6 +1,17 @@
 package util
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	KeyCaseKeep  = "keep"
+	KeyCaseCamel = "camel"
+	KeyCaseSnake = "snake"
+	KeyCaseLower = "lower"
+)
 
 func ToCamelCase(s string) string {
 	parts := strings.Split(s, "_")
@@ -11,3 +22,48 @@ func ToCamelCase(s string) string {
 	}
 	return strings.Join(parts, "")
 }
+
+func ToSnakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && runes[i-1] != '_' && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		if r == '-' || r == ' ' {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ValidKeyCase reports whether style is one of the supported key case names.
+func ValidKeyCase(style string) bool {
+	switch style {
+	case KeyCaseKeep, KeyCaseCamel, KeyCaseSnake, KeyCaseLower:
+		return true
+	}
+	return false
+}
+
+// ConvertKeyCase renames key according to style.
+func ConvertKeyCase(key, style string) (string, error) {
+	switch style {
+	case KeyCaseKeep, "":
+		return key, nil
+	case KeyCaseCamel:
+		return ToCamelCase(key), nil
+	case KeyCaseSnake:
+		return ToSnakeCase(key), nil
+	case KeyCaseLower:
+		return strings.ToLower(key), nil
+	}
+	return "", fmt.Errorf("unknown key case %q", style)
+}